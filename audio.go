@@ -0,0 +1,510 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Header of a frame of MPEG audio.
+type mpegFrame struct {
+	// 1 for MPEG-1, 2 for MPEG-2 and MPEG-2.5
+	version int
+	layer   int
+	// Bits per second
+	bitrate int
+	// Samples per second and per frame
+	rate, samples int
+	// Size of the frame in bytes
+	size int
+	mono bool
+}
+
+// Bitrates in kbit/s of MPEG-1 layers I to III and of MPEG-2 layer I
+// and layers II and III, by index.
+var mpegBitrates = [5][15]int{
+	{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegRates = [3]int{44100, 48000, 32000}
+
+// Parses a frame header, see isMPEGAudio.
+func parseMPEGFrame(b []byte) (mpegFrame, bool) {
+	if !isMPEGAudio(b) {
+		return mpegFrame{}, false
+	}
+	var f mpegFrame
+	version := b[1] >> 3 & 3
+	f.layer = int(4 - b[1]>>1&3)
+	f.rate = mpegRates[b[2]>>2&3]
+	f.mono = b[3]>>6 == 3
+	table := f.layer - 1
+	switch version {
+	case 3:
+		f.version = 1
+	case 2:
+		f.version, f.rate = 2, f.rate/2
+	case 0:
+		// MPEG-2.5
+		f.version, f.rate = 2, f.rate/4
+	}
+	if f.version == 2 {
+		table = 4
+		if f.layer == 1 {
+			table = 3
+		}
+	}
+	f.bitrate = mpegBitrates[table][b[2]>>4] * 1000
+	padding := int(b[2] >> 1 & 1)
+	switch {
+	case f.layer == 1:
+		f.samples = 384
+		f.size = (12*f.bitrate/f.rate + padding) * 4
+	case f.layer == 3 && f.version == 2:
+		f.samples = 576
+		f.size = 72*f.bitrate/f.rate + padding
+	default:
+		f.samples = 1152
+		f.size = 144*f.bitrate/f.rate + padding
+	}
+	return f, true
+}
+
+// Number of frames in the VBR header of the first frame b, written by
+// LAME (Xing or Info) or by Fraunhofer encoders (VBRI).
+func (f mpegFrame) vbrFrames(b []byte) (int64, bool) {
+	// The Xing header follows the side information
+	side := 17
+	switch {
+	case f.version == 1 && !f.mono:
+		side = 32
+	case f.version == 2 && f.mono:
+		side = 9
+	}
+	if x := b[min(4+side, len(b)):]; len(x) >= 12 && (bytes.HasPrefix(x, []byte("Xing")) || bytes.HasPrefix(x, []byte("Info"))) {
+		if binary.BigEndian.Uint32(x[4:])&1 == 0 {
+			return 0, false
+		}
+		return int64(binary.BigEndian.Uint32(x[8:])), true
+	}
+	if x := b[min(36, len(b)):]; len(x) >= 18 && bytes.HasPrefix(x, []byte("VBRI")) {
+		return int64(binary.BigEndian.Uint32(x[14:])), true
+	}
+	return 0, false
+}
+
+var errNoMPEGFrame = errors.New("MPEG audio: no frame header")
+
+// Bytes searched for the first frame, after the ID3 tag.
+const mpegSyncSize = 64 << 10
+
+// Extracts the ID3 tags and the duration and bitrate of MP3 files,
+// from the VBR header or, without one, from the first frame.
+func mp3Meta(c *contents, m metadata) error {
+	start, err := readID3v2(c, m)
+	end := c.size
+	if t := c.at(c.size-128, 128); t != nil && bytes.HasPrefix(t, []byte("TAG")) {
+		readID3v1(t, m)
+		end -= 128
+	}
+	b := boxData(c, start, end-start, mpegSyncSize)
+	var f mpegFrame
+	for i := 0; ; i++ {
+		if i+4 > len(b) {
+			if err == nil {
+				err = errNoMPEGFrame
+			}
+			return err
+		}
+		var ok bool
+		// A valid header is followed by another one, or the end
+		if f, ok = parseMPEGFrame(b[i:]); ok {
+			next := i + f.size
+			if _, ok := parseMPEGFrame(b[min(next, len(b)):]); ok || int64(next) >= end-start || next+4 > len(b) {
+				start += int64(i)
+				b = b[i:]
+				break
+			}
+		}
+	}
+	size := end - start
+	if frames, ok := f.vbrFrames(b); ok {
+		setDuration(m, float64(frames*int64(f.samples))/float64(f.rate), size)
+		return err
+	}
+	m.set("bitrate", strconv.Itoa(f.bitrate))
+	setDuration(m, float64(size)*8/float64(f.bitrate), size)
+	return err
+}
+
+var errID3 = errors.New("ID3: invalid tag")
+
+// Reads an ID3v2 tag at the start of the contents and returns its size.
+func readID3v2(c *contents, m metadata) (int64, error) {
+	h := c.at(0, 10)
+	if h == nil || !bytes.HasPrefix(h, []byte("ID3")) {
+		return 0, nil
+	}
+	version, flags := h[3], h[5]
+	size := int64(syncsafe(h[6:10])) + 10
+	// Footer
+	if flags&0x10 != 0 {
+		size += 10
+	}
+	b := c.at(10, size-10)
+	if b == nil || version < 2 || version > 4 {
+		return size, errID3
+	}
+	// Unsynchronisation of the whole tag, versions before 4
+	if flags&0x80 != 0 && version < 4 {
+		b = bytes.ReplaceAll(b, []byte{0xff, 0}, []byte{0xff})
+	}
+	// Extended header
+	if flags&0x40 != 0 && version > 2 && len(b) >= 4 {
+		n := int(binary.BigEndian.Uint32(b))
+		if version == 4 {
+			n = int(syncsafe(b))
+		} else {
+			n += 4
+		}
+		b = b[min(n, len(b)):]
+	}
+	frames := make(map[string]string)
+	idSize, hdrSize := 4, 10
+	if version == 2 {
+		idSize, hdrSize = 3, 6
+	}
+	for len(b) >= hdrSize && b[0] != 0 {
+		id := string(b[:idSize])
+		var n int
+		switch version {
+		case 2:
+			n = int(b[3])<<16 | int(b[4])<<8 | int(b[5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(b[4:]))
+		case 4:
+			n = int(syncsafe(b[4:]))
+		}
+		if n < 0 || n > len(b)-hdrSize {
+			return size, errID3
+		}
+		data, fl := b[hdrSize:hdrSize+n], byte(0)
+		if version > 2 {
+			fl = b[9]
+		}
+		b = b[hdrSize+n:]
+		switch {
+		// Compressed or encrypted frames are not read
+		case version == 3 && fl&0xc0 != 0, version == 4 && fl&0x0c != 0:
+			continue
+		case version == 4:
+			// Data length before the data, and unsynchronisation
+			if fl&0x01 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+			if fl&0x02 != 0 {
+				data = bytes.ReplaceAll(data, []byte{0xff, 0}, []byte{0xff})
+			}
+		}
+		if _, ok := frames[id]; !ok {
+			frames[id] = id3Text(id, data)
+		}
+	}
+	for _, f := range []struct{ name, v2, v3 string }{
+		{"title", "TT2", "TIT2"},
+		{"description", "COM", "COMM"},
+		{"creator", "TP1", "TPE1"},
+		{"copyright", "TCR", "TCOP"},
+		{"creator_tool", "TSS", "TSSE"},
+		{"content_creation_date", "TYE", "TDRC"},
+		{"content_creation_date", "", "TYER"},
+	} {
+		v := frames[f.v3]
+		if version == 2 {
+			v = frames[f.v2]
+		}
+		if strings.HasPrefix(f.name, "content_") {
+			v = xmpTime(v)
+		}
+		m.set(f.name, v)
+	}
+	return size, nil
+}
+
+// Integers of ID3 tags with the highest bit of each byte unset.
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// Returns the text of text and comment frames of ID3 tags.  Comments
+// have a language and a description before the text.
+func id3Text(id string, b []byte) string {
+	if len(b) < 1 || (id[0] != 'T' && id != "COMM" && id != "COM") {
+		return ""
+	}
+	enc, b := b[0], b[1:]
+	if id[0] == 'C' {
+		if len(b) < 3 {
+			return ""
+		}
+		b = b[3:]
+		// Description, terminated like the text
+		term := []byte{0}
+		if enc == 1 || enc == 2 {
+			term = []byte{0, 0}
+		}
+		for i := 0; i+len(term) <= len(b); i += len(term) {
+			if bytes.Equal(b[i:i+len(term)], term) {
+				b = b[i+len(term):]
+				break
+			}
+		}
+	}
+	var s string
+	switch enc {
+	case 0:
+		// Latin-1
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			order, b = binary.LittleEndian, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			b = b[2:]
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u = append(u, order.Uint16(b[i:]))
+		}
+		s = string(utf16.Decode(u))
+	case 3:
+		s = string(b)
+	}
+	// Lists of values are separated by NUL in version 4
+	return strings.TrimRight(strings.ReplaceAll(strings.TrimRight(s, "\x00"), "\x00", ", "), ", ")
+}
+
+// Reads an ID3v1 tag of 128 bytes at the end of the file.
+func readID3v1(b []byte, m metadata) {
+	field := func(from, to int) string {
+		s := b[from:to]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(string(s))
+	}
+	m.set("title", field(3, 33))
+	m.set("creator", field(33, 63))
+	m.set("content_creation_date", xmpTime(field(93, 97)))
+	m.set("description", field(97, 125))
+}
+
+var errRIFFChunk = errors.New("RIFF: invalid chunk")
+
+// Extracts the duration and bitrate of WAV files from the format and
+// the size of the data chunk.
+func wavMeta(c *contents, m metadata) error {
+	h := c.at(0, 12)
+	if h == nil || string(h[:4]) != "RIFF" || string(h[8:]) != "WAVE" {
+		return nil
+	}
+	var byteRate uint32
+	for off := int64(12); off+8 <= c.size; {
+		h := c.at(off, 8)
+		if h == nil {
+			return errRIFFChunk
+		}
+		id, n := string(h[:4]), int64(binary.LittleEndian.Uint32(h[4:]))
+		switch id {
+		case "fmt ":
+			b := c.at(off+8, 16)
+			if b == nil {
+				return errRIFFChunk
+			}
+			byteRate = binary.LittleEndian.Uint32(b[8:])
+		case "data":
+			// Streams write the data before knowing its size
+			if n == 0 || n == 0xffffffff || n > c.size-off-8 {
+				n = c.size - off - 8
+			}
+			if byteRate == 0 {
+				return errRIFFChunk
+			}
+			m.set("bitrate", strconv.Itoa(int(byteRate)*8))
+			setDuration(m, float64(n)/float64(byteRate), n)
+			return nil
+		}
+		// Chunks are padded to even sizes
+		off += 8 + n + n&1
+	}
+	return nil
+}
+
+// Reads the STREAMINFO block of FLAC: sample rate in 20 bits and, after
+// the channels and the bits per sample, total samples in 36 bits.
+func flacStreamInfo(b []byte) (rate int, samples int64, ok bool) {
+	if len(b) < 18 {
+		return 0, 0, false
+	}
+	rate = int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+	samples = int64(b[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(b[14:]))
+	return rate, samples, rate > 0
+}
+
+func flacMeta(c *contents, m metadata) error {
+	b := c.at(0, 8+34)
+	if b == nil || !bytes.HasPrefix(b, []byte("fLaC")) {
+		return nil
+	}
+	// The first metadata block is always STREAMINFO
+	if b[4]&0x7f != 0 {
+		return errors.New("FLAC: no STREAMINFO block")
+	}
+	rate, samples, ok := flacStreamInfo(b[8:])
+	if ok {
+		setDuration(m, float64(samples)/float64(rate), c.size)
+	}
+	return nil
+}
+
+// Page of an Ogg file: the granule position, the serial number of the
+// logical stream and the packet data.
+type oggPage struct {
+	flags   byte
+	granule int64
+	serial  uint32
+	// Size of the header and of the data
+	hdr, size int
+}
+
+// Parses the page header at the start of b.
+func parseOggPage(b []byte) (oggPage, bool) {
+	if len(b) < 27 || !bytes.HasPrefix(b, []byte("OggS")) || b[4] != 0 {
+		return oggPage{}, false
+	}
+	p := oggPage{
+		flags:   b[5],
+		granule: int64(binary.LittleEndian.Uint64(b[6:])),
+		serial:  binary.LittleEndian.Uint32(b[14:]),
+		hdr:     27 + int(b[26]),
+	}
+	if len(b) < p.hdr {
+		return oggPage{}, false
+	}
+	for _, n := range b[27:p.hdr] {
+		p.size += int(n)
+	}
+	return p, true
+}
+
+// Logical stream of an Ogg file, by its first packet.
+type oggStream struct {
+	// Granule positions per second, and those to skip at the start
+	rate, skip int64
+	// Theora counts frames in two parts of the granule position, at
+	// num/den frames per second
+	shift    uint
+	num, den int64
+	// Size of video
+	width, height uint64
+}
+
+func newOggStream(packet []byte) *oggStream {
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		return &oggStream{rate: int64(binary.LittleEndian.Uint32(packet[12:]))}
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+		// Always 48kHz, whatever the rate of the input was
+		return &oggStream{rate: 48000, skip: int64(binary.LittleEndian.Uint16(packet[10:]))}
+	case bytes.HasPrefix(packet, []byte("\x7fFLAC")) && len(packet) >= 13+4+18:
+		if rate, _, ok := flacStreamInfo(packet[17:]); ok {
+			return &oggStream{rate: int64(rate)}
+		}
+	case bytes.HasPrefix(packet, []byte("\x80theora")) && len(packet) >= 42:
+		// Picture size of 24 bits, frame rate as a fraction
+		s := &oggStream{
+			num:    int64(binary.BigEndian.Uint32(packet[22:])),
+			den:    int64(binary.BigEndian.Uint32(packet[26:])),
+			shift:  uint(packet[40]&3<<3 | packet[41]>>5),
+			width:  uint64(packet[14])<<16 | uint64(packet[15])<<8 | uint64(packet[16]),
+			height: uint64(packet[17])<<16 | uint64(packet[18])<<8 | uint64(packet[19]),
+		}
+		if s.num > 0 && s.den > 0 {
+			return s
+		}
+	}
+	return nil
+}
+
+// Returns the time of a granule position, in seconds.
+func (s *oggStream) seconds(granule int64) float64 {
+	if s.num > 0 {
+		// Frames since the last key frame are in the lowest bits
+		frames := granule>>s.shift + granule&(1<<s.shift-1)
+		return float64(frames) * float64(s.den) / float64(s.num)
+	}
+	return float64(granule-s.skip) / float64(s.rate)
+}
+
+var errOggPage = errors.New("Ogg: invalid page")
+
+// Extracts the duration and the video size of Ogg files: the streams
+// are identified by the first pages, their duration is the position
+// of the last one.
+func oggMeta(c *contents, m metadata) error {
+	if !bytes.HasPrefix(c.head, []byte("OggS")) {
+		return nil
+	}
+	streams := make(map[uint32]*oggStream)
+	b := c.head
+	for {
+		p, ok := parseOggPage(b)
+		// The pages starting the streams come first
+		if !ok || p.flags&2 == 0 {
+			break
+		}
+		if len(b) < p.hdr+p.size {
+			return errOggPage
+		}
+		if s := newOggStream(b[p.hdr : p.hdr+p.size]); s != nil {
+			streams[p.serial] = s
+		}
+		b = b[p.hdr+p.size:]
+	}
+	if len(streams) == 0 {
+		return nil
+	}
+	var duration float64
+	for tail := c.tail; ; {
+		i := bytes.LastIndex(tail, []byte("OggS"))
+		if i < 0 {
+			break
+		}
+		if p, ok := parseOggPage(tail[i:]); ok && p.granule > 0 {
+			if s := streams[p.serial]; s != nil {
+				duration = max(duration, s.seconds(p.granule))
+			}
+		}
+		tail = tail[:i]
+	}
+	setDuration(m, duration, c.size)
+	for _, s := range streams {
+		setSize(m, s.width, s.height)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Default of $GLOBALS['TYPO3_CONF_VARS']['BE']['fileDenyPattern'],
+// the names TYPO3 does not accept for uploads.
+const typo3DenyPattern = `\.(php[3-8]?|phpsh|phtml|pht|phar|shtml|cgi)(\..*)?$|\.pl$|^\.htaccess$`
+
+// Reasons to report a file in the audit
+const (
+	// Name matches the deny patterns
+	auditDenied = "denied"
+	// Any of the executable permission bits is set
+	auditExecutable = "executable"
+	// Name starts with a dot
+	auditHidden = "hidden"
+)
+
+var auditFindings = []string{auditDenied, auditExecutable, auditHidden}
+
+// Findings of the audit, as a comma separated flag value.
+type findingList []string
+
+func (l *findingList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *findingList) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !validFinding(s) {
+			return fmt.Errorf("unknown finding %q, valid ones are %s", s, strings.Join(auditFindings, ", "))
+		}
+		*l = append(*l, s)
+	}
+	return nil
+}
+
+func validFinding(s string) bool {
+	for _, f := range auditFindings {
+		if s == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports files that should not be in a storage, writing them as CSV.
+type auditor struct {
+	deny []*regexp.Regexp
+	// Files with these findings get no record
+	skip map[string]bool
+	mu   sync.Mutex
+	w    *csv.Writer
+	// Number of files with each finding
+	counts map[string]int
+}
+
+// Creates an auditor that writes to w, if not nil.  Names are matched
+// against the regular expressions in patterns like TYPO3 does, without
+// regard to case, or against the default fileDenyPattern if there are none.
+func newAuditor(w io.Writer, patterns []string, skip []string) (*auditor, error) {
+	if len(patterns) == 0 {
+		patterns = []string{typo3DenyPattern}
+	}
+	a := &auditor{
+		skip:   make(map[string]bool),
+		counts: make(map[string]int),
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("deny pattern %s: %s", p, err)
+		}
+		a.deny = append(a.deny, re)
+	}
+	for _, s := range skip {
+		a.skip[s] = true
+	}
+	if w != nil {
+		a.w = csv.NewWriter(w)
+		a.w.Write([]string{"path", "findings", "permissions"})
+	}
+	return a, nil
+}
+
+// Returns what is wrong with file f.
+func (a *auditor) findings(f *file) []string {
+	var found []string
+	for _, re := range a.deny {
+		if re.MatchString(f.base) {
+			found = append(found, auditDenied)
+			break
+		}
+	}
+	if f.Mode().IsRegular() && f.Mode().Perm()&0111 != 0 {
+		found = append(found, auditExecutable)
+	}
+	if strings.HasPrefix(f.base, ".") {
+		found = append(found, auditHidden)
+	}
+	return found
+}
+
+// Reports file f with path name if it has any finding.  Returns
+// false if no record should be written for it.
+func (a *auditor) check(name string, f *file) bool {
+	if a == nil {
+		return true
+	}
+	found := a.findings(f)
+	if len(found) == 0 {
+		return true
+	}
+	keep := true
+	for _, s := range found {
+		if a.skip[s] {
+			keep = false
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range found {
+		a.counts[s]++
+	}
+	if a.w != nil {
+		a.w.Write([]string{name, strings.Join(found, ";"), f.Mode().Perm().String()})
+	}
+	return keep
+}
+
+func (a *auditor) flush() error {
+	if a == nil || a.w == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Flush()
+	return a.w.Error()
+}
+
+// Writes the number of files with each finding.
+func (a *auditor) summary(w io.Writer) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range auditFindings {
+		if a.counts[s] == 0 {
+			continue
+		}
+		var note string
+		if a.skip[s] {
+			note = ", not indexed"
+		}
+		fmt.Fprintf(w, "Files found by the audit, %s: %d%s\n", s, a.counts[s], note)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (i testInfo) Name() string       { return i.name }
+func (i testInfo) Size() int64        { return 0 }
+func (i testInfo) Mode() os.FileMode  { return i.mode }
+func (i testInfo) ModTime() time.Time { return time.Time{} }
+func (i testInfo) IsDir() bool        { return false }
+func (i testInfo) Sys() interface{}   { return nil }
+
+func TestAuditFindings(t *testing.T) {
+	var tests = []struct {
+		name     string
+		mode     os.FileMode
+		findings string
+	}{
+		{"photo.jpg", 0644, ""},
+		{"shell.php", 0644, "denied"},
+		{"shell.PHP5", 0644, "denied"},
+		{"shell.php.jpg", 0644, "denied"},
+		{"shell.phtml", 0644, "denied"},
+		{"archive.phar", 0644, "denied"},
+		{"index.shtml", 0644, "denied"},
+		{"run.pl", 0644, "denied"},
+		{"perl.pl.txt", 0644, ""},
+		{"php.txt", 0644, ""},
+		{"run.sh", 0755, "executable"},
+		{".htaccess", 0644, "denied;hidden"},
+		{".gitkeep", 0600, "hidden"},
+		{"x.cgi", 0700, "denied;executable"},
+	}
+	a, err := newAuditor(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		f := makeFile(testInfo{tt.name, tt.mode}, "dir/"+tt.name)
+		if s := strings.Join(a.findings(&f), ";"); s != tt.findings {
+			t.Errorf("%s: expected %q got %q", tt.name, tt.findings, s)
+		}
+	}
+}
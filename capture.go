@@ -0,0 +1,117 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "io"
+
+// Sizes of the start and end of files kept while reading them.  Headers
+// of images and other formats are expected to fit in the head.
+const (
+	headSize = 1 << 20
+	tailSize = 64 << 10
+)
+
+// Keeps the first and last bytes written to it.
+type capture struct {
+	head []byte
+	// Ring buffer of the last bytes, next written at pos
+	ring []byte
+	pos  int
+	// Ordered copy of the ring
+	tail []byte
+	// Number of bytes written
+	n int64
+}
+
+func newCapture(head, tail int) *capture {
+	return &capture{
+		head: make([]byte, 0, head),
+		ring: make([]byte, tail),
+		tail: make([]byte, 0, tail),
+	}
+}
+
+func (c *capture) reset() {
+	c.head = c.head[:0]
+	c.pos = 0
+	c.n = 0
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	if free := cap(c.head) - len(c.head); free > 0 {
+		if free > len(p) {
+			free = len(p)
+		}
+		c.head = append(c.head, p[:free]...)
+	}
+	if len(p) >= len(c.ring) {
+		copy(c.ring, p[len(p)-len(c.ring):])
+		c.pos = 0
+		return len(p), nil
+	}
+	n := copy(c.ring[c.pos:], p)
+	copy(c.ring, p[n:])
+	c.pos = (c.pos + len(p)) % len(c.ring)
+	return len(p), nil
+}
+
+// Returns true if the head contains all bytes written.
+func (c *capture) complete() bool {
+	return int64(len(c.head)) == c.n
+}
+
+// Returns the last bytes written, at most the size of the tail.
+// The result is only valid until the next write.
+func (c *capture) last() []byte {
+	if c.n < int64(len(c.ring)) {
+		return c.ring[:c.n]
+	}
+	c.tail = append(c.tail[:0], c.ring[c.pos:]...)
+	return append(c.tail, c.ring[:c.pos]...)
+}
+
+// Parts of the contents of a file that are available after reading it.
+type contents struct {
+	head, tail []byte
+	// Size of the whole file
+	size int64
+	// Reads the parts not kept, if not nil
+	r io.ReaderAt
+}
+
+// Maximum number of bytes read at once from the file, for the
+// parts of the contents that were not kept.
+const contentsReadSize = 16 << 20
+
+// Returns the parts of the contents written so far, and reads the
+// other parts from r, if not nil.  The tail is only valid until
+// the next write.
+func (c *capture) contents(r io.ReaderAt) *contents {
+	return &contents{head: c.head, tail: c.last(), size: c.n, r: r}
+}
+
+// Returns n bytes at offset off, or nil if they are not all in
+// the head or in the tail and cannot be read.
+func (c *contents) at(off, n int64) []byte {
+	if off < 0 || n < 0 || off+n > c.size {
+		return nil
+	}
+	if off+n <= int64(len(c.head)) {
+		return c.head[off : off+n]
+	}
+	start := c.size - int64(len(c.tail))
+	if off >= start {
+		return c.tail[off-start : off-start+n]
+	}
+	if c.r == nil || n > contentsReadSize {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := c.r.ReadAt(b, off); err != nil {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	for _, chunk := range []int{1, 3, 7, 8, 100} {
+		c := newCapture(5, 8)
+		for i := 0; i < len(data); i += chunk {
+			end := i + chunk
+			if end > len(data) {
+				end = len(data)
+			}
+			c.Write(data[i:end])
+		}
+		if string(c.head) != "01234" {
+			t.Errorf("chunk %d: expected head 01234 got %s", chunk, c.head)
+		}
+		if tail := c.last(); string(tail) != "stuvwxyz" {
+			t.Errorf("chunk %d: expected tail stuvwxyz got %s", chunk, tail)
+		}
+		if c.complete() {
+			t.Errorf("chunk %d: head should not be complete", chunk)
+		}
+	}
+	c := newCapture(5, 8)
+	c.Write([]byte("abc"))
+	if !c.complete() || !bytes.Equal(c.last(), []byte("abc")) {
+		t.Errorf("short write: got head %s tail %s", c.head, c.last())
+	}
+}
@@ -0,0 +1,404 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State of a directory that is not completely processed.
+type dirState struct {
+	// Files found but whose record is not written yet
+	files int
+	// All entries of the directory were found
+	scanned bool
+}
+
+// Tracks which directories are completely processed, that is, the
+// directory was scanned and the records of all its files were written.
+type tracker struct {
+	mu        sync.Mutex
+	pending   map[string]*dirState
+	completed map[string]bool
+	// Files already written by the interrupted run
+	written map[digest]bool
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		pending:   make(map[string]*dirState),
+		completed: make(map[string]bool),
+		written:   make(map[digest]bool),
+	}
+}
+
+// Registers a directory to scan.  Returns false if the
+// directory is already pending or completed.
+func (t *tracker) queue(dir string) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.completed[dir] || t.pending[dir] != nil {
+		return false
+	}
+	t.pending[dir] = &dirState{}
+	return true
+}
+
+func (t *tracker) complete(dir string, s *dirState) {
+	if s.scanned && s.files == 0 {
+		delete(t.pending, dir)
+		t.completed[dir] = true
+	}
+}
+
+// Marks a directory as completely scanned.
+func (t *tracker) scanned(dir string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.pending[dir]; s != nil {
+		s.scanned = true
+		t.complete(dir, s)
+	}
+}
+
+// Registers a file found in dir.
+func (t *tracker) add(dir string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.pending[dir]; s != nil {
+		s.files++
+	}
+}
+
+// Marks a file in dir as done, after its record was written.
+func (t *tracker) release(dir string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.pending[dir]; s != nil {
+		s.files--
+		t.complete(dir, s)
+	}
+}
+
+// Returns true if the interrupted run already wrote this file.
+func (t *tracker) wasWritten(ident digest) bool {
+	if t == nil {
+		return false
+	}
+	return t.written[ident]
+}
+
+func (t *tracker) snapshot() (completed, pending []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	completed = make([]string, 0, len(t.completed))
+	for dir := range t.completed {
+		completed = append(completed, dir)
+	}
+	pending = make([]string, 0, len(t.pending))
+	for dir := range t.pending {
+		pending = append(pending, dir)
+	}
+	sort.Strings(completed)
+	sort.Strings(pending)
+	return
+}
+
+// Saved state of a run, from which it can be resumed.
+type checkpoint struct {
+	Roots     []string `json:"roots"`
+	Completed []string `json:"completed"`
+	Pending   []string `json:"pending"`
+	// Settings that change the records, which must be the same
+	// when resuming
+	MD5         bool   `json:"md5"`
+	Digests     string `json:"digests"`
+	MetaColumns string `json:"meta_columns"`
+	MIME        string `json:"mime"`
+	TimeZone    string `json:"time_zone"`
+	// Last UID assigned by the writer
+	UID int `json:"uid"`
+	// Size of the output containing all records written so far
+	Offset int64 `json:"offset"`
+	// Size of the text of the files, with -text
+	TextOffset int64 `json:"text_offset"`
+}
+
+func loadCheckpoint(name string) (*checkpoint, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &checkpoint{}
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return c, nil
+}
+
+// Sets the settings of this run that change the records.
+func (c *checkpoint) setSettings() {
+	c.MD5 = *useMd5
+	c.Digests = extraDigests.String()
+	c.MetaColumns = metaColumns.String()
+	c.MIME = *mimeMode
+	c.TimeZone = *timeZone
+}
+
+// Returns an error if the interrupted run had other settings that
+// change the records: resuming would mix records of both settings.
+func (c *checkpoint) checkSettings() error {
+	var cur checkpoint
+	cur.setSettings()
+	switch {
+	case c.MD5 != cur.MD5:
+		return fmt.Errorf("the interrupted run used -md5=%v", c.MD5)
+	case c.Digests != cur.Digests:
+		return fmt.Errorf("the interrupted run used -digests %q", c.Digests)
+	case c.MetaColumns != cur.MetaColumns:
+		return fmt.Errorf("the interrupted run used -meta-columns %q", c.MetaColumns)
+	case c.MIME != cur.MIME:
+		return fmt.Errorf("the interrupted run used -mime %q", c.MIME)
+	case c.TimeZone != cur.TimeZone:
+		return fmt.Errorf("the interrupted run used -time-zone %q", c.TimeZone)
+	}
+	return nil
+}
+
+// Writes the checkpoint atomically, so that a crash while
+// writing leaves the previous checkpoint in place.
+func (c *checkpoint) save(name string) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	if err := json.NewEncoder(w).Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Restores the tracker state.  The records in r, the output up to
+// the checkpoint, are remembered if they are in pending directories,
+// as those directories will be scanned again.
+func (c *checkpoint) restore(t *tracker, r io.Reader) error {
+	for _, dir := range c.Completed {
+		t.completed[dir] = true
+	}
+	for _, dir := range c.Pending {
+		t.pending[dir] = &dirState{}
+	}
+	rr := newRecordReader(r)
+	for {
+		rec, err := rr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fields := rec.fileFields
+		if t.pending[path.Dir(fields[8])] == nil {
+			continue
+		}
+		hash, err := hex.DecodeString(fields[9])
+		if err != nil {
+			return fmt.Errorf("%s: %s", fields[9], err)
+		}
+		var key digest
+		copy(key[:], hash)
+		t.written[key] = true
+	}
+}
+
+// Prepares the output of an interrupted run to be appended to.  Records
+// written after the checkpoint are removed, as they will be written again.
+func (c *checkpoint) resumeOutput(f *os.File, t *tracker) error {
+	if err := f.Truncate(c.Offset); err != nil {
+		return err
+	}
+	if err := c.restore(t, io.NewSectionReader(f, 0, c.Offset)); err != nil {
+		return err
+	}
+	_, err := f.Seek(c.Offset, io.SeekStart)
+	return err
+}
+
+// Prepares the text of an interrupted run to be appended to.  Text written
+// after the checkpoint is removed, and so is that of files whose records
+// are not in the output up to the checkpoint, as they are processed again.
+// Returns the size of the text that is kept.
+func (c *checkpoint) resumeText(f *os.File, out io.ReaderAt) (int64, error) {
+	written := make(map[string]bool)
+	rr := newRecordReader(io.NewSectionReader(out, 0, c.Offset))
+	for {
+		rec, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		written[rec.fileFields[9]] = true
+	}
+	// Lines are only removed, so the text kept is written
+	// over the lines already read.
+	r := bufio.NewReader(io.NewSectionReader(f, 0, c.TextOffset))
+	var off int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		var rec textRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, fmt.Errorf("%s: %s", f.Name(), err)
+		}
+		if !written[rec.IdentifierHash] {
+			continue
+		}
+		if _, err := f.WriteAt(line, off); err != nil {
+			return 0, err
+		}
+		off += int64(len(line))
+	}
+	if err := f.Truncate(off); err != nil {
+		return 0, err
+	}
+	_, err := f.Seek(off, io.SeekStart)
+	return off, err
+}
+
+// Periodically saves a checkpoint of a running scan.
+type checkpointer struct {
+	name   string
+	roots  []string
+	track  *tracker
+	writer *writer
+	stop   chan struct{}
+	done   chan struct{}
+	// Text of the files, if not nil
+	text *textWriter
+}
+
+func newCheckpointer(name string, roots []string, t *tracker, w *writer, text *textWriter) *checkpointer {
+	return &checkpointer{
+		name:   name,
+		roots:  roots,
+		track:  t,
+		writer: w,
+		text:   text,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *checkpointer) run(every time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// The snapshot must be taken before syncing the writer:
+			// all records of completed directories are then written.
+			completed, pending := c.track.snapshot()
+			uid, offset, ok := c.writer.sync()
+			if !ok {
+				return
+			}
+			// Text is extracted before the records are written: that
+			// of completed directories is all in the buffer.
+			textOffset, err := c.text.sync()
+			if err != nil {
+				log.Print("Cannot write text file: ", err)
+				continue
+			}
+			if err := c.save(completed, pending, uid, offset, textOffset); err != nil {
+				log.Print("Cannot write checkpoint: ", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *checkpointer) save(completed, pending []string, uid int, offset, textOffset int64) error {
+	cp := &checkpoint{
+		Roots:      c.roots,
+		Completed:  completed,
+		Pending:    pending,
+		UID:        uid,
+		Offset:     offset,
+		TextOffset: textOffset,
+	}
+	cp.setSettings()
+	return cp.save(c.name)
+}
+
+// Stops saving periodically, after the writer finished.  If the run is
+// incomplete the checkpoint is kept, and updated if save is true.
+// Otherwise the checkpoint is removed.
+func (c *checkpointer) finish(incomplete, save bool) error {
+	close(c.stop)
+	<-c.done
+	if !incomplete {
+		err := os.Remove(c.name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !save {
+		return nil
+	}
+	completed, pending := c.track.snapshot()
+	textOffset, err := c.text.sync()
+	if err != nil {
+		return err
+	}
+	return c.save(completed, pending, c.writer.uid, c.writer.offset, textOffset)
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointRestore(t *testing.T) {
+	// Names with characters escaped in the output
+	dir := "upload/\"a\\b\nc\r\x00"
+	pending := newMissingProps(sha1.New(), dir+"/file.txt")
+	done := newMissingProps(sha1.New(), "other/file.txt")
+	var out strings.Builder
+	writeInfo(&out, "format", outputFormat)
+	for _, p := range []*props{pending, done} {
+		out.WriteString(p.marshal(&bytes.Buffer{}))
+	}
+	c := &checkpoint{Completed: []string{"other"}, Pending: []string{dir}}
+	tr := newTracker()
+	if err := c.restore(tr, strings.NewReader(out.String())); err != nil {
+		t.Fatal(err)
+	}
+	if !tr.written[pending.ident] || tr.written[done.ident] || len(tr.written) != 1 {
+		t.Errorf("unexpected written files %v", tr.written)
+	}
+}
+
+func TestCheckpointResumeText(t *testing.T) {
+	var out bytes.Buffer
+	written := newMissingProps(sha1.New(), "a/written.txt")
+	out.WriteString(written.marshal(&bytes.Buffer{}))
+	f, err := os.Create(filepath.Join(t.TempDir(), "text.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := newTextWriter(f, 100, nil)
+	// Text of a file whose record is after the checkpoint
+	lost := newMissingProps(sha1.New(), "a/lost.txt")
+	for _, p := range []*props{lost, written} {
+		p.mime = "text/plain"
+		data := []byte(p.fname)
+		tw.extract(p, &contents{head: data, size: int64(len(data))})
+	}
+	offset, err := tw.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Text after the checkpoint
+	f.WriteString("{\"identifier_hash\":\"00\",\"digest\":\"\",\"algorithm\":\"sha1\",\"text\":\"x\"}\n")
+	c := &checkpoint{Offset: int64(out.Len()), TextOffset: offset}
+	n, err := c.resumeText(f, bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf(`{"identifier_hash":"%x","digest":"%x","algorithm":"sha1","text":"a/written.txt"}`+"\n", written.ident, written.chash)
+	if string(data) != expect || n != int64(len(expect)) {
+		t.Errorf("expected %q (%d bytes), got %q (%d bytes)", expect, len(expect), data, n)
+	}
+}
+
+func TestCheckpointSettings(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "checkpoint.json")
+	c := &checkpoint{Roots: []string{"."}}
+	c.setSettings()
+	if err := c.save(name); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadCheckpoint(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.checkSettings(); err != nil {
+		t.Errorf("same settings: %s", err)
+	}
+	defer func(d digestList) { extraDigests = d }(extraDigests)
+	extraDigests = digestList{"sha256"}
+	if err := saved.checkSettings(); err == nil {
+		t.Error("resuming with other digests not refused")
+	}
+}
@@ -5,9 +5,6 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/csv"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -33,6 +30,18 @@ func (f *deltaFiles) IsSet() bool {
 type entry struct {
 	mtime      int64
 	file, meta string
+	// Record of a deleted file
+	missing bool
+	// Record of a file that could not be read
+	failed bool
+	// Digest of the contents in the sha1 column
+	sum string
+}
+
+// Returns true if the cached record can be used for a
+// file with modification time mtime.
+func (e *entry) valid(mtime int64) bool {
+	return !e.missing && !e.failed && e.mtime == mtime
 }
 
 type delta map[digest]*entry
@@ -41,63 +50,63 @@ func makeDelta() delta {
 	return delta(make(map[digest]*entry))
 }
 
-func (d delta) load(r io.Reader) error {
-	var buf bytes.Buffer
-	scanner := bufio.NewScanner(r)
-	parser := csv.NewReader(&buf)
-	for scanner.Scan() {
-		fline := scanner.Text()
-		if !strings.HasPrefix(fline, "file:") {
-			return fmt.Errorf("invalid file line: %s", fline)
-		}
-		// Write this line to a reader for CSV parsing
-		fmt.Fprintln(&buf, fline[5:])
-		// Parse the last written line
-		fields, err := parser.Read()
+// Loads the records in r.  Returns the values of the info lines.
+func (d delta) load(r io.Reader) (map[string]string, error) {
+	rr := newRecordReader(r)
+	for {
+		rec, err := rr.next()
 		if err != nil {
-			return err
+			if err == io.EOF {
+				return rr.info, nil
+			}
+			return nil, err
 		}
-		// Save memory by keeping the buffer empty
-		buf.Reset()
+		fields := rec.fileFields
 		// Parse filename hash and modification date field
-		if len(fields) < 18 {
-			return fmt.Errorf("expected at least 18 fields, got %d", len(fields))
-		}
 		hash, err := hex.DecodeString(fields[9])
 		if err != nil {
-			return fmt.Errorf("%s: %s", fields[9], err)
+			return nil, fmt.Errorf("%s: %s", fields[9], err)
 		}
 		mtime, err := strconv.ParseInt(fields[17], 10, 64)
 		if err != nil {
-			return fmt.Errorf("cannot parse modification time: %s", err)
-		}
-		// Read the next line that contains the "meta:" data
-		if !scanner.Scan() {
-			return fmt.Errorf("expected a meta: line, got error: %s", scanner.Err())
-		}
-		mline := scanner.Text()
-		if !strings.HasPrefix(mline, "meta:") {
-			return fmt.Errorf("invalid meta line: %s", mline)
+			return nil, fmt.Errorf("cannot parse modification time: %s", err)
 		}
 		var key digest
 		copy(key[:], hash)
-		// If there is already an entry and it has is newer than the one we
-		// are trying to insert, do not override the newest entry.
-		if e, ok := d[key]; ok {
-			if e.mtime >= mtime {
-				continue
-			}
-		}
-		d[key] = &entry{
-			mtime: mtime,
-			file:  fline,
-			meta:  mline,
+		// Lines are written again as they are
+		file, meta := rec.fileLine, rec.metaLine
+		if rr.legacy() {
+			file, meta = upgradeLine(file), upgradeLine(meta)
 		}
+		d.add(key, &entry{
+			mtime:   mtime,
+			file:    file,
+			meta:    meta,
+			missing: fields[4] == "1",
+			failed:  fields[14] == "",
+			sum:     fields[14],
+		})
+	}
+}
+
+// Adds the entry e for key, unless there is a newer one.
+func (d delta) add(key digest, e *entry) {
+	if old, ok := d[key]; ok && old.mtime >= e.mtime {
+		return
+	}
+	d[key] = e
+}
+
+// Adds the entries of other, keeping the newest ones.
+func (d delta) merge(other delta) {
+	for key, e := range other {
+		d.add(key, e)
 	}
-	return scanner.Err()
 }
 
+// Writes the records as normal mode output, that can be used as delta.
 func (d delta) writeTo(w io.Writer) error {
+	writeHeader(w)
 	for _, e := range d {
 		if _, err := fmt.Fprintf(w, "%s\n%s\n", e.file, e.meta); err != nil {
 			return err
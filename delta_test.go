@@ -0,0 +1,75 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+)
+
+// Loads the delta written by d, as merging deltas does.
+func remerge(t *testing.T, d delta) (delta, map[string]string) {
+	var b bytes.Buffer
+	if err := d.writeTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	merged := makeDelta()
+	info, err := merged.load(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return merged, info
+}
+
+func TestDeltaMergeTwice(t *testing.T) {
+	p := newMissingProps(sha1.New(), `root/a\b.txt`)
+	p.missing = false
+	d := makeDelta()
+	var b bytes.Buffer
+	writeHeader(&b)
+	b.WriteString(p.marshal(&bytes.Buffer{}))
+	if _, err := d.load(&b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		d, _ = remerge(t, d)
+	}
+	e := d[p.ident]
+	if e == nil {
+		t.Fatal("record lost by merging")
+	}
+	fields, err := parseFields(strings.TrimPrefix(e.file, "file:"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields[8] != p.fname || fields[13] != p.bname {
+		t.Errorf("expected %q and %q, got %q and %q", p.fname, p.bname, fields[8], fields[13])
+	}
+}
+
+func TestDeltaMergeDigests(t *testing.T) {
+	defer func(d digestList) { extraDigests = d }(extraDigests)
+	extraDigests = digestList{"sha256"}
+	p := newMissingProps(sha1.New(), "root/a.txt")
+	p.missing = false
+	p.sums = [][]byte{{0xab}}
+	var b bytes.Buffer
+	writeHeader(&b)
+	b.WriteString(p.marshal(&bytes.Buffer{}))
+	d := makeDelta()
+	if _, err := d.load(&b); err != nil {
+		t.Fatal(err)
+	}
+	merged, info := remerge(t, d)
+	// A run with the same digests uses the merged records
+	if v := info["digests"]; v != extraDigests.String() {
+		t.Errorf("expected digests %q, got %q", extraDigests.String(), v)
+	}
+	if e := merged[p.ident]; e == nil || !strings.HasSuffix(e.file, `,"ab"`) {
+		t.Errorf("record with digests lost by merging: %v", e)
+	}
+}
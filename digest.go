@@ -0,0 +1,80 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Digests of the contents that can be computed in addition to the
+// one in the sha1 column.
+var digestFuncs = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		// Only fails with an invalid key
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// Name of the digest in the sha1 column.
+func primaryDigest() string {
+	if *useMd5 {
+		return "md5"
+	}
+	return "sha1"
+}
+
+func digestNames() string {
+	names := make([]string, 0, len(digestFuncs))
+	for name := range digestFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Names of digests to compute, as a comma separated flag value.
+type digestList []string
+
+func (d *digestList) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *digestList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := digestFuncs[name]; !ok {
+			return fmt.Errorf("unknown digest %q, valid ones are %s", name, digestNames())
+		}
+		for _, n := range *d {
+			if n == name {
+				return fmt.Errorf("digest %s listed twice", name)
+			}
+		}
+		*d = append(*d, name)
+	}
+	return nil
+}
+
+func (d digestList) hashes() []hash.Hash {
+	hs := make([]hash.Hash, len(d))
+	for i, name := range d {
+		hs[i] = digestFuncs[name]()
+	}
+	return hs
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDigests(t *testing.T) {
+	var d digestList
+	if err := d.Set("sha1,SHA256, blake2b"); err != nil {
+		t.Fatal(err)
+	}
+	tools := newTools(false, d)
+	if _, err := tools.read(strings.NewReader("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	_, sums := tools.digests()
+	expected := []string{
+		"f572d396fae9206628714fb2ce00f72e94f2258f",
+		"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		"f60ce482e5cc1229f39d71313171a8d9f4ca3a87d066bf4b205effb528192a75f14f3271e2c1a90e1de53f275b4d4793eef2f5e31ea90d2ce29d2e481c36435f",
+	}
+	for i := range expected {
+		if sum := fmt.Sprintf("%x", sums[i]); sum != expected[i] {
+			t.Errorf("%s: expected %s got %s", d[i], expected[i], sum)
+		}
+	}
+}
+
+func TestDigestListInvalid(t *testing.T) {
+	for _, v := range []string{"sha3", "md5,md5", ""} {
+		var d digestList
+		if err := d.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestDigestColumns(t *testing.T) {
+	defer func(d digestList, c bool) { extraDigests, *digestColumns = d, c }(extraDigests, *digestColumns)
+	extraDigests = digestList{"sha256"}
+	p := newMissingProps(sha1.New(), "docs/a.pdf")
+	p.missing = false
+	p.sums = [][]byte{{0xab}}
+	var normal bytes.Buffer
+	writeHeader(&normal)
+	normal.WriteString(p.marshal(&bytes.Buffer{}))
+	for _, c := range []bool{false, true} {
+		*digestColumns = c
+		var sql, split bytes.Buffer
+		p.writeSQL(&sql)
+		sw := splitWriter{"file:", bytes.NewReader(normal.Bytes()), 1, 1, 1, !c}
+		if err := sw.write(&split); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(sql.String(), "sha256") != c || strings.Contains(sql.String(), `"ab"`) != c {
+			t.Errorf("-digest-columns %v: unexpected SQL: %s", c, sql.String())
+		}
+		if strings.HasSuffix(strings.TrimSpace(split.String()), `,"ab"`) != c {
+			t.Errorf("-digest-columns %v: unexpected sys_file CSV: %s", c, split.String())
+		}
+	}
+}
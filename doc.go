@@ -10,14 +10,17 @@ import (
 	"os"
 )
 
-const helpText = `Usage: sys-file-index [MODE...] [DIRECTORY]
+const helpText = `Usage: sys-file-index [MODE...] [DIRECTORY...]
 
 ABOUT
 
-sys-file-indexer indices the directory specified as last
-argument or the current directory by default.
+sys-file-indexer indices the directories specified as last
+arguments or the current directory by default.  When several
+directories are given, they are scanned in the same run and
+produce one combined output.
 
-sys-file-indexer always outputs the result to stdout.
+sys-file-indexer outputs the result to stdout, or to the file
+specified with "-o".
 
 MODES OF OPERATION
 
@@ -45,6 +48,19 @@ sys-file-indexer has the following modes of operation:
 
 5. Single mode: outputs one single CSV dataset.  Useful for testing onty.
 
+6. Watch mode: after scanning, keeps running and outputs a new record
+   every time a file is created, modified, moved or deleted, or its
+   attributes change.  Modified files are processed when closed after
+   writing, so files kept open are not processed until then.  Records
+   of deleted files, and of files in directories moved out of the
+   scanned directories, are marked as missing.  Only available on Linux.
+
+Quotes, backslashes, new lines, carriage returns and NUL characters in
+names and metadata are escaped with a backslash, like MySQL expects.
+Earlier versions only escaped quotes: their outputs, that do not start
+with a "format" info line, are still read correctly with "-delta" and in
+SQL transform mode.
+
 EXAMPLE
 
 Generate the normal mode CSV output:
@@ -69,6 +85,12 @@ Delta mode and output to SQL (use tee(1) to update the normal
 	file in one go):
 $ sys-file-indexer -delta normal.csv | sys-file-indexer -osql - | mysql ...
 
+Keep the index up to date after the first scan:
+$ sys-file-indexer -watch -delta normal.csv -o changes.csv DIR
+
+Scan several directories in one run:
+$ sys-file-indexer fileadmin uploads >normal.csv
+
 In delta mode you can specify several files to load as follows:
 $ sys-file-indexer -delta a.csv -delta b.csv DIR
 
@@ -77,6 +99,292 @@ record is retained. To merge several deltas, use the -delta switch
 multiple times and do not specify a directory to scan. The merged delta
 will be printed to standard output.
 
+MIME TYPES
+
+By default the MIME type is chosen by the extension of the file, and
+the contents are only examined for files without extension.  With
+"-mime content" the contents are examined first, like libmagic does for
+TYPO3, and the extension is only used for contents that are not known.
+The detection is built in and recognizes office documents, archives,
+audio, video and image formats, PDF, fonts, executables and text.
+
+Records reused from a delta keep the MIME type they had, so a run
+without delta is needed for the new types to apply to all files.
+
+The MIME types of extensions come from a table built into the program,
+so that the same files have the same types on every host.  Types can
+be added or changed with "-mime-types FILE", in the format of
+/etc/mime.types: a MIME type followed by its extensions on each line.
+
+The version of the table is written at the start of the output, on an
+"info:" line in normal mode and as a comment in SQL mode.  A line
+"version V" in the file sets the version of the changes, otherwise a
+digest of the file is used.  A warning is printed when a delta was
+produced with a different version.
+
+MISMATCHES
+
+With "-mismatches F", files whose contents do not match the MIME type
+of their extension are written as CSV to F, with the path, extension,
+both MIME types and a severity:
+
+- critical: scripts or executables, like PHP code in avatar.png;
+- high: HTML or SVG, that browsers can run scripts from, named as
+  media or PDF;
+- medium: completely different contents, like an invoice.pdf that is
+  really a ZIP;
+- low: another format of the same media, like a PNG named .jpg.
+
+Formats based on another, like office documents that are ZIP files,
+are not reported.  A count for each severity is printed at the end of
+the run.  Files whose record is reused from a delta are not read, and
+thus not checked: with "-delta" only new and changed files are
+reported, a run without it checks every file.
+
+$ sys-file-indexer -mismatches mismatches.csv DIR >normal.csv
+
+AUDIT
+
+With "-audit F", files that should not be in a storage are written as
+CSV to F, with their findings and permissions.  The findings are:
+
+- denied: the name matches TYPO3's default fileDenyPattern, that rejects
+  uploads of PHP and other scripts like shell.php.jpg and .htaccess;
+- executable: any of the executable permission bits is set;
+- hidden: the name starts with a dot.
+
+The patterns can be replaced with "-deny-pattern REGEXP", a flag that
+can be repeated, for example with the fileDenyPattern configured in
+TYPO3.  Like in TYPO3, patterns are regular expressions matched against
+the name of the file without regard to case.
+
+Files are still indexed, unless their findings are listed with
+"-audit-skip", for example "-audit-skip denied,executable".  A count for
+each finding is printed at the end of the run.
+
+$ sys-file-indexer -audit audit.csv -audit-skip denied fileadmin >normal.csv
+
+DIGESTS
+
+The sha1 column contains the SHA-1 digest of the contents, or MD5 with
+"-md5".  Other digests can be computed in the same read of the file
+with "-digests", a comma separated list of md5, sha1, sha256, sha512 and
+blake2b (BLAKE2b-512).  The additional digests are appended as columns,
+in the order given, to the file lines of normal mode and to single mode
+lines.  The sys_file CSV of split mode and SQL mode only have the sha1
+column, as TYPO3 has no columns for the others.  With "-digest-columns"
+they are written to sys_file columns named like the digest, that must
+first be added to the table as character columns for the digest in
+hexadecimal, 128 characters for sha512 and blake2b.  Reading the digests
+back with "-dump" needs the same columns.
+
+$ sys-file-indexer -digests sha256,blake2b >../normal.csv
+
+The list is written on an "info:" line at the start of the output.  A
+delta written with another list is not used, and SQL transform mode
+stops, so the same list should be given to every run and to SQL
+transform mode.
+
+METADATA
+
+The width and height of images are read from their headers, also for
+WebP, AVIF, HEIC, ICO and PSD images.  Those of SVG images, compressed
+or not, are their width and height attributes or the size of their
+view box, like TYPO3 reads them.  They are swapped when the EXIF
+orientation says that the image is rotated by a quarter turn, like
+TYPO3 shows it.
+The width and height of PDF files are the size of the first page in
+points, rotated like the page is shown, those of videos the size of
+the first video track.
+
+The title, description and alternative columns of sys_file_metadata
+are filled with the metadata embedded in images, documents and audio
+files.  Other metadata is written to additional columns with
+"-meta-columns", a comma separated list of "column=field", or of
+"field" for a column with the same name.  The name "filemetadata" adds the columns of the TYPO3
+extension of the same name that can be filled: content_creation_date,
+content_modification_date, creator_tool, creator, copyright,
+color_space, latitude, longitude, keywords, pages and duration.
+
+$ sys-file-indexer -meta-columns filemetadata,camera=camera_model DIR >../normal.csv
+
+The fields are:
+
+- title, description and alternative, the alternative text or the
+  headline;
+- keywords, comma separated;
+- content_creation_date, content_modification_date: Unix time, dates
+  without time zone are UTC, or in the time zone set with "-time-zone",
+  like Europe/Berlin or Local for that of the host;
+- creator, copyright and creator_tool, the program used;
+- color_space: RGB, sRGB, CMYK, grey or indx, for all images;
+- latitude and longitude in decimal degrees, altitude in meters;
+- camera_make, camera_model, lens_model, exposure_time, f_number,
+  iso_speed, focal_length and orientation;
+- pages, the number of pages of documents or of slides of
+  presentations, and word_count;
+- duration of audio and video in seconds, and bitrate in bits per
+  second.
+
+Metadata is read from XMP, IPTC-IIM and EXIF in JPEG and TIFF images,
+from XMP and IPTC-IIM in PNG images, and from XMP and the document
+information in PDF files.  When the same field is found in more than
+one, XMP is used first and EXIF or the document information last.  Of
+encrypted PDF files only the pages and their size are read.  Office
+Open XML and OpenDocument files have their document properties read,
+without reading the rest of the archive.  Duration and size are read
+from the headers of MP4, QuickTime, WebM, Matroska and Ogg videos, and
+of MP3, WAV, FLAC and Ogg audio; MP3 files also have their ID3 tags
+read.  An XMP sidecar file, "photo.xmp" or "photo.jpg.xmp" next to
+"photo.jpg", takes precedence over the metadata embedded in the file.
+Changes to a sidecar alone do not change the modification time of the
+file, so they are only seen when a record is not taken from the delta.
+
+The columns are appended, in the order given, to the meta lines of
+normal mode and thus to the sys_file_metadata CSV of split mode, and to
+single mode lines.  In SQL mode only the columns with a value are
+inserted.  The columns must be added to the table.
+
+The list is written on an "info:" line at the start of the output.  A
+delta written with another list is not used, and SQL transform mode
+stops, as its values would be in the wrong columns: the same list
+should be given to every run, to SQL transform mode and to "-dump".
+
+TEXT
+
+With "-text F", the plain text of documents is written to file F for
+full-text search, like Solr or indexed_search, as JSON Lines: one
+object for each file, with its identifier_hash, the digest of the sha1
+column and its algorithm, sha1 or md5 with "-md5", and the text.
+Text is extracted from text files as they are, from the pages of PDF
+files, from the body of Office Open XML documents, the shared strings
+of spreadsheets and the slides of presentations, and from the content
+of OpenDocument files.  The text of each file is cut at "-text-size"
+bytes, 1MB by default and 16MB at most; those cut have "truncated"
+set.
+
+$ sys-file-indexer -text text.jsonl DIR >normal.csv
+
+{"identifier_hash":"85f9d678...","digest":"1efa3dc3...","algorithm":"sha1","text":"Hello world"}
+
+Text of encrypted PDF files and of images in PDF files cannot be
+extracted.  With "-delta", only files whose contents changed have their
+text written: their lines replace those with the same identifier_hash
+in the text of previous runs.  When resuming, the text of files whose
+records are written again is removed from the file, like the records.
+
+FILE LISTS
+
+Instead of scanning, the files to index can be read from a list, one
+name per line, or separated by NUL with "-null".  Names must be inside
+the directories specified as arguments, or the current directory.
+Partitioning, filtering and the symlink policy apply as when scanning,
+also to the directories that contain the listed files.
+
+$ find DIR -newer last-run -type f -print0 | sys-file-indexer -files - -null DIR
+
+FILTERING
+
+Paths can be excluded from the scan with gitignore-style patterns,
+matched against the path relative to the scanned directory.  Excluded
+directories are never opened.  If include patterns are given, only
+files matching at least one of them are indexed.
+
+$ sys-file-indexer -exclude _processed_/ -exclude _temp_/ -exclude '*.tmp' DIR
+$ sys-file-indexer -exclude-from ignore.txt -include '*.pdf' DIR
+
+SYMBOLIC LINKS
+
+Symbolic links are followed by default.  With "-symlinks=within-root"
+only links that resolve inside the scanned directory are followed, and
+with "-symlinks=skip" links are never followed.  Directories that were
+already visited are not scanned again, so links pointing to a parent
+directory cannot make the scan loop.  Links to directories are followed
+after all other directories are scanned, so that files are indexed with
+their real path, not with that of a link to them.  Links that were not
+followed are reported on standard error at the end of the run.
+
+FILESYSTEMS
+
+With "-xdev" directories on other filesystems than the scanned directory,
+like bind mounts or network mounts, are not scanned.  Mount points to scan
+anyway can be specified as patterns relative to the scanned directory with
+"-mount", a flag that can be repeated.  They match like "-exclude"
+patterns: user_upload/nfs matches only that directory, not user_upload/nfs2
+or directories below it.  Mount points that were not scanned are reported
+on standard error at the end of the run.
+
+$ sys-file-indexer -xdev -mount user_upload/nfs DIR
+
+ERRORS
+
+Files and directories that cannot be read are logged to standard error,
+and can be written as CSV to the file specified with "-errors", including
+path, stage, operation and error number.  A summary is printed at the end
+of the run.  By default records of files that cannot be read are emitted
+with an empty sha1 field ("-on-error=flag"), so that they are processed
+again when the output is used with "-delta".  With "-on-error=skip" no
+record is emitted, with "-on-error=abort" the run stops at the first
+failed file.
+
+With "-max-errors N" the exit status is not zero if more than N files
+could not be read, for example with 0 if any file could not be read.
+By default files that cannot be read do not change the exit status.
+Errors decoding images, metadata and text are reported but do not count
+as failures.
+
+INTERRUPTING
+
+On SIGINT or SIGTERM the scan stops, files being processed are
+completed and only complete records are written to the output.  The
+number of records written and the directories that were not completely
+scanned are printed to standard error.  A second signal terminates
+immediately.
+
+PROGRESS
+
+With "-progress D", a line with the progress of the run is printed to
+standard error every interval D (for example "30s"): directories
+waiting to be scanned, files found and processed, files whose record
+was taken from the delta or not, and bytes hashed with the throughput.
+When a delta is loaded, its number of records, divided by the number
+of workers of "-wg", is used as the expected number of files to
+estimate the remaining time.
+
+Sending SIGUSR1 prints the progress immediately, also without
+"-progress".
+
+METRICS
+
+With "-metrics-addr ADDR", for example ":9100", metrics in the Prometheus
+text format are served at http://ADDR/metrics for as long as the run
+lasts, which is useful with watch mode.  Metrics include the files found,
+processed and written, the files and bytes of each stage (stat, open,
+sniff, hash, metadata, image and text), errors for each stage, delta
+hits and misses, a histogram of the time to process each file, and
+gauges of the directories waiting to be scanned, active scan workers
+and records waiting to be written.
+
+CHECKPOINTS
+
+With "-checkpoint FILE", the directories completely processed and the
+position in the output are saved to FILE every minute, or as set with
+"-checkpoint-every".  A checkpoint is also saved when the scan is
+interrupted, and removed when the scan completes.
+
+An interrupted scan is resumed by running it again with the same
+directories, "-o" file and "-checkpoint" file plus "-resume".  Records
+written after the last checkpoint are removed from the output and
+written again, directories already completed are not scanned again.
+The options that change the records, "-md5", "-digests", "-meta-columns",
+"-mime" and "-time-zone", must be the same as in the interrupted run.
+
+$ sys-file-indexer -o normal.csv -checkpoint scan.json /data
+$ sys-file-indexer -o normal.csv -checkpoint scan.json -resume /data
+
+Checkpoints cannot be used with "-files", watch mode, SQL mode or
+single mode.
+
 PARTITIONING
 
 sys-file-indexer can be run on multiple machines if that leads to an
@@ -0,0 +1,315 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoTIFF = errors.New("invalid TIFF header")
+
+// Reads the image file directories of TIFF files and of EXIF data,
+// which has the same structure.
+type tiffReader struct {
+	// Returns n bytes at offset off, or nil if not available
+	at    func(off, n int64) []byte
+	order binary.ByteOrder
+}
+
+// A field of an image file directory
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	// Value, nil if not available
+	value []byte
+}
+
+// Returns a reader and the offset of the first directory.
+func newTIFFReader(at func(off, n int64) []byte) (*tiffReader, uint32, error) {
+	h := at(0, 8)
+	if h == nil {
+		return nil, 0, errNoTIFF
+	}
+	r := &tiffReader{at: at}
+	switch string(h[:4]) {
+	case "II*\x00":
+		r.order = binary.LittleEndian
+	case "MM\x00*":
+		r.order = binary.BigEndian
+	default:
+		return nil, 0, errNoTIFF
+	}
+	return r, r.order.Uint32(h[4:]), nil
+}
+
+// Size of one value of each TIFF type.
+func tiffTypeSize(typ uint16) int64 {
+	switch typ {
+	case 1, 2, 6, 7:
+		return 1
+	case 3, 8:
+		return 2
+	case 4, 9, 11, 13:
+		return 4
+	case 5, 10, 12:
+		return 8
+	}
+	return 0
+}
+
+// Maximum number of fields of a directory, more mean it is corrupt.
+const tiffMaxEntries = 1000
+
+// Reads the directory at offset off.  Returns its fields by tag and
+// the offset of the next directory, zero if it is the last one.
+func (r *tiffReader) ifd(off uint32) (map[uint16]tiffEntry, uint32, error) {
+	b := r.at(int64(off), 2)
+	if b == nil {
+		return nil, 0, fmt.Errorf("directory at %d not in the data read", off)
+	}
+	n := int64(r.order.Uint16(b))
+	if n > tiffMaxEntries {
+		return nil, 0, fmt.Errorf("directory at %d has %d fields", off, n)
+	}
+	b = r.at(int64(off)+2, n*12+4)
+	if b == nil {
+		return nil, 0, fmt.Errorf("directory at %d not in the data read", off)
+	}
+	entries := make(map[uint16]tiffEntry, n)
+	for i := int64(0); i < n; i++ {
+		e := b[i*12 : i*12+12]
+		tag := r.order.Uint16(e)
+		entry := tiffEntry{typ: r.order.Uint16(e[2:]), count: r.order.Uint32(e[4:])}
+		size := tiffTypeSize(entry.typ) * int64(entry.count)
+		if size <= 4 {
+			entry.value = e[8 : 8+size]
+		} else {
+			entry.value = r.at(int64(r.order.Uint32(e[8:])), size)
+		}
+		entries[tag] = entry
+	}
+	return entries, r.order.Uint32(b[n*12:]), nil
+}
+
+// Returns the value i of an integer field.
+func (r *tiffReader) uint(e tiffEntry, i int) (uint32, bool) {
+	size := int(tiffTypeSize(e.typ))
+	if e.value == nil || (i+1)*size > len(e.value) {
+		return 0, false
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(e.value[i]), true
+	case 3:
+		return uint32(r.order.Uint16(e.value[i*2:])), true
+	case 4, 13:
+		return r.order.Uint32(e.value[i*4:]), true
+	}
+	return 0, false
+}
+
+// Returns the value i of a rational field.
+func (r *tiffReader) rational(e tiffEntry, i int) (float64, bool) {
+	if e.value == nil || (e.typ != 5 && e.typ != 10) || (i+1)*8 > len(e.value) {
+		return 0, false
+	}
+	num, den := r.order.Uint32(e.value[i*8:]), r.order.Uint32(e.value[i*8+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+// Returns the value of a text field, up to the first NUL.
+func tiffString(e tiffEntry) string {
+	if e.typ != 2 && e.typ != 7 && e.typ != 1 {
+		return ""
+	}
+	s := e.value
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return string(s)
+}
+
+// Tags of EXIF data used for metadata
+const (
+	tagMake        = 0x010f
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagSoftware    = 0x0131
+	tagDateTime    = 0x0132
+	tagArtist      = 0x013b
+	tagCopyright   = 0x8298
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+
+	tagExposureTime       = 0x829a
+	tagFNumber            = 0x829d
+	tagISOSpeed           = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagDateTimeDigitized  = 0x9004
+	tagOffsetTime         = 0x9010
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920a
+	tagColorSpace         = 0xa001
+	tagLensModel          = 0xa434
+
+	tagGPSLatitudeRef  = 1
+	tagGPSLatitude     = 2
+	tagGPSLongitudeRef = 3
+	tagGPSLongitude    = 4
+	tagGPSAltitudeRef  = 5
+	tagGPSAltitude     = 6
+)
+
+// Extracts EXIF metadata from the first directory of r and the
+// directories it points to.
+func readExif(r *tiffReader, ifd0 map[uint16]tiffEntry, m metadata) error {
+	var err error
+	m.set("camera_make", tiffString(ifd0[tagMake]))
+	m.set("camera_model", tiffString(ifd0[tagModel]))
+	m.set("creator_tool", tiffString(ifd0[tagSoftware]))
+	m.set("creator", tiffString(ifd0[tagArtist]))
+	m.set("copyright", exifCopyright(ifd0[tagCopyright]))
+	if o, ok := r.uint(ifd0[tagOrientation], 0); ok && o >= 1 && o <= 8 {
+		m.set("orientation", strconv.Itoa(int(o)))
+	}
+	var exif map[uint16]tiffEntry
+	if off, ok := r.uint(ifd0[tagExifIFD], 0); ok {
+		if exif, _, err = r.ifd(off); err != nil {
+			return fmt.Errorf("EXIF: %s", err)
+		}
+	}
+	zone := tiffString(exif[tagOffsetTimeOriginal])
+	m.set("content_creation_date", exifTime(tiffString(exif[tagDateTimeOriginal]), zone))
+	m.set("content_creation_date", exifTime(tiffString(exif[tagDateTimeDigitized]), zone))
+	m.set("content_modification_date", exifTime(tiffString(ifd0[tagDateTime]), tiffString(exif[tagOffsetTime])))
+	m.set("lens_model", tiffString(exif[tagLensModel]))
+	if v, ok := r.rational(exif[tagExposureTime], 0); ok && v > 0 {
+		m.set("exposure_time", exposureTime(v))
+	}
+	if v, ok := r.rational(exif[tagFNumber], 0); ok && v > 0 {
+		m.set("f_number", formatFloat(v, 1))
+	}
+	if v, ok := r.rational(exif[tagFocalLength], 0); ok && v > 0 {
+		m.set("focal_length", formatFloat(v, 1))
+	}
+	if v, ok := r.uint(exif[tagISOSpeed], 0); ok && v > 0 {
+		m.set("iso_speed", strconv.Itoa(int(v)))
+	}
+	// Other values mean uncalibrated, the image decides
+	if v, ok := r.uint(exif[tagColorSpace], 0); ok && v == 1 {
+		m.set("color_space", "sRGB")
+	}
+	if off, ok := r.uint(ifd0[tagGPSIFD], 0); ok {
+		gps, _, err := r.ifd(off)
+		if err != nil {
+			return fmt.Errorf("GPS: %s", err)
+		}
+		readGPS(r, gps, m)
+	}
+	return nil
+}
+
+func readGPS(r *tiffReader, gps map[uint16]tiffEntry, m metadata) {
+	lat, ok := gpsDegrees(r, gps[tagGPSLatitude], tiffString(gps[tagGPSLatitudeRef]), "S")
+	if !ok {
+		return
+	}
+	lon, ok := gpsDegrees(r, gps[tagGPSLongitude], tiffString(gps[tagGPSLongitudeRef]), "W")
+	if !ok {
+		return
+	}
+	m.set("latitude", formatFloat(lat, 6))
+	m.set("longitude", formatFloat(lon, 6))
+	if alt, ok := r.rational(gps[tagGPSAltitude], 0); ok {
+		// Reference 1 is below sea level
+		if ref, _ := r.uint(gps[tagGPSAltitudeRef], 0); ref == 1 {
+			alt = -alt
+		}
+		m.set("altitude", formatFloat(alt, 1))
+	}
+}
+
+// Returns decimal degrees from degrees, minutes and seconds.
+func gpsDegrees(r *tiffReader, e tiffEntry, ref, negative string) (float64, bool) {
+	var v float64
+	for i, div := range []float64{1, 60, 3600} {
+		n, ok := r.rational(e, i)
+		if !ok {
+			return 0, false
+		}
+		v += n / div
+	}
+	if math.IsNaN(v) || v > 180 {
+		return 0, false
+	}
+	if strings.EqualFold(ref, negative) {
+		v = -v
+	}
+	return v, true
+}
+
+// Copyright of the photographer and of the editor are separated by NUL.
+func exifCopyright(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	var parts []string
+	for _, s := range strings.Split(string(e.value), "\x00") {
+		if s = strings.TrimSpace(s); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Returns the Unix time of an EXIF date as a string.  Dates without
+// time zone are in dateZone.
+func exifTime(s, zone string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasPrefix(s, "0000") {
+		return ""
+	}
+	loc := dateZone
+	if len(zone) == 6 {
+		if t, err := time.Parse("-07:00", zone); err == nil {
+			loc = t.Location()
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, loc)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// Exposure times below a second are written as fractions.
+func exposureTime(v float64) string {
+	if v < 1 {
+		return fmt.Sprintf("1/%d", int(math.Round(1/v)))
+	}
+	return formatFloat(v, 1)
+}
+
+// Formats v with at most prec decimals.
+func formatFloat(v float64, prec int) string {
+	s := strconv.FormatFloat(v, 'f', prec, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
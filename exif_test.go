@@ -0,0 +1,163 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testField struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+	// Index of the directory pointed to, if data is nil
+	ifd int
+}
+
+func asciiField(tag uint16, s string) testField {
+	return testField{tag: tag, typ: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func shortField(tag uint16, v uint16) testField {
+	return testField{tag: tag, typ: 3, count: 1, data: binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func rationalField(tag uint16, v ...uint32) testField {
+	var data []byte
+	for _, n := range v {
+		data = binary.LittleEndian.AppendUint32(data, n)
+	}
+	return testField{tag: tag, typ: 5, count: uint32(len(v) / 2), data: data}
+}
+
+// Builds little endian TIFF data with the directories ifds, one after
+// the other, each followed by the values that do not fit in the fields.
+func buildTIFF(ifds [][]testField) []byte {
+	offsets := make([]uint32, len(ifds))
+	off := uint32(8)
+	for i, fields := range ifds {
+		offsets[i] = off
+		off += uint32(2 + 12*len(fields) + 4)
+		for _, f := range fields {
+			if len(f.data) > 4 {
+				off += uint32(len(f.data))
+			}
+		}
+	}
+	le := binary.LittleEndian
+	b := le.AppendUint32([]byte("II*\x00"), offsets[0])
+	for i, fields := range ifds {
+		b = le.AppendUint16(b, uint16(len(fields)))
+		extra := offsets[i] + uint32(2+12*len(fields)+4)
+		var values []byte
+		for _, f := range fields {
+			b = le.AppendUint16(b, f.tag)
+			if f.data == nil {
+				b = le.AppendUint16(b, 4)
+				b = le.AppendUint32(b, 1)
+				b = le.AppendUint32(b, offsets[f.ifd])
+				continue
+			}
+			b = le.AppendUint16(b, f.typ)
+			b = le.AppendUint32(b, f.count)
+			if len(f.data) > 4 {
+				b = le.AppendUint32(b, extra+uint32(len(values)))
+				values = append(values, f.data...)
+				continue
+			}
+			var v [4]byte
+			copy(v[:], f.data)
+			b = append(b, v[:]...)
+		}
+		b = le.AppendUint32(b, 0)
+		b = append(b, values...)
+	}
+	return b
+}
+
+func testExif() []byte {
+	return buildTIFF([][]testField{
+		{
+			asciiField(tagMake, "Canon"),
+			asciiField(tagModel, "Canon EOS 5D"),
+			shortField(tagOrientation, 6),
+			asciiField(tagDateTime, "2020:01:03 10:00:00"),
+			{tag: tagCopyright, typ: 2, count: 14, data: []byte("Jane\x00Editor X\x00")},
+			{tag: tagExifIFD, ifd: 1},
+			{tag: tagGPSIFD, ifd: 2},
+		},
+		{
+			rationalField(tagExposureTime, 1, 250),
+			rationalField(tagFNumber, 28, 10),
+			shortField(tagISOSpeed, 400),
+			asciiField(tagDateTimeOriginal, "2020:01:02 15:04:05"),
+			asciiField(tagOffsetTimeOriginal, "+02:00"),
+			rationalField(tagFocalLength, 50, 1),
+			shortField(tagColorSpace, 1),
+		},
+		{
+			asciiField(tagGPSLatitudeRef, "N"),
+			rationalField(tagGPSLatitude, 52, 1, 30, 1, 0, 1),
+			asciiField(tagGPSLongitudeRef, "W"),
+			rationalField(tagGPSLongitude, 13, 1, 15, 1, 36, 1),
+		},
+	})
+}
+
+func TestExif(t *testing.T) {
+	tiff := testExif()
+	// The same data in a JPEG segment
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe1}
+	jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(2+len(exifHeader)+len(tiff)))
+	jpeg = append(append(jpeg, exifHeader...), tiff...)
+	jpeg = append(jpeg, 0xff, 0xda, 0, 2)
+	created := time.Date(2020, 1, 2, 15, 4, 5, 0, time.FixedZone("", 2*3600)).Unix()
+	modified := time.Date(2020, 1, 3, 10, 0, 0, 0, time.UTC).Unix()
+	expect := metadata{
+		"camera_make":               "Canon",
+		"camera_model":              "Canon EOS 5D",
+		"orientation":               "6",
+		"copyright":                 "Jane; Editor X",
+		"exposure_time":             "1/250",
+		"f_number":                  "2.8",
+		"iso_speed":                 "400",
+		"focal_length":              "50",
+		"color_space":               "sRGB",
+		"content_creation_date":     strconv.FormatInt(created, 10),
+		"content_modification_date": strconv.FormatInt(modified, 10),
+		"latitude":                  "52.5",
+		"longitude":                 "-13.26",
+	}
+	for name, fn := range map[string]extractor{"tiff": tiffMeta, "jpeg": jpegMeta} {
+		data := tiff
+		if name == "jpeg" {
+			data = jpeg
+		}
+		m := make(metadata)
+		if err := fn(&contents{head: data, size: int64(len(data))}, m); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		for k, v := range expect {
+			if m[k] != v {
+				t.Errorf("%s: %s: expected %q got %q", name, k, v, m[k])
+			}
+		}
+		if len(m) != len(expect) {
+			t.Errorf("%s: expected %d fields, got %v", name, len(expect), m)
+		}
+	}
+}
+
+func TestExifTruncated(t *testing.T) {
+	tiff := testExif()
+	for _, n := range []int{4, 8, 20, 60, 100, 200} {
+		m := make(metadata)
+		// Must not panic
+		tiffMeta(&contents{head: tiff[:n], size: int64(len(tiff))}, m)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *patternList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Append all patterns found in file name, one per line.
+func (l *patternList) load(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return l.read(f)
+}
+
+func (l *patternList) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		// Empty lines and comments are ignored like in gitignore
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		*l = append(*l, line)
+	}
+	return scanner.Err()
+}
+
+// A single gitignore-style pattern
+type pattern struct {
+	// Segments of the pattern, split at slashes
+	parts []string
+	// Pattern starts with '!'
+	negate bool
+	// Pattern ends with '/' and only matches directories
+	dirOnly bool
+	// Pattern contains a slash and is relative to the root
+	anchored bool
+}
+
+func makePattern(s string) pattern {
+	var p pattern
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	}
+	// A leading backslash escapes a literal '!' or '#'
+	if strings.HasPrefix(s, `\!`) || strings.HasPrefix(s, `\#`) {
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+	if strings.Contains(s, "/") {
+		p.anchored = true
+		s = strings.TrimLeft(s, "/")
+	}
+	p.parts = strings.Split(s, "/")
+	return p
+}
+
+func (p *pattern) match(rel string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	if !p.anchored {
+		// Patterns without a slash match the name at any depth
+		ok, _ := path.Match(p.parts[0], path.Base(rel))
+		return ok
+	}
+	return matchParts(p.parts, strings.Split(rel, "/"))
+}
+
+// Match path segments against pattern segments, where "**"
+// matches zero or more whole segments.
+func matchParts(parts, segs []string) bool {
+	for len(parts) > 0 {
+		if parts[0] == "**" {
+			// Trailing "**" matches everything inside
+			if len(parts) == 1 {
+				return len(segs) > 0
+			}
+			for i := 0; i <= len(segs); i++ {
+				if matchParts(parts[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(parts[0], segs[0]); !ok {
+			return false
+		}
+		parts, segs = parts[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// Filters paths relative to the storage root.
+type pathFilter struct {
+	exclude []pattern
+	include []pattern
+}
+
+func newPathFilter(exclude, include []string) *pathFilter {
+	if len(exclude) == 0 && len(include) == 0 {
+		return nil
+	}
+	f := &pathFilter{}
+	for _, s := range exclude {
+		f.exclude = append(f.exclude, makePattern(s))
+	}
+	for _, s := range include {
+		f.include = append(f.include, makePattern(s))
+	}
+	return f
+}
+
+func lastMatch(patterns []pattern, rel string, dir bool) bool {
+	var matched bool
+	// Like in gitignore, the last matching pattern decides
+	for i := range patterns {
+		if patterns[i].match(rel, dir) {
+			matched = !patterns[i].negate
+		}
+	}
+	return matched
+}
+
+// Returns true if the path should not be scanned or processed.
+// Include patterns only apply to files: directories are always
+// descended unless they are excluded.
+func (f *pathFilter) skip(rel string, dir bool) bool {
+	if f == nil {
+		return false
+	}
+	if lastMatch(f.exclude, rel, dir) {
+		return true
+	}
+	if dir || len(f.include) == 0 {
+		return false
+	}
+	return !lastMatch(f.include, rel, dir)
+}
+
+// Path of name relative to the root directory it was found in.
+func relPath(root, name string) string {
+	switch root {
+	case ".":
+		return name
+	case "/":
+		return strings.TrimPrefix(name, "/")
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestPathFilter(t *testing.T) {
+	f := newPathFilter(
+		[]string{"_processed_/", "_temp_/", ".git", "*.tmp", "/user_upload/private/**", "!keep.tmp"},
+		[]string{"*.jpg", "*.tmp", "**/docs/*"},
+	)
+	var cases = []struct {
+		rel  string
+		dir  bool
+		skip bool
+	}{
+		{"_processed_", true, true},
+		{"a/b/_processed_", true, true},
+		{"a/_processed_", false, true},
+		{"docs/_temp_", false, false},
+		{".git", true, true},
+		{"img/photo.jpg", false, false},
+		{"img/photo.png", false, true},
+		{"img/upload.tmp", false, true},
+		{"img/keep.tmp", false, false},
+		{"user_upload/private", true, false},
+		{"user_upload/private/a", true, true},
+		{"user_upload/private/a/b.jpg", false, true},
+		{"docs/readme.txt", false, false},
+		{"a/b/docs/readme.txt", false, false},
+		{"a/b/docs/x/readme.txt", false, true},
+		{"img", true, false},
+	}
+	for _, c := range cases {
+		if skip := f.skip(c.rel, c.dir); skip != c.skip {
+			t.Errorf("%s (dir %v): expected skip %v got %v", c.rel, c.dir, c.skip, skip)
+		}
+	}
+}
+
+func TestRelPath(t *testing.T) {
+	var cases = []struct {
+		root, name, rel string
+	}{
+		{".", "a/b", "a/b"},
+		{"/", "/a/b", "a/b"},
+		{"fileadmin", "fileadmin/a/b", "a/b"},
+		{"/srv/fileadmin", "/srv/fileadmin/a", "a"},
+	}
+	for _, c := range cases {
+		if rel := relPath(c.root, c.name); rel != c.rel {
+			t.Errorf("%s in %s: expected %s got %s", c.name, c.root, c.rel, rel)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Returns a function reading the bytes of b, for a tiffReader.
+func bytesAt(b []byte) func(off, n int64) []byte {
+	return func(off, n int64) []byte {
+		if off < 0 || n < 0 || off+n > int64(len(b)) {
+			return nil
+		}
+		return b[off : off+n]
+	}
+}
+
+// Embedded metadata found in an image.  Each is used in order of
+// precedence, XMP first and EXIF last, like the Metadata Working
+// Group recommends.
+type embedded struct {
+	xmp, iptc []byte
+	exif      *tiffReader
+	ifd0      map[uint16]tiffEntry
+}
+
+func (e *embedded) read(m metadata) error {
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if e.xmp != nil {
+		keep(readXMP(e.xmp, m))
+	}
+	if e.iptc != nil {
+		keep(readIPTC(e.iptc, m))
+	}
+	if e.exif != nil {
+		keep(readExif(e.exif, e.ifd0, m))
+	}
+	return first
+}
+
+// Sets the EXIF data of e from TIFF data read by at.
+func (e *embedded) readTIFF(at func(off, n int64) []byte) error {
+	r, off, err := newTIFFReader(at)
+	if err != nil {
+		return err
+	}
+	ifd0, _, err := r.ifd(off)
+	if err != nil {
+		return err
+	}
+	e.exif, e.ifd0 = r, ifd0
+	return nil
+}
+
+// Calls fn with the marker and data of each segment of a JPEG image
+// before the image data, until fn returns false.
+func jpegSegments(b []byte, fn func(marker byte, data []byte) bool) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return
+	}
+	b = b[2:]
+	for len(b) >= 4 && b[0] == 0xff {
+		marker := b[1]
+		// Fill bytes before a marker
+		if marker == 0xff {
+			b = b[1:]
+			continue
+		}
+		// Start of scan, image data follows
+		if marker == 0xda {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if n < 2 || 2+n > len(b) {
+			return
+		}
+		if !fn(marker, b[4:2+n]) {
+			return
+		}
+		b = b[2+n:]
+	}
+}
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// Tags of TIFF images with embedded metadata
+const (
+	tagXMP       = 0x02bc
+	tagIPTC      = 0x83bb
+	tagPhotoshop = 0x8649
+)
+
+func jpegMeta(c *contents, m metadata) error {
+	var (
+		e   embedded
+		err error
+	)
+	jpegSegments(c.head, func(marker byte, data []byte) bool {
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, exifHeader) && e.exif == nil:
+			err = e.readTIFF(bytesAt(data[len(exifHeader):]))
+		case marker == 0xe1 && bytes.HasPrefix(data, xmpHeader):
+			e.xmp = data[len(xmpHeader):]
+		case marker == 0xed && bytes.HasPrefix(data, photoshopHeader):
+			e.iptc = photoshopResource(data[len(photoshopHeader):], photoshopIPTC)
+		}
+		return true
+	})
+	if rerr := e.read(m); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func tiffMeta(c *contents, m metadata) error {
+	var e embedded
+	if err := e.readTIFF(c.at); err != nil {
+		return err
+	}
+	e.xmp = e.ifd0[tagXMP].value
+	if iptc := e.ifd0[tagIPTC]; iptc.value != nil {
+		e.iptc = iptc.value
+	} else if ps := e.ifd0[tagPhotoshop]; ps.value != nil {
+		e.iptc = photoshopResource(ps.value, photoshopIPTC)
+	}
+	return e.read(m)
+}
+
+var (
+	pngHeader      = []byte("\x89PNG\r\n\x1a\n")
+	errPNGChunk    = errors.New("PNG: invalid chunk")
+	pngXMPKeyword  = "XML:com.adobe.xmp"
+	pngIPTCKeyword = "Raw profile type iptc"
+)
+
+// Maximum size of compressed text of PNG images, once uncompressed.
+const pngTextSize = 1 << 20
+
+// Calls fn with the type and data of each chunk of a PNG image, until
+// the image data or a chunk that was not read.
+func pngChunks(c *contents, fn func(typ string, data []byte)) error {
+	if !bytes.HasPrefix(c.head, pngHeader) {
+		return nil
+	}
+	off := int64(len(pngHeader))
+	for {
+		h := c.at(off, 8)
+		if h == nil {
+			return nil
+		}
+		n := int64(binary.BigEndian.Uint32(h))
+		typ := string(h[4:])
+		if typ == "IDAT" || typ == "IEND" {
+			return nil
+		}
+		data := c.at(off+8, n)
+		if data == nil {
+			return errPNGChunk
+		}
+		fn(typ, data)
+		off += 12 + n
+	}
+}
+
+func pngMeta(c *contents, m metadata) error {
+	var e embedded
+	err := pngChunks(c, func(typ string, data []byte) {
+		keyword, text, ok := pngText(typ, data)
+		if !ok {
+			return
+		}
+		switch keyword {
+		case pngXMPKeyword:
+			e.xmp = text
+		case pngIPTCKeyword:
+			if b := rawProfile(text); bytes.HasPrefix(b, []byte("8BIM")) {
+				e.iptc = photoshopResource(b, photoshopIPTC)
+			} else {
+				e.iptc = b
+			}
+		}
+	})
+	if rerr := e.read(m); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Returns the keyword and text of PNG text chunks, uncompressed.
+func pngText(typ string, data []byte) (string, []byte, bool) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return "", nil, false
+	}
+	keyword, data := string(data[:i]), data[i+1:]
+	if keyword != pngXMPKeyword && keyword != pngIPTCKeyword {
+		return "", nil, false
+	}
+	compressed := false
+	switch typ {
+	case "tEXt":
+	case "zTXt":
+		compressed = true
+		if len(data) < 1 {
+			return "", nil, false
+		}
+		data = data[1:]
+	case "iTXt":
+		// Compression flag and method, language and translated keyword
+		if len(data) < 2 {
+			return "", nil, false
+		}
+		compressed = data[0] == 1
+		data = data[2:]
+		for j := 0; j < 2; j++ {
+			i := bytes.IndexByte(data, 0)
+			if i < 0 {
+				return "", nil, false
+			}
+			data = data[i+1:]
+		}
+	default:
+		return "", nil, false
+	}
+	if !compressed {
+		return keyword, data, true
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, false
+	}
+	defer r.Close()
+	text, err := io.ReadAll(io.LimitReader(r, pngTextSize))
+	if err != nil {
+		return "", nil, false
+	}
+	return keyword, text, true
+}
+
+// Decodes the raw profiles written by ImageMagick: a name, the size
+// and the data in hexadecimal, each on new lines.
+func rawProfile(text []byte) []byte {
+	lines := strings.SplitN(strings.TrimLeft(string(text), "\n"), "\n", 3)
+	if len(lines) < 3 {
+		return nil
+	}
+	data, err := hex.DecodeString(strings.Join(strings.Fields(lines[2]), ""))
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,323 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Formats without a decoder in the standard library: only their
+// configuration is read, from the head of the file.
+func init() {
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", noDecode, icoConfig)
+	image.RegisterFormat("cur", "\x00\x00\x02\x00", noDecode, icoConfig)
+	image.RegisterFormat("psd", "8BPS", noDecode, psdConfig)
+	image.RegisterFormat("heif", "????ftyp", noDecode, heifConfig)
+}
+
+var errNoDecode = errors.New("image: only the configuration of the format is read")
+
+func noDecode(r io.Reader) (image.Image, error) {
+	return nil, errNoDecode
+}
+
+var errICO = errors.New("ICO: invalid directory")
+
+// Returns the size of the largest image of icons and cursors.  Sizes
+// of 256 pixels are written as zero.
+func icoConfig(r io.Reader) (image.Config, error) {
+	var h [6]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return image.Config{}, err
+	}
+	n := int(binary.LittleEndian.Uint16(h[4:]))
+	if n == 0 {
+		return image.Config{}, errICO
+	}
+	entries := make([]byte, n*16)
+	if _, err := io.ReadFull(r, entries); err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{ColorModel: color.RGBAModel}
+	for i := 0; i < n; i++ {
+		w, h := int(entries[i*16]), int(entries[i*16+1])
+		if w == 0 {
+			w = 256
+		}
+		if h == 0 {
+			h = 256
+		}
+		if w*h > cfg.Width*cfg.Height {
+			cfg.Width, cfg.Height = w, h
+		}
+	}
+	return cfg, nil
+}
+
+var errPSD = errors.New("PSD: invalid header")
+
+// Returns the size and color model of Photoshop documents, PSD and PSB.
+func psdConfig(r io.Reader) (image.Config, error) {
+	var h [26]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return image.Config{}, err
+	}
+	if v := binary.BigEndian.Uint16(h[4:]); v != 1 && v != 2 {
+		return image.Config{}, errPSD
+	}
+	cfg := image.Config{
+		Height: int(binary.BigEndian.Uint32(h[14:])),
+		Width:  int(binary.BigEndian.Uint32(h[18:])),
+	}
+	switch binary.BigEndian.Uint16(h[24:]) {
+	case 0, 1, 8:
+		// Bitmap, grayscale and duotone
+		cfg.ColorModel = color.GrayModel
+	case 2:
+		cfg.ColorModel = color.Palette{}
+	case 4:
+		cfg.ColorModel = color.CMYKModel
+	default:
+		cfg.ColorModel = color.RGBAModel
+	}
+	return cfg, nil
+}
+
+var errHEIF = errors.New("HEIF: no image size")
+
+// Returns the size of the primary image of HEIF files, HEIC and AVIF:
+// the image spatial extents property associated with it, rotated by
+// the image rotation property.
+func heifConfig(r io.Reader) (image.Config, error) {
+	b, err := io.ReadAll(io.LimitReader(r, headSize))
+	if err != nil {
+		return image.Config{}, err
+	}
+	c := &contents{head: b, size: int64(len(b))}
+	var (
+		primary uint32
+		// Properties, and those of each item by index from 1
+		props []image.Point
+		assoc = make(map[uint32][]int)
+	)
+	var merr error
+	err = mp4Boxes(c, 0, c.size, func(typ string, off, n int64) bool {
+		if typ != "meta" {
+			return true
+		}
+		// Full box, version and flags come first
+		merr = mp4Boxes(c, off+4, off+n, func(typ string, off, n int64) bool {
+			data := c.at(off, n)
+			switch typ {
+			case "pitm":
+				if len(data) >= 6 && data[0] == 0 {
+					primary = uint32(binary.BigEndian.Uint16(data[4:]))
+				} else if len(data) >= 8 {
+					primary = binary.BigEndian.Uint32(data[4:])
+				}
+			case "iprp":
+				mp4Boxes(c, off, off+n, func(typ string, off, n int64) bool {
+					switch typ {
+					case "ipco":
+						props = heifProperties(c, off, n)
+					case "ipma":
+						heifAssociations(c.at(off, n), assoc)
+					}
+					return true
+				})
+			}
+			return true
+		})
+		return false
+	})
+	if err == nil {
+		err = merr
+	}
+	if err != nil {
+		return image.Config{}, err
+	}
+	cfg := image.Config{ColorModel: color.YCbCrModel}
+	rotated := false
+	for _, i := range assoc[primary] {
+		if i < 1 || i > len(props) {
+			continue
+		}
+		switch p := props[i-1]; {
+		case p.X < 0:
+			rotated = p.Y%2 == 1
+		case p.X > 0 && cfg.Width == 0:
+			cfg.Width, cfg.Height = p.X, p.Y
+		}
+	}
+	// Without associations, the largest image
+	if cfg.Width == 0 {
+		for _, p := range props {
+			if p.X*p.Y > cfg.Width*cfg.Height {
+				cfg.Width, cfg.Height = p.X, p.Y
+			}
+		}
+	}
+	if cfg.Width == 0 {
+		return image.Config{}, errHEIF
+	}
+	if rotated {
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+	return cfg, nil
+}
+
+// Returns the properties of a HEIF file in order: image spatial extents
+// as their size, rotations as -1 and the quarter turns, others as zero.
+func heifProperties(c *contents, off, n int64) []image.Point {
+	var props []image.Point
+	mp4Boxes(c, off, off+n, func(typ string, off, n int64) bool {
+		var p image.Point
+		data := c.at(off, n)
+		switch {
+		case typ == "ispe" && len(data) >= 12:
+			p = image.Point{int(binary.BigEndian.Uint32(data[4:])), int(binary.BigEndian.Uint32(data[8:]))}
+		case typ == "irot" && len(data) >= 1:
+			p = image.Point{-1, int(data[0] & 3)}
+		}
+		props = append(props, p)
+		return true
+	})
+	return props
+}
+
+// Reads the property indexes associated with each item.
+func heifAssociations(b []byte, assoc map[uint32][]int) {
+	if len(b) < 8 {
+		return
+	}
+	version, flags := b[0], b[3]
+	count := int(binary.BigEndian.Uint32(b[4:]))
+	b = b[8:]
+	for i := 0; i < count; i++ {
+		var item uint32
+		if version < 1 {
+			if len(b) < 3 {
+				return
+			}
+			item, b = uint32(binary.BigEndian.Uint16(b)), b[2:]
+		} else {
+			if len(b) < 5 {
+				return
+			}
+			item, b = binary.BigEndian.Uint32(b), b[4:]
+		}
+		n := int(b[0])
+		b = b[1:]
+		for j := 0; j < n; j++ {
+			// The highest bit tells if the property is essential
+			var index int
+			if flags&1 != 0 {
+				if len(b) < 2 {
+					return
+				}
+				index, b = int(binary.BigEndian.Uint16(b)&0x7fff), b[2:]
+			} else {
+				if len(b) < 1 {
+					return
+				}
+				index, b = int(b[0]&0x7f), b[1:]
+			}
+			assoc[item] = append(assoc[item], index)
+		}
+	}
+}
+
+var errSVG = errors.New("SVG: no svg element")
+
+// Extracts the size of SVG images, compressed with gzip or not, from
+// the attributes of the svg element, like TYPO3: the width and height
+// without unit, or the size of the view box.
+func svgMeta(c *contents, m metadata) error {
+	var r io.Reader = bytes.NewReader(c.head)
+	if bytes.HasPrefix(c.head, []byte("\x1f\x8b")) {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = io.LimitReader(z, headSize)
+	}
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return errSVG
+		}
+		t, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if t.Name.Local != "svg" {
+			return errSVG
+		}
+		var width, height, viewBox string
+		for _, a := range t.Attr {
+			switch a.Name.Local {
+			case "width":
+				width = a.Value
+			case "height":
+				height = a.Value
+			case "viewBox":
+				viewBox = a.Value
+			}
+		}
+		w, h := svgLength(width), svgLength(height)
+		box := strings.FieldsFunc(viewBox, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+		})
+		if len(box) == 4 {
+			bw, bh := svgLength(box[2]), svgLength(box[3])
+			// Only one of them, the other keeps the ratio
+			switch {
+			case w == 0 && h == 0:
+				w, h = bw, bh
+			case w == 0 && bh > 0:
+				w = int(math.Round(float64(h) * float64(bw) / float64(bh)))
+			case h == 0 && bw > 0:
+				h = int(math.Round(float64(w) * float64(bh) / float64(bw)))
+			}
+		}
+		if w > 0 && h > 0 {
+			m.set("width", strconv.Itoa(w))
+			m.set("height", strconv.Itoa(h))
+		}
+		return nil
+	}
+}
+
+// Returns the number of an SVG length, zero for percentages.
+func svgLength(s string) int {
+	s = strings.TrimSpace(s)
+	i := 0
+	for i < len(s) && (s[i] == '.' || s[i] == '-' || s[i] == '+' || (s[i] >= '0' && s[i] <= '9')) {
+		i++
+	}
+	if strings.HasSuffix(s, "%") {
+		return 0
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || v <= 0 || v > math.MaxInt32 {
+		return 0
+	}
+	return int(math.Round(v))
+}
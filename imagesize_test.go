@@ -0,0 +1,90 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+func TestSVG(t *testing.T) {
+	tests := []struct {
+		svg, width, height string
+	}{
+		{`<svg width="120" height="80px"/>`, "120", "80"},
+		{`<?xml version="1.0"?><!DOCTYPE svg><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 199.7 184.2">`, "200", "184"},
+		{`<svg width="100%" height="100%" viewBox="0,0,64,32">`, "64", "32"},
+		{`<svg width="128" viewBox="0 0 64 32">`, "128", "64"},
+		{`<svg>`, "", ""},
+	}
+	for _, tt := range tests {
+		m := make(metadata)
+		if err := svgMeta(&contents{head: []byte(tt.svg)}, m); err != nil {
+			t.Errorf("%s: %s", tt.svg, err)
+		}
+		if m["width"] != tt.width || m["height"] != tt.height {
+			t.Errorf("%s: expected %sx%s, got %sx%s", tt.svg, tt.width, tt.height, m["width"], m["height"])
+		}
+	}
+	var b bytes.Buffer
+	z := gzip.NewWriter(&b)
+	z.Write([]byte(tests[0].svg))
+	z.Close()
+	m := make(metadata)
+	if err := svgMeta(&contents{head: b.Bytes()}, m); err != nil || m["width"] != "120" {
+		t.Errorf("SVGZ: unexpected %v, %v", m, err)
+	}
+	// Detected from the contents too
+	if mime := detectMIME(b.Bytes()); mime != "image/svg+xml" {
+		t.Errorf("SVGZ: expected image/svg+xml, got %s", mime)
+	}
+}
+
+func TestImageConfig(t *testing.T) {
+	// Icon of 16x16 and 256x256 pixels
+	ico := []byte("\x00\x00\x01\x00\x02\x00")
+	ico = append(ico, "\x10\x10\x00\x00\x01\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	ico = append(ico, "\x00\x00\x00\x00\x01\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	psd := []byte("8BPS\x00\x01\x00\x00\x00\x00\x00\x00\x00\x03\x00\x00\x01\x2c\x00\x00\x01\x90\x00\x08\x00\x04")
+	// Image of 4032x3024 rotated by a quarter turn, and its thumbnail
+	ispe := func(w, h uint32) []byte {
+		b := binary.BigEndian.AppendUint32(make([]byte, 4), w)
+		return box("ispe", binary.BigEndian.AppendUint32(b, h))
+	}
+	heif := bytes.Join([][]byte{
+		box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic")),
+		box("meta", make([]byte, 4),
+			box("pitm", []byte{0, 0, 0, 0, 0, 1}),
+			box("iprp",
+				box("ipco", ispe(320, 240), ispe(4032, 3024), box("irot", []byte{1})),
+				box("ipma", []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 2, 1, 0x81, 0, 1, 2, 0x82, 3}))),
+	}, nil)
+	tests := []struct {
+		name          string
+		data          []byte
+		format        string
+		width, height int
+	}{
+		{"ico", ico, "ico", 256, 256},
+		{"psd", psd, "psd", 400, 300},
+		{"heif", heif, "heif", 3024, 4032},
+	}
+	for _, tt := range tests {
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if format != tt.format || cfg.Width != tt.width || cfg.Height != tt.height {
+			t.Errorf("%s: expected %s %dx%d, got %s %dx%d", tt.name, tt.format, tt.width, tt.height, format, cfg.Width, cfg.Height)
+		}
+	}
+	if cfg, _, _ := image.DecodeConfig(bytes.NewReader(psd)); colorSpace(cfg.ColorModel) != "CMYK" {
+		t.Errorf("psd: expected CMYK, got %s", colorSpace(cfg.ColorModel))
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errIPTC = errors.New("IPTC: invalid dataset")
+
+// Datasets of the application record of IPTC-IIM used for metadata
+const (
+	iptcObjectName  = 5
+	iptcKeywords    = 25
+	iptcDateCreated = 55
+	iptcTimeCreated = 60
+	iptcByline      = 80
+	iptcHeadline    = 105
+	iptcCopyright   = 116
+	iptcCaption     = 120
+)
+
+// Extracts metadata from IPTC-IIM data.  Text is UTF-8 or, in older
+// files, Latin-1.
+func readIPTC(b []byte, m metadata) error {
+	values := make(map[int][]string)
+	for len(b) > 0 {
+		// Padding after the last dataset
+		if b[0] == 0 {
+			break
+		}
+		if len(b) < 5 || b[0] != 0x1c {
+			return errIPTC
+		}
+		record, dataset := b[1], int(b[2])
+		n := int(binary.BigEndian.Uint16(b[3:]))
+		b = b[5:]
+		// Extended datasets have the size of the size first
+		if n&0x8000 != 0 {
+			size := n & 0x7fff
+			if size > 4 || len(b) < size {
+				return errIPTC
+			}
+			n = 0
+			for _, c := range b[:size] {
+				n = n<<8 | int(c)
+			}
+			b = b[size:]
+		}
+		if n < 0 || len(b) < n {
+			return errIPTC
+		}
+		if record == 2 {
+			values[dataset] = append(values[dataset], string(b[:n]))
+		}
+		b = b[n:]
+	}
+	first := func(dataset int) string {
+		if v := values[dataset]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	m.set("title", first(iptcObjectName))
+	m.set("description", first(iptcCaption))
+	m.set("alternative", first(iptcHeadline))
+	m.set("keywords", strings.Join(values[iptcKeywords], ", "))
+	m.set("creator", strings.Join(values[iptcByline], ", "))
+	m.set("copyright", first(iptcCopyright))
+	m.set("content_creation_date", iptcTime(first(iptcDateCreated), first(iptcTimeCreated)))
+	return nil
+}
+
+// Returns the Unix time of an IPTC date and time as a string.  Dates
+// without time are at midnight, dates without time zone in dateZone.
+func iptcTime(date, clock string) string {
+	if len(date) != 8 || strings.HasPrefix(date, "0000") {
+		return ""
+	}
+	var (
+		t   time.Time
+		err error
+	)
+	switch len(clock) {
+	case 11:
+		t, err = time.Parse("20060102150405-0700", date+clock)
+	case 6:
+		t, err = time.ParseInLocation("20060102150405", date+clock, dateZone)
+	default:
+		t, err = time.ParseInLocation("20060102", date, dateZone)
+	}
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// Resource of Photoshop image resources with the IPTC data.
+const photoshopIPTC = 0x0404
+
+// Returns the IPTC data in Photoshop image resources, or nil.
+func photoshopResource(b []byte, id uint16) []byte {
+	for len(b) >= 12 && bytes.HasPrefix(b, []byte("8BIM")) {
+		rid := binary.BigEndian.Uint16(b[4:])
+		// Name as Pascal string, padded to an even size
+		name := 1 + int(b[6])
+		name += name % 2
+		if len(b) < 6+name+4 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint32(b[6+name:]))
+		b = b[6+name+4:]
+		if n < 0 || n > len(b) {
+			return nil
+		}
+		if rid == id {
+			return b[:n]
+		}
+		// The padding of the last resource can be missing
+		b = b[min(n+n%2, len(b)):]
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"unicode/utf8"
+)
+
+// Modes to choose the MIME type of a file
+const (
+	// Extension first, contents only without extension
+	mimeExtension = "extension"
+	// Contents first, as libmagic does, extension only if unknown
+	mimeContent = "content"
+)
+
+func validMIMEMode(s string) bool {
+	return s == mimeExtension || s == mimeContent
+}
+
+// Signature at a fixed offset.  MIME types are the ones used by libmagic.
+type magic struct {
+	offset int
+	sig    string
+	mime   string
+}
+
+// Simple signatures, checked in order after the container formats.
+var magics = []magic{
+	{0, "%PDF-", "application/pdf"},
+	{0, "%!PS", "application/postscript"},
+	{0, "{\\rtf", "text/rtf"},
+	{0, "Rar!\x1a\x07", "application/x-rar"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\x1f\x8b", "application/gzip"},
+	{0, "BZh", "application/x-bzip2"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{257, "ustar", "application/x-tar"},
+	{0, "\x89PNG\r\n\x1a\n", "image/png"},
+	{0, "\xff\xd8\xff", "image/jpeg"},
+	{0, "GIF87a", "image/gif"},
+	{0, "GIF89a", "image/gif"},
+	{0, "II*\x00", "image/tiff"},
+	{0, "MM\x00*", "image/tiff"},
+	{0, "8BPS", "image/vnd.adobe.photoshop"},
+	{0, "\x00\x00\x01\x00", "image/vnd.microsoft.icon"},
+	{0, "\x00\x00\x00\x0cjP  \r\n\x87\n", "image/jp2"},
+	{0, "wOFF", "font/woff"},
+	{0, "wOF2", "font/woff2"},
+	{0, "\x00\x01\x00\x00\x00", "font/sfnt"},
+	{0, "OTTO", "font/sfnt"},
+	{0, "ttcf", "font/sfnt"},
+	{0, "fLaC", "audio/flac"},
+	{0, "ID3", "audio/mpeg"},
+	{0, "MThd", "audio/midi"},
+	{0, "FLV\x01", "video/x-flv"},
+	{0, "\x30\x26\xb2\x75\x8e\x66\xcf\x11", "video/x-ms-asf"},
+	{0, "\x00\x00\x01\xba", "video/mpeg"},
+	{0, "\x00\x00\x01\xb3", "video/mpeg"},
+	{0, "FWS", "application/x-shockwave-flash"},
+	{0, "CWS", "application/x-shockwave-flash"},
+	{0, "ZWS", "application/x-shockwave-flash"},
+	{0, "MZ", "application/x-dosexec"},
+	{0, "SQLite format 3\x00", "application/vnd.sqlite3"},
+	{4, "Standard Jet DB", "application/x-msaccess"},
+	{4, "Standard ACE DB", "application/x-msaccess"},
+}
+
+// Detects the MIME type from the start of the contents.  Returns
+// an empty string if the type is not known.
+func detectMIME(head []byte) string {
+	if len(head) == 0 {
+		return "inode/x-empty"
+	}
+	if m := detectContainer(head); m != "" {
+		return m
+	}
+	for _, m := range magics {
+		if hasAt(head, m.offset, m.sig) {
+			return m.mime
+		}
+	}
+	if isMPEGAudio(head) {
+		return "audio/mpeg"
+	}
+	if isBMP(head) {
+		return "image/x-ms-bmp"
+	}
+	return detectText(head)
+}
+
+func hasAt(b []byte, off int, sig string) bool {
+	return len(b) >= off+len(sig) && string(b[off:off+len(sig)]) == sig
+}
+
+// Formats that contain other formats and need a closer look.
+func detectContainer(head []byte) string {
+	switch {
+	case hasAt(head, 0, "PK\x03\x04"):
+		return detectZip(head)
+	case hasAt(head, 0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"):
+		return detectOLE(head)
+	case hasAt(head, 0, "RIFF"):
+		switch {
+		case hasAt(head, 8, "WAVE"):
+			return "audio/x-wav"
+		case hasAt(head, 8, "AVI "):
+			return "video/x-msvideo"
+		case hasAt(head, 8, "WEBP"):
+			return "image/webp"
+		}
+	case hasAt(head, 0, "FORM") && (hasAt(head, 8, "AIFF") || hasAt(head, 8, "AIFC")):
+		return "audio/x-aiff"
+	case hasAt(head, 4, "ftyp"):
+		return detectISOBMFF(head)
+	case hasAt(head, 0, "\x1a\x45\xdf\xa3"):
+		// The document type is near the start of the EBML header
+		if bytes.Contains(head[:min(len(head), 64)], []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case hasAt(head, 0, "OggS"):
+		if bytes.Contains(head[:min(len(head), 128)], []byte("\x80theora")) {
+			return "video/ogg"
+		}
+		return "audio/ogg"
+	case hasAt(head, 0, "\x7fELF"):
+		return detectELF(head)
+	case hasAt(head, 0, "\x1f\x8b"):
+		return detectGzip(head)
+	}
+	return ""
+}
+
+// Compressed SVG images are told apart from other gzip files by
+// the start of their decompressed contents.
+func detectGzip(head []byte) string {
+	if z, err := gzip.NewReader(bytes.NewReader(head)); err == nil {
+		b, _ := io.ReadAll(io.LimitReader(z, 4096))
+		if detectText(b) == "image/svg+xml" {
+			return "image/svg+xml"
+		}
+	}
+	return "application/gzip"
+}
+
+// Shared objects with an interpreter are position independent executables.
+func detectELF(head []byte) string {
+	if len(head) < 64 {
+		return "application/x-executable"
+	}
+	order := binary.ByteOrder(binary.LittleEndian)
+	if head[5] == 2 {
+		order = binary.BigEndian
+	}
+	if order.Uint16(head[16:]) != 3 {
+		return "application/x-executable"
+	}
+	// Position of the program headers depends on the class
+	var phoff, phentsize, phnum int
+	if head[4] == 2 {
+		phoff = int(order.Uint64(head[32:]))
+		phentsize = int(order.Uint16(head[54:]))
+		phnum = int(order.Uint16(head[56:]))
+	} else {
+		phoff = int(order.Uint32(head[28:]))
+		phentsize = int(order.Uint16(head[42:]))
+		phnum = int(order.Uint16(head[44:]))
+	}
+	for i := 0; i < phnum; i++ {
+		off := phoff + i*phentsize
+		if off < 0 || off+4 > len(head) {
+			break
+		}
+		// PT_INTERP
+		if order.Uint32(head[off:]) == 3 {
+			return "application/x-pie-executable"
+		}
+	}
+	return "application/x-sharedlib"
+}
+
+// Tells apart the formats based on ZIP from the names of the first
+// entries.  Only entries that are in head are seen.
+func detectZip(head []byte) string {
+	for off, first := 0, true; hasAt(head, off, "PK\x03\x04") && off+30 <= len(head); first = false {
+		method := binary.LittleEndian.Uint16(head[off+8:])
+		csize := int(binary.LittleEndian.Uint32(head[off+18:]))
+		nlen := int(binary.LittleEndian.Uint16(head[off+26:]))
+		xlen := int(binary.LittleEndian.Uint16(head[off+28:]))
+		start := off + 30
+		if start+nlen > len(head) {
+			break
+		}
+		name := string(head[start : start+nlen])
+		data := start + nlen + xlen
+		if data > len(head) {
+			break
+		}
+		// Sizes are unknown when they follow the data: the
+		// entry ends where the next one starts
+		sizeAfter := binary.LittleEndian.Uint16(head[off+6:])&0x8 != 0
+		if sizeAfter {
+			csize = bytes.Index(head[data:], []byte("PK"))
+			if csize < 0 {
+				break
+			}
+		}
+		// OpenDocument and EPUB store their type uncompressed first
+		if first && name == "mimetype" && method == 0 && csize < 128 && data+csize <= len(head) {
+			return string(head[data : data+csize])
+		}
+		switch {
+		case hasPrefix(name, "word/"):
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		case hasPrefix(name, "xl/"):
+			return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case hasPrefix(name, "ppt/"):
+			return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+		case name == "META-INF/MANIFEST.MF":
+			return "application/java-archive"
+		}
+		off = data + csize
+		if sizeAfter {
+			next := bytes.Index(head[off:], []byte("PK\x03\x04"))
+			if next < 0 {
+				break
+			}
+			off += next
+		}
+	}
+	return "application/zip"
+}
+
+func hasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
+
+// Tells apart Microsoft Office formats from the names of the streams
+// in the compound document, which are UTF-16.
+func detectOLE(head []byte) string {
+	streams := []struct {
+		name, mime string
+	}{
+		{"WordDocument", "application/msword"},
+		{"Workbook", "application/vnd.ms-excel"},
+		{"Book", "application/vnd.ms-excel"},
+		{"PowerPoint Document", "application/vnd.ms-powerpoint"},
+	}
+	for _, s := range streams {
+		if bytes.Contains(head, utf16le(s.name)) {
+			return s.mime
+		}
+	}
+	return "application/vnd.ms-office"
+}
+
+func utf16le(s string) []byte {
+	b := make([]byte, 0, 2*len(s))
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i], 0)
+	}
+	return b
+}
+
+// Formats based on the ISO base media file format, by major brand.
+func detectISOBMFF(head []byte) string {
+	if len(head) < 12 {
+		return ""
+	}
+	switch string(head[8:12]) {
+	case "qt  ":
+		return "video/quicktime"
+	case "M4A ", "M4B ":
+		return "audio/x-m4a"
+	case "avif", "avis":
+		return "image/avif"
+	case "heic", "heix", "heim", "heis":
+		return "image/heic"
+	case "mif1", "msf1":
+		return "image/heif"
+	case "3gp4", "3gp5", "3gp6", "3gp7", "3ge6", "3ge7", "3gg6":
+		return "video/3gpp"
+	case "3g2a", "3g2b", "3g2c":
+		return "video/3gpp2"
+	case "crx ":
+		return "image/x-canon-cr3"
+	}
+	return "video/mp4"
+}
+
+// MPEG audio without ID3 tag starts with a frame header.
+func isMPEGAudio(head []byte) bool {
+	if len(head) < 4 || head[0] != 0xff || head[1]&0xe0 != 0xe0 {
+		return false
+	}
+	version := head[1] >> 3 & 3
+	layer := head[1] >> 1 & 3
+	bitrate := head[2] >> 4
+	rate := head[2] >> 2 & 3
+	return version != 1 && layer != 0 && bitrate != 0 && bitrate != 15 && rate != 3
+}
+
+// Two letters are not enough: the size of the header must be known.
+func isBMP(head []byte) bool {
+	if !hasAt(head, 0, "BM") || len(head) < 18 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(head[14:]) {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+// Detects markup and plain text.  Binary contents are not known.
+func detectText(head []byte) string {
+	sample := head[:min(len(head), 4096)]
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return ""
+	}
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(sample, []byte("\xef\xbb\xbf")), " \t\r\n")
+	lower := bytes.ToLower(trimmed[:min(len(trimmed), 512)])
+	switch {
+	case bytes.HasPrefix(sample, []byte("#!")):
+		return detectInterpreter(sample)
+	// PHP code can start anywhere in a template
+	case bytes.Contains(bytes.ToLower(sample), []byte("<?php")):
+		return "text/x-php"
+	case bytes.HasPrefix(lower, []byte("<?xml")):
+		if bytes.Contains(lower, []byte("<svg")) {
+			return "image/svg+xml"
+		}
+		return "text/xml"
+	case bytes.HasPrefix(lower, []byte("<svg")):
+		return "image/svg+xml"
+	case bytes.HasPrefix(lower, []byte("<!doctype html")),
+		bytes.HasPrefix(lower, []byte("<html")),
+		bytes.HasPrefix(lower, []byte("<head")),
+		bytes.HasPrefix(lower, []byte("<body")):
+		return "text/html"
+	}
+	if !validText(sample) {
+		return ""
+	}
+	return "text/plain"
+}
+
+// Type of a script from the interpreter in its first line.
+func detectInterpreter(sample []byte) string {
+	line := sample
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	switch {
+	case bytes.Contains(line, []byte("python")):
+		return "text/x-script.python"
+	case bytes.Contains(line, []byte("perl")):
+		return "text/x-perl"
+	case bytes.Contains(line, []byte("php")):
+		return "text/x-php"
+	case bytes.Contains(line, []byte("node")):
+		return "application/javascript"
+	case bytes.Contains(line, []byte("ruby")):
+		return "text/x-ruby"
+	}
+	return "text/x-shellscript"
+}
+
+// Text is valid UTF-8 or Latin-1 without control characters
+// other than whitespace.  An incomplete rune at the end is allowed.
+func validText(b []byte) bool {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			if !utf8.FullRune(b) && len(b) < utf8.UTFMax {
+				return true
+			}
+			// Latin-1 text
+			if b[0] < 0xa0 {
+				return false
+			}
+		} else if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' && r != 0x1b {
+			return false
+		}
+		b = b[size:]
+	}
+	return true
+}
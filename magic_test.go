@@ -0,0 +1,45 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestDetectMIME(t *testing.T) {
+	var tests = []struct {
+		head string
+		mime string
+	}{
+		{"%PDF-1.7\n", "application/pdf"},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"\x00\x00\x00\x1cftypisom\x00\x00\x02\x00", "video/mp4"},
+		{"\x00\x00\x00\x1cftypqt  \x00\x00\x02\x00", "video/quicktime"},
+		{"\x00\x00\x00\x1cftypheic\x00\x00\x00\x00", "image/heic"},
+		{"\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm", "video/webm"},
+		{"PK\x03\x04\x14\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x14\x00\x00\x00\x14\x00\x00\x00\x08\x00\x00\x00mimetypeapplication/epub+zip", "application/epub+zip"},
+		{"PK\x03\x04\x14\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x0a\x00\x00\x00ppt/slides", "application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+		{"PK\x03\x04\x14\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00a.txt", "application/zip"},
+		{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1\x00W\x00o\x00r\x00k\x00b\x00o\x00o\x00k\x00", "application/vnd.ms-excel"},
+		{"wOF2\x00\x01\x00\x00", "font/woff2"},
+		{"\x00\x01\x00\x00\x00\x0f\x00\x80", "font/sfnt"},
+		{"ID3\x04\x00\x00\x00\x00\x00\x00", "audio/mpeg"},
+		{"\xff\xfb\x90\x64\x00", "audio/mpeg"},
+		{"BM\x36\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00", "image/x-ms-bmp"},
+		{"BMW is a car\n", "text/plain"},
+		{"<?xml version=\"1.0\"?>\n<svg xmlns=\"http://www.w3.org/2000/svg\">", "image/svg+xml"},
+		{"  <!DOCTYPE HTML>\n<html>", "text/html"},
+		{"caf\xe9 au lait\n", "text/plain"},
+		{"#!/usr/bin/env python3\nprint()\n", "text/x-script.python"},
+		{"#!/bin/sh\necho\n", "text/x-shellscript"},
+		{"<html><?PHP echo 1; ?></html>", "text/x-php"},
+		{"\x00\x01\x02\x03binary", ""},
+		{"", "inode/x-empty"},
+	}
+	for _, tt := range tests {
+		if mime := detectMIME([]byte(tt.head)); mime != tt.mime {
+			t.Errorf("%q: expected %q got %q", tt.head, tt.mime, mime)
+		}
+	}
+}
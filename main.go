@@ -6,30 +6,72 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	singleMode = flag.Bool("single", false, "Output in single view mode")
-	sqlMode    = flag.Bool("sql", false, "Output in SQL mode")
-	useMd5     = flag.Bool("md5", false, "Use MD5 instead of SHA-1 to produce digests")
-	osqlMode   = flag.String("osql", "", "Output SQL parsing common CSV from file `F` or stdin")
-	fileMode   = flag.String("ofile", "", "Output the CSV for sys_file reading reading from `F`")
-	metaMode   = flag.String("ometa", "", "Output the CSV for sys_file_metadata reading from `F`")
-	dumpDB     = flag.String("dump", "", "Output common CSV from tables in database `DB` (full DSN)")
-	profile    = flag.String("profile", "", "Write profiling information to this file `F`")
-	multiplier = flag.Int("multi", 3, "Number `N` of workers to run for each CPU")
-	workerN    = flag.Int("wg", 1, "Total number `N` of workers")
-	workerID   = flag.Int("w", 1, "Number `N` of this specific worker instance")
-	deltas     deltaFiles // Custom type to catch several files if flag is repeated
+	singleMode      = flag.Bool("single", false, "Output in single view mode")
+	sqlMode         = flag.Bool("sql", false, "Output in SQL mode")
+	useMd5          = flag.Bool("md5", false, "Use MD5 instead of SHA-1 to produce digests")
+	osqlMode        = flag.String("osql", "", "Output SQL parsing common CSV from file `F` or stdin")
+	fileMode        = flag.String("ofile", "", "Output the CSV for sys_file reading reading from `F`")
+	metaMode        = flag.String("ometa", "", "Output the CSV for sys_file_metadata reading from `F`")
+	dumpDB          = flag.String("dump", "", "Output common CSV from tables in database `DB` (full DSN)")
+	profile         = flag.String("profile", "", "Write profiling information to this file `F`")
+	multiplier      = flag.Int("multi", 3, "Number `N` of workers to run for each CPU")
+	queueMax        = flag.Int("queue", 100000, "Number `N` of directories to queue in memory before using a temporary file")
+	workerN         = flag.Int("wg", 1, "Total number `N` of workers")
+	workerID        = flag.Int("w", 1, "Number `N` of this specific worker instance")
+	excludeF        = flag.String("exclude-from", "", "Read exclude patterns from file `F`, one per line")
+	includeF        = flag.String("include-from", "", "Read include patterns from file `F`, one per line")
+	watchMode       = flag.Bool("watch", false, "After scanning, keep running and output records of changed files")
+	outFile         = flag.String("o", "", "Write output to file `F` instead of stdout")
+	xdev            = flag.Bool("xdev", false, "Do not descend into directories on other filesystems")
+	fileList        = flag.String("files", "", "Index the files listed in `F` or stdin instead of scanning")
+	nullSep         = flag.Bool("null", false, "Names in the -files list are separated by NUL instead of newline")
+	errorsFile      = flag.String("errors", "", "Write a CSV report of all errors to file `F`")
+	onError         = flag.String("on-error", onErrorFlag, "Policy `P` for files that cannot be read: skip, flag or abort")
+	maxErrors       = flag.Int("max-errors", -1, "Exit with an error if more than `N` files cannot be read, -1 to disable")
+	metricsAddr     = flag.String("metrics-addr", "", "Serve Prometheus metrics on `ADDR` at /metrics")
+	progressEvery   = flag.Duration("progress", 0, "Print progress to stderr every `D`; also printed on SIGUSR1")
+	checkpointF     = flag.String("checkpoint", "", "Periodically save the state of the scan to file `F`")
+	checkpointEvery = flag.Duration("checkpoint-every", time.Minute, "Save a checkpoint every `D`")
+	resume          = flag.Bool("resume", false, "Resume the scan saved with -checkpoint, appending to the -o file")
+	mimeTypesF      = flag.String("mime-types", "", "Override the built-in MIME types by extension with the ones in file `F`")
+	mismatchesF     = flag.String("mismatches", "", "Write a CSV report of files whose extension does not match their contents to file `F`, except for delta hits")
+	auditF          = flag.String("audit", "", "Write a CSV report of denied, executable and hidden files to file `F`")
+	textF           = flag.String("text", "", "Write the plain text of documents as JSON Lines to file `F`")
+	textSize        = flag.Int("text-size", 1<<20, "Write at most `N` bytes of text for each file with -text")
+	mimeMode        = flag.String("mime", mimeExtension, "Detect MIME types by `MODE`: extension or content")
+	symlinks        = flag.String("symlinks", linksFollow, "Symlink policy `P`: skip, follow or within-root")
+	digestColumns   = flag.Bool("digest-columns", false, "Write the -digests to the sys_file columns named like them in SQL mode and with -ofile")
+	timeZone        = flag.String("time-zone", "UTC", "Time zone `TZ` of metadata dates without one, like Europe/Berlin or Local")
+	deltas          deltaFiles // Custom type to catch several files if flag is repeated
+	excludes        patternList
+	includes        patternList
+	mounts          patternList
+	extraDigests    digestList
+	denyPatterns    patternList
+	auditSkip       findingList
+	metaColumns     metaColumnList
 )
 
+var errInterrupted = errors.New("interrupted")
+
 func create(s string) *os.File {
 	f, err := os.Create(s)
 	if err != nil {
@@ -40,8 +82,39 @@ func create(s string) *os.File {
 
 func main() {
 	flag.Var(&deltas, "delta", "Use common mode CSV file `F` for cached values. Flag can be repeated.")
+	flag.Var(&excludes, "exclude", "Do not scan or index paths matching gitignore-style `PATTERN`. Flag can be repeated.")
+	flag.Var(&includes, "include", "Only index files matching gitignore-style `PATTERN`. Flag can be repeated.")
+	flag.Var(&mounts, "mount", "With -xdev, scan mount points matching `PATTERN`. Flag can be repeated.")
+	flag.Var(&extraDigests, "digests", "Also compute the digests in comma separated `LIST` ("+digestNames()+")")
+	flag.Var(&metaColumns, "meta-columns", "Add sys_file_metadata columns filled with metadata, comma separated `LIST` of column=field")
+	flag.Var(&denyPatterns, "deny-pattern", "Audit names matching `REGEXP` instead of TYPO3's default fileDenyPattern. Flag can be repeated.")
+	flag.Var(&auditSkip, "audit-skip", "Do not index files with the audit findings in comma separated `LIST` ("+strings.Join(auditFindings, ", ")+")")
 	flag.Parse()
 
+	// Handle SIGUSR1 from the start, as loading deltas can take long
+	// and the default action would terminate the process.
+	snapshot := notifySnapshot()
+
+	if *resume && (*checkpointF == "" || *outFile == "") {
+		log.Fatal("Resuming needs both the -checkpoint and the -o file of the interrupted run")
+	}
+
+	// Output goes to stdout unless a file is specified.
+	// When resuming, the existing output is appended to.
+	out := os.Stdout
+	if *outFile != "" {
+		if *resume {
+			f, err := os.OpenFile(*outFile, os.O_RDWR, 0)
+			if err != nil {
+				log.Fatal(err)
+			}
+			out = f
+		} else {
+			out = create(*outFile)
+		}
+		defer out.Close()
+	}
+
 	// Enable profiling if requested regardless of the
 	// mode the tool is run in.
 	if *profile != "" {
@@ -49,9 +122,15 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	if *mimeTypesF != "" {
+		if err := mimeTypes.override(*mimeTypesF); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Create a CSV cache file by reading DB tables.
 	if *dumpDB != "" {
-		w := bufio.NewWriter(os.Stdout)
+		w := bufio.NewWriter(out)
 		if err := dumpDatabase(*dumpDB, w); err != nil {
 			log.Fatal("Cannot export from DB: ", err)
 		}
@@ -69,13 +148,45 @@ func main() {
 		log.Fatal("Worker number is not valid: must be between 1 and `-wg N`")
 	}
 
+	if !validErrorPolicy(*onError) {
+		log.Fatal("Error policy must be one of: skip, flag, abort")
+	}
+
+	primary := primaryDigest()
+	for _, name := range extraDigests {
+		if name == primary {
+			log.Fatalf("Digest %s is already computed for the sha1 column", name)
+		}
+	}
+
+	if !validMIMEMode(*mimeMode) {
+		log.Fatal("MIME detection mode must be one of: extension, content")
+	}
+
+	if !validLinkPolicy(*symlinks) {
+		log.Fatal("Symlink policy must be one of: skip, follow, within-root")
+	}
+
+	if zone, err := time.LoadLocation(*timeZone); err != nil {
+		log.Fatal("Invalid time zone: ", err)
+	} else {
+		dateZone = zone
+	}
+
+	// Text files are read at once
+	if *textSize < 1 || *textSize > contentsReadSize {
+		log.Fatalf("Size of the text of files must be between 1 and %d bytes", contentsReadSize)
+	}
+
 	if *multiplier < 1 {
 		*multiplier = 1
 	}
 
-	root := flag.Arg(0)
-	if root != "" {
-		root = filepath.Clean(filepath.ToSlash(root))
+	var roots []string
+	for _, root := range flag.Args() {
+		if root != "" {
+			roots = append(roots, filepath.Clean(filepath.ToSlash(root)))
+		}
 	}
 
 	// Not output UID, but real numbers
@@ -94,10 +205,9 @@ func main() {
 			defer fr.Close()
 			r = fr
 		}
-		pr := newPrefixReader(r)
-		writer := newWriter(os.Stdout, transform, *workerID, *workerN)
+		writer := newWriter(out, transform, *workerID, *workerN)
 		go writer.run()
-		if err := loadCSV(pr, writer); err != nil {
+		if err := loadCSV(r, writer); err != nil {
 			log.Fatal(err)
 		}
 		writer.wait()
@@ -120,8 +230,8 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		sw := splitWriter{prefix, f, uids, *workerID, *workerN}
-		if err := sw.write(os.Stdout); err != nil {
+		sw := splitWriter{prefix, f, uids, *workerID, *workerN, !*digestColumns}
+		if err := sw.write(out); err != nil {
 			log.Fatal(err)
 		}
 		return
@@ -135,38 +245,316 @@ func main() {
 			if err != nil {
 				log.Fatal(err)
 			}
-			if err := delta.load(f); err != nil {
+			records := makeDelta()
+			info, err := records.load(f)
+			f.Close()
+			if err != nil {
 				log.Fatal(err)
 			}
+			if v := info["mime_types"]; v != "" && v != mimeTypes.version {
+				log.Printf("%s: MIME types version %s differs from %s, cached records keep their types", d, v, mimeTypes.version)
+			}
+			// Values would end up in the wrong columns
+			if v := info["meta_columns"]; v != metaColumns.String() {
+				log.Printf("%s: metadata columns %q differ from %q, its records are not used", d, v, metaColumns.String())
+				continue
+			}
+			if v := info["digests"]; v != extraDigests.String() {
+				log.Printf("%s: digests %q differ from %q, its records are not used", d, v, extraDigests.String())
+				continue
+			}
+			delta.merge(records)
 		}
 	}
 
-	if root == "" && !deltas.IsSet() {
+	// Listed files are validated against the current directory
+	// if no storage root is specified.
+	if *fileList != "" && len(roots) == 0 {
+		roots = append(roots, ".")
+	}
+
+	if len(roots) == 0 && !deltas.IsSet() {
 		log.Fatal("You need to specify at least one -delta CSV file")
 	}
 
-	// We don't have a directory to scan, just print
+	// We don't have any directory to scan, just print
 	// out the resulting loaded delta.
-	if root == "" {
-		delta.writeTo(os.Stdout)
+	if len(roots) == 0 {
+		w := bufio.NewWriter(out)
+		if err := delta.writeTo(w); err != nil {
+			log.Fatal("Cannot write: ", err)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal("Cannot write: ", err)
+		}
 		return
 	}
 
-	writer := newWriter(os.Stdout, transform, *workerID, *workerN)
-	go writer.run()
+	if *watchMode && *fileList != "" {
+		log.Fatal("Watch mode cannot be used with a list of files")
+	}
+
+	if *checkpointF != "" && (*watchMode || *fileList != "") {
+		log.Fatal("Checkpoints can only be used when scanning directories")
+	}
+
+	// Records already written are only found in the normal mode output
+	if *checkpointF != "" && (*sqlMode || *singleMode) {
+		log.Fatal("Checkpoints can only be used in normal mode")
+	}
+
+	writer := newWriter(out, transform, *workerID, *workerN)
 
 	// Number of processor workers to process the files
 	nproc := runtime.NumCPU() * *multiplier
 
-	// Start scanning the directory
-	idx := newIndexer(*workerN, *workerID-1)
-	go idx.scan(root, nproc)
+	if *excludeF != "" {
+		if err := excludes.load(*excludeF); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *includeF != "" {
+		if err := includes.load(*includeF); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Start scanning all the directories or reading the list of files
+	idx := newIndexer(*workerN, *workerID-1, *queueMax)
+	idx.filter = newPathFilter(excludes, includes)
+	idx.links = *symlinks
+	idx.xdev = *xdev
+	for _, m := range mounts {
+		idx.mounts = append(idx.mounts, makePattern(m))
+	}
+
+	// All errors go to the same report
+	var ew io.Writer
+	if *errorsFile != "" {
+		f := create(*errorsFile)
+		defer f.Close()
+		ew = f
+	}
+	errs := newErrorReport(ew)
+	idx.errors = errs
+
+	// Audit the files found before they are indexed
+	var audit *auditor
+	if *auditF != "" || len(auditSkip) > 0 || len(denyPatterns) > 0 {
+		var aw io.Writer
+		if *auditF != "" {
+			f := create(*auditF)
+			defer f.Close()
+			aw = f
+		}
+		var err error
+		audit, err = newAuditor(aw, denyPatterns, auditSkip)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Track completed directories to save checkpoints.  When resuming,
+	// the records after the last checkpoint are written again.
+	var (
+		track   *tracker
+		resumed *checkpoint
+	)
+	if *checkpointF != "" {
+		track = newTracker()
+		if *resume {
+			cp, err := loadCheckpoint(*checkpointF)
+			if err != nil {
+				log.Fatal("Cannot resume: ", err)
+			}
+			if strings.Join(cp.Roots, "\x00") != strings.Join(roots, "\x00") {
+				log.Fatalf("Cannot resume: the interrupted run scanned %s", strings.Join(cp.Roots, " "))
+			}
+			if err := cp.checkSettings(); err != nil {
+				log.Fatal("Cannot resume: ", err)
+			}
+			if err := cp.resumeOutput(out, track); err != nil {
+				log.Fatal("Cannot resume: ", err)
+			}
+			writer.uid = cp.UID
+			writer.offset = cp.Offset
+			idx.resume(cp.Pending)
+			resumed = cp
+		}
+		idx.track = track
+	}
+	writer.stats = idx.stats
+	// The version of MIME types makes the output reproducible.
+	// When resuming, the output already starts with it.
+	if !*resume {
+		var buf bytes.Buffer
+		writeHeader(&buf)
+		writer.header(buf.String())
+	}
+	go writer.run()
+
+	// Stop scanning on interrupt or when aborting after an error.
+	// The files already found are still processed, so that the
+	// output is complete.
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		// Another signal terminates immediately
+		signal.Stop(sigs)
+		log.Printf("%s: finishing files in progress", sig)
+		cancel(errInterrupted)
+	}()
+	scanErr := make(chan error, 1)
+
+	// In watch mode all scanned directories are watched, and
+	// changes are processed after the files found by the scan.
+	files := idx.sink()
+	if *watchMode {
+		w, err := newWatcher(idx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		idx.onDir = w.add
+		go w.run(ctx, idx.sink())
+		files = w.sink()
+	}
+
+	if *fileList != "" {
+		var r io.Reader
+		if *fileList == "-" {
+			r = os.Stdin
+		} else {
+			fr, err := os.Open(*fileList)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer fr.Close()
+			r = fr
+		}
+		sep := byte('\n')
+		if *nullSep {
+			sep = 0
+		}
+		go func() {
+			scanErr <- idx.list(ctx, roots, r, sep)
+		}()
+	} else {
+		go func() {
+			scanErr <- idx.scan(ctx, roots, nproc)
+		}()
+	}
 
 	// Start all processors
-	proc := newProcessor(*useMd5, idx.sink(), writer, nproc, delta)
+	proc := newProcessor(*useMd5, extraDigests, files, writer, nproc, delta)
+	proc.ctx = ctx
+	proc.abort = cancel
+	proc.onError = *onError
+	proc.errors = errs
+	proc.track = track
+	proc.stats = idx.stats
+	if *mismatchesF != "" {
+		f := create(*mismatchesF)
+		defer f.Close()
+		proc.mismatches = newMismatchReport(f)
+	}
+	proc.audit = audit
+	if *textF != "" {
+		// Text of the files written before the checkpoint is kept
+		var (
+			f          *os.File
+			textOffset int64
+		)
+		if *resume {
+			var err error
+			if f, err = os.OpenFile(*textF, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+				log.Fatal(err)
+			}
+			if textOffset, err = resumed.resumeText(f, out); err != nil {
+				log.Fatal("Cannot resume: ", err)
+			}
+		} else {
+			f = create(*textF)
+		}
+		defer f.Close()
+		proc.text = newTextWriter(f, *textSize, delta)
+		proc.text.offset = textOffset
+	}
 	proc.run()
 
+	// The number of files of a previous run is the best estimate
+	// of how many files there are, shared among the workers.
+	prog := newProgress(idx.stats, idx, len(delta) / *workerN, os.Stderr)
+	go prog.run(*progressEvery, snapshot)
+
+	if *metricsAddr != "" {
+		m := &metrics{stats: idx.stats, idx: idx, writer: writer, errors: errs}
+		m.listen(*metricsAddr)
+	}
+
+	var cp *checkpointer
+	if track != nil {
+		cp = newCheckpointer(*checkpointF, roots, track, writer, proc.text)
+		go cp.run(*checkpointEvery)
+	}
+
 	// Wait for all processors to finish processing files.
 	// Processors will also wait for writers to finish.
 	proc.wait()
+	prog.finish()
+
+	// The last checkpoint is kept if the output is incomplete.
+	if cp != nil {
+		if err := cp.finish(ctx.Err() != nil || writer.err != nil, writer.err == nil); err != nil {
+			log.Print("Cannot write checkpoint: ", err)
+		}
+	}
+
+	idx.report(os.Stderr)
+	if err := errs.flush(); err != nil {
+		log.Print("Cannot write error report: ", err)
+	}
+	errs.summary(os.Stderr)
+	if err := proc.mismatches.flush(); err != nil {
+		log.Print("Cannot write mismatch report: ", err)
+	}
+	proc.mismatches.summary(os.Stderr)
+	if err := proc.audit.flush(); err != nil {
+		log.Print("Cannot write audit report: ", err)
+	}
+	proc.audit.summary(os.Stderr)
+	if err := proc.text.flush(); err != nil {
+		log.Print("Cannot write text file: ", err)
+	}
+	proc.text.summary(os.Stderr)
+
+	if writer.err != nil {
+		log.Fatal("Output is incomplete: ", writer.err)
+	}
+
+	err := <-scanErr
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+		fmt.Fprintf(os.Stderr, "Records written: %d\n", writer.count)
+		idx.stopped(os.Stderr)
+	}
+	if err := exitError(err, errs.count(), *maxErrors); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Returns the error to exit with after a run that ended with err
+// and where failed files could not be read.
+func exitError(err error, failed, maxErrors int) error {
+	switch {
+	case err == errInterrupted:
+		return err
+	case err != nil:
+		return fmt.Errorf("Scan failed: %w", err)
+	case maxErrors >= 0 && failed > maxErrors:
+		return fmt.Errorf("Too many files could not be read: %d", failed)
+	}
+	return nil
 }
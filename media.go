@@ -0,0 +1,446 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+// Sets the duration, in seconds, and the average bitrate of size bytes
+// of audio or video, in bits per second.
+func setDuration(m metadata, seconds float64, size int64) {
+	if seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return
+	}
+	m.set("duration", formatFloat(seconds, 3))
+	if size > 0 {
+		m.set("bitrate", strconv.FormatInt(int64(math.Round(float64(size)*8/seconds)), 10))
+	}
+}
+
+// Sets the size of a video, in pixels.
+func setSize(m metadata, width, height uint64) {
+	if width == 0 || height == 0 {
+		return
+	}
+	m.set("width", strconv.FormatUint(width, 10))
+	m.set("height", strconv.FormatUint(height, 10))
+}
+
+var errMP4Box = errors.New("MP4: invalid box")
+
+// Calls fn with the type, the offset and the size of the data of each
+// box of an ISO base media file between off and end, until fn returns
+// false.  Only the headers are read.
+func mp4Boxes(c *contents, off, end int64, fn func(typ string, off, n int64) bool) error {
+	for off+8 <= end {
+		h := c.at(off, 8)
+		if h == nil {
+			return errMP4Box
+		}
+		n, typ, hdr := int64(binary.BigEndian.Uint32(h)), string(h[4:]), int64(8)
+		switch n {
+		case 0:
+			// Up to the end of the file
+			n = end - off
+		case 1:
+			h = c.at(off+8, 8)
+			if h == nil {
+				return errMP4Box
+			}
+			n, hdr = int64(binary.BigEndian.Uint64(h)), 16
+		}
+		if n < hdr || n > end-off {
+			return errMP4Box
+		}
+		if !fn(typ, off+hdr, n-hdr) {
+			return nil
+		}
+		off += n
+	}
+	return nil
+}
+
+// Reads at most max bytes of data of a box.
+func boxData(c *contents, off, n, max int64) []byte {
+	if n > max {
+		n = max
+	}
+	return c.at(off, n)
+}
+
+// Movie of MP4 and QuickTime files.
+type mp4Movie struct {
+	c                   *contents
+	timescale, duration uint64
+	// Duration of fragmented files
+	fragments     uint64
+	width, height uint64
+	err           error
+}
+
+func (mv *mp4Movie) keep(err error) {
+	if err != nil && mv.err == nil {
+		mv.err = err
+	}
+}
+
+// Reads the movie header, of the whole movie, and the track header of
+// the first video track.
+func (mv *mp4Movie) moov(off, n int64) bool {
+	mv.keep(mp4Boxes(mv.c, off, off+n, func(typ string, off, n int64) bool {
+		switch typ {
+		case "mvhd":
+			// Times are of 64 bits in version 1
+			b := boxData(mv.c, off, n, 32)
+			switch {
+			case len(b) >= 32 && b[0] == 1:
+				mv.timescale, mv.duration = uint64(binary.BigEndian.Uint32(b[20:])), binary.BigEndian.Uint64(b[24:])
+			case len(b) >= 20 && b[0] == 0:
+				mv.timescale, mv.duration = uint64(binary.BigEndian.Uint32(b[12:])), uint64(binary.BigEndian.Uint32(b[16:]))
+			}
+		case "mvex":
+			mv.keep(mp4Boxes(mv.c, off, off+n, func(typ string, off, n int64) bool {
+				b := boxData(mv.c, off, n, 12)
+				switch {
+				case typ != "mehd":
+				case len(b) >= 12 && b[0] == 1:
+					mv.fragments = binary.BigEndian.Uint64(b[4:])
+				case len(b) >= 8:
+					mv.fragments = uint64(binary.BigEndian.Uint32(b[4:]))
+				}
+				return true
+			}))
+		case "trak":
+			if mv.width == 0 {
+				mv.keep(mp4Boxes(mv.c, off, off+n, mv.tkhd))
+			}
+		}
+		return true
+	}))
+	return false
+}
+
+// Size of the track header, in version 0 and 1.
+const (
+	tkhdSize   = 84
+	tkhdSizeV1 = 96
+)
+
+// Reads the size of a track, zero for audio tracks, at the end of the
+// track header.  It is preceded by the transformation matrix, which
+// rotates by a quarter turn when its first value is zero.
+func (mv *mp4Movie) tkhd(typ string, off, n int64) bool {
+	if typ != "tkhd" {
+		return true
+	}
+	b := boxData(mv.c, off, n, tkhdSizeV1)
+	if len(b) < tkhdSize {
+		return false
+	}
+	if b[0] == 1 && len(b) < tkhdSizeV1 {
+		return false
+	}
+	size := len(b)
+	if b[0] == 0 {
+		size = tkhdSize
+	}
+	matrix := b[size-44:]
+	// Fixed point numbers, 16.16
+	w, h := uint64(binary.BigEndian.Uint32(b[size-8:])>>16), uint64(binary.BigEndian.Uint32(b[size-4:])>>16)
+	if binary.BigEndian.Uint32(matrix) == 0 && binary.BigEndian.Uint32(matrix[4:]) != 0 {
+		w, h = h, w
+	}
+	mv.width, mv.height = w, h
+	return false
+}
+
+// Types of the first box of MP4 and QuickTime files.
+var mp4FirstBoxes = map[string]bool{
+	"ftyp": true, "moov": true, "mdat": true, "free": true,
+	"skip": true, "wide": true, "pnot": true,
+}
+
+// Extracts the duration and the size of the first video track of
+// MP4 and QuickTime files.  The movie box is often at the end.
+func mp4Meta(c *contents, m metadata) error {
+	if h := c.at(4, 4); h == nil || !mp4FirstBoxes[string(h)] {
+		return nil
+	}
+	mv := &mp4Movie{c: c}
+	err := mp4Boxes(c, 0, c.size, func(typ string, off, n int64) bool {
+		if typ == "moov" {
+			return mv.moov(off, n)
+		}
+		return true
+	})
+	mv.keep(err)
+	if mv.timescale > 0 {
+		duration := mv.duration
+		// Unknown or only of the first fragment
+		if duration == 0 || duration == math.MaxUint32 || mv.fragments > duration {
+			duration = mv.fragments
+		}
+		setDuration(m, float64(duration)/float64(mv.timescale), c.size)
+	}
+	setSize(m, mv.width, mv.height)
+	return mv.err
+}
+
+// IDs of the EBML elements of Matroska and WebM files used for metadata
+const (
+	ebmlHeader        = 0x1a45dfa3
+	mkvSegment        = 0x18538067
+	mkvSeekHead       = 0x114d9b74
+	mkvSeek           = 0x4dbb
+	mkvSeekID         = 0x53ab
+	mkvSeekPosition   = 0x53ac
+	mkvInfo           = 0x1549a966
+	mkvTimecodeScale  = 0x2ad7b1
+	mkvDuration       = 0x4489
+	mkvTracks         = 0x1654ae6b
+	mkvTrackEntry     = 0xae
+	mkvTrackType      = 0x83
+	mkvVideo          = 0xe0
+	mkvPixelWidth     = 0xb0
+	mkvPixelHeight    = 0xba
+	mkvCluster        = 0x1f43b675
+	mkvTrackTypeVideo = 1
+)
+
+var errEBML = errors.New("EBML: invalid element")
+
+// Parses the header of an EBML element: its ID, the size of the header
+// and the size of the data, -1 if unknown.
+func ebmlElement(b []byte) (uint32, int, int64, bool) {
+	if len(b) < 2 {
+		return 0, 0, 0, false
+	}
+	// The IDs keep their length marker
+	n := bits.LeadingZeros8(b[0]) + 1
+	if n > 4 || len(b) < n+1 {
+		return 0, 0, 0, false
+	}
+	var id uint32
+	for _, c := range b[:n] {
+		id = id<<8 | uint32(c)
+	}
+	k := bits.LeadingZeros8(b[n]) + 1
+	if k > 8 || len(b) < n+k {
+		return 0, 0, 0, false
+	}
+	size := uint64(b[n] & (0xff >> k))
+	unknown := size == 0xff>>k
+	for _, c := range b[n+1 : n+k] {
+		size = size<<8 | uint64(c)
+		unknown = unknown && c == 0xff
+	}
+	if unknown {
+		return id, n + k, -1, true
+	}
+	if size > math.MaxInt64 {
+		return 0, 0, 0, false
+	}
+	return id, n + k, int64(size), true
+}
+
+// Calls fn with the ID and data of each element in b, until fn
+// returns false.
+func ebmlElements(b []byte, fn func(id uint32, data []byte) bool) error {
+	for len(b) > 0 {
+		id, hdr, n, ok := ebmlElement(b)
+		if !ok || n < 0 || n > int64(len(b)-hdr) {
+			return errEBML
+		}
+		if !fn(id, b[hdr:hdr+int(n)]) {
+			return nil
+		}
+		b = b[hdr+int(n):]
+	}
+	return nil
+}
+
+// Calls fn with the ID, the offset and the size of the data of each
+// element between off and end, until fn returns false.  Only the
+// headers are read; elements of unknown size extend to end.
+func ebmlChildren(c *contents, off, end int64, fn func(id uint32, off, n int64) bool) error {
+	for off < end {
+		h := boxData(c, off, end-off, 12)
+		if h == nil {
+			return errEBML
+		}
+		id, hdr, n, ok := ebmlElement(h)
+		if !ok || n > end-off-int64(hdr) {
+			return errEBML
+		}
+		if n < 0 {
+			n = end - off - int64(hdr)
+		}
+		if !fn(id, off+int64(hdr), n) {
+			return nil
+		}
+		off += int64(hdr) + n
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// Maximum size of the segment information and of the tracks.
+const mkvElementSize = 1 << 20
+
+// Segment of Matroska and WebM files.
+type mkvSegmentInfo struct {
+	scale    uint64
+	duration float64
+	width    uint64
+	height   uint64
+	// Elements already read
+	info, tracks bool
+}
+
+func (s *mkvSegmentInfo) read(c *contents, id uint32, off, n int64) error {
+	b := boxData(c, off, n, mkvElementSize)
+	if b == nil {
+		return errEBML
+	}
+	switch id {
+	case mkvInfo:
+		s.info = true
+		return ebmlElements(b, func(id uint32, data []byte) bool {
+			switch id {
+			case mkvTimecodeScale:
+				s.scale = ebmlUint(data)
+			case mkvDuration:
+				s.duration = ebmlFloat(data)
+			}
+			return true
+		})
+	case mkvTracks:
+		s.tracks = true
+		return ebmlElements(b, func(id uint32, data []byte) bool {
+			if id != mkvTrackEntry || s.width != 0 {
+				return true
+			}
+			var video []byte
+			var typ uint64
+			ebmlElements(data, func(id uint32, data []byte) bool {
+				switch id {
+				case mkvTrackType:
+					typ = ebmlUint(data)
+				case mkvVideo:
+					video = data
+				}
+				return true
+			})
+			if typ != mkvTrackTypeVideo {
+				return true
+			}
+			ebmlElements(video, func(id uint32, data []byte) bool {
+				switch id {
+				case mkvPixelWidth:
+					s.width = ebmlUint(data)
+				case mkvPixelHeight:
+					s.height = ebmlUint(data)
+				}
+				return true
+			})
+			return true
+		})
+	}
+	return nil
+}
+
+// Extracts the duration and the size of the first video track of
+// Matroska and WebM files, from the elements before the first cluster
+// or from those the seek head points to.
+func matroskaMeta(c *contents, m metadata) error {
+	b := boxData(c, 0, c.size, 12)
+	id, hdr, n, ok := ebmlElement(b)
+	if !ok || id != ebmlHeader || n < 0 {
+		return nil
+	}
+	start := int64(hdr) + n
+	b = boxData(c, start, c.size-start, 12)
+	if id, hdr, _, ok = ebmlElement(b); !ok || id != mkvSegment {
+		return errEBML
+	}
+	// Positions in the seek head are relative to the segment data
+	segment := start + int64(hdr)
+	s := &mkvSegmentInfo{scale: 1000000}
+	seek := make(map[uint32]int64)
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	keep(ebmlChildren(c, segment, c.size, func(id uint32, off, n int64) bool {
+		switch id {
+		case mkvSeekHead:
+			b := boxData(c, off, n, mkvElementSize)
+			ebmlElements(b, func(id uint32, data []byte) bool {
+				if id != mkvSeek {
+					return true
+				}
+				var seekID uint32
+				var pos int64 = -1
+				ebmlElements(data, func(id uint32, data []byte) bool {
+					switch id {
+					case mkvSeekID:
+						seekID = uint32(ebmlUint(data))
+					case mkvSeekPosition:
+						pos = int64(ebmlUint(data))
+					}
+					return true
+				})
+				if pos >= 0 {
+					seek[seekID] = segment + pos
+				}
+				return true
+			})
+		case mkvInfo, mkvTracks:
+			keep(s.read(c, id, off, n))
+		case mkvCluster:
+			return false
+		}
+		return true
+	}))
+	for _, id := range []uint32{mkvInfo, mkvTracks} {
+		pos, ok := seek[id]
+		if !ok || (id == mkvInfo && s.info) || (id == mkvTracks && s.tracks) {
+			continue
+		}
+		keep(ebmlChildren(c, pos, c.size, func(found uint32, off, n int64) bool {
+			if found == id {
+				keep(s.read(c, id, off, n))
+			}
+			return false
+		}))
+	}
+	setDuration(m, s.duration*float64(s.scale)/1e9, c.size)
+	setSize(m, s.width, s.height)
+	return first
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func testMedia(t *testing.T, fn extractor, data []byte, expect metadata) {
+	t.Helper()
+	m := make(metadata)
+	if err := fn(&contents{head: data, tail: data, size: int64(len(data))}, m); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range expect {
+		if m[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, m[k])
+		}
+	}
+}
+
+func box(typ string, data ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 0)
+	b = append(b, typ...)
+	for _, d := range data {
+		b = append(b, d...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func tkhd(width, height uint32, rotated bool) []byte {
+	b := make([]byte, tkhdSize)
+	if rotated {
+		binary.BigEndian.PutUint32(b[44:], 1<<16)
+	} else {
+		binary.BigEndian.PutUint32(b[40:], 1<<16)
+	}
+	binary.BigEndian.PutUint32(b[76:], width<<16)
+	binary.BigEndian.PutUint32(b[80:], height<<16)
+	return box("tkhd", b)
+}
+
+func TestMP4(t *testing.T) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 12500)
+	data := bytes.Join([][]byte{
+		box("ftyp", []byte("isom\x00\x00\x02\x00")),
+		box("mdat", make([]byte, 1000)),
+		box("moov", box("mvhd", mvhd),
+			box("trak", tkhd(0, 0, false)),
+			box("trak", tkhd(1920, 1080, true))),
+	}, nil)
+	testMedia(t, mp4Meta, data, metadata{
+		"duration": "12.5",
+		"bitrate":  "858",
+		"width":    "1080",
+		"height":   "1920",
+	})
+}
+
+func ebml(id uint32, data ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, id)
+	for b[0] == 0 {
+		b = b[1:]
+	}
+	var n int
+	for _, d := range data {
+		n += len(d)
+	}
+	// Sizes of 8 bytes
+	b = append(b, 1)
+	b = append(b, binary.BigEndian.AppendUint64(nil, uint64(n))[1:]...)
+	for _, d := range data {
+		b = append(b, d...)
+	}
+	return b
+}
+
+func TestMatroska(t *testing.T) {
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(5000))
+	data := bytes.Join([][]byte{
+		ebml(ebmlHeader, ebml(0x4282, []byte("webm"))),
+		// Segment of unknown size
+		{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		ebml(mkvInfo, ebml(mkvTimecodeScale, []byte{0x0f, 0x42, 0x40}), ebml(mkvDuration, duration)),
+		ebml(mkvTracks,
+			ebml(mkvTrackEntry, ebml(mkvTrackType, []byte{2})),
+			ebml(mkvTrackEntry, ebml(mkvTrackType, []byte{1}),
+				ebml(mkvVideo, ebml(mkvPixelWidth, []byte{0x02, 0x80}), ebml(mkvPixelHeight, []byte{0x01, 0xe0})))),
+		ebml(mkvCluster, make([]byte, 100)),
+	}, nil)
+	testMedia(t, matroskaMeta, data, metadata{
+		"duration": "5",
+		"width":    "640",
+		"height":   "480",
+	})
+}
+
+// MPEG-1 layer III frame at 128kbit/s and 44.1kHz, of 417 bytes.
+func mpegFrameData(xing uint32) []byte {
+	b := make([]byte, 417)
+	copy(b, "\xff\xfb\x90\x00")
+	if xing > 0 {
+		copy(b[36:], "Xing\x00\x00\x00\x01")
+		binary.BigEndian.PutUint32(b[44:], xing)
+	}
+	return b
+}
+
+func id3Frame(id, data string) []byte {
+	b := append([]byte(id), 0, 0, 0, byte(len(data)), 0, 0)
+	return append(b, data...)
+}
+
+func TestMP3(t *testing.T) {
+	frames := bytes.Repeat(mpegFrameData(0), 100)
+	// Title in Latin-1 and artist in UTF-16
+	tag := append(id3Frame("TIT2", "\x00Caf\xe9"), id3Frame("TPE1", "\x01\xff\xfeA\x00n\x00a\x00")...)
+	id3 := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, byte(len(tag))}
+	data := bytes.Join([][]byte{id3, tag, frames}, nil)
+	testMedia(t, mp3Meta, data, metadata{
+		"title":    "Café",
+		"creator":  "Ana",
+		"duration": "2.606",
+		"bitrate":  "128000",
+	})
+	// Variable bitrate, the duration is in the Xing header
+	data = append(mpegFrameData(1000), frames...)
+	testMedia(t, mp3Meta, data, metadata{
+		"duration": "26.122",
+		"bitrate":  "12898",
+	})
+}
+
+func oggPageData(flags byte, granule uint64, packet []byte) []byte {
+	b := []byte("OggS\x00")
+	b = append(b, flags)
+	b = binary.LittleEndian.AppendUint64(b, granule)
+	b = append(b, make([]byte, 12)...)
+	b = append(b, 1, byte(len(packet)))
+	return append(b, packet...)
+}
+
+func TestOgg(t *testing.T) {
+	vorbis := make([]byte, 30)
+	copy(vorbis, "\x01vorbis")
+	binary.LittleEndian.PutUint32(vorbis[12:], 44100)
+	data := bytes.Join([][]byte{
+		oggPageData(2, 0, vorbis),
+		oggPageData(0, 44100, make([]byte, 100)),
+		oggPageData(4, 441000, make([]byte, 100)),
+	}, nil)
+	testMedia(t, oggMeta, data, metadata{"duration": "10"})
+}
+
+func TestFLAC(t *testing.T) {
+	info := make([]byte, 34)
+	// 44.1kHz, 88200 samples
+	copy(info[10:], []byte{0x0a, 0xc4, 0x42, 0xf0, 0x00, 0x01, 0x58, 0x88})
+	data := append([]byte("fLaC\x80\x00\x00\x22"), info...)
+	testMedia(t, flacMeta, data, metadata{"duration": "2"})
+}
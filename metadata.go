@@ -0,0 +1,309 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Time zone of dates in metadata without one, set with -time-zone.
+// UTC by default, so that records do not depend on the host.
+var dateZone = time.UTC
+
+// Metadata extracted from the contents of a file, by field name.
+type metadata map[string]string
+
+// Sets field name to value, unless the field is already set: the
+// first format that has a value wins.  Empty values are ignored.
+func (m metadata) set(name, value string) {
+	if _, ok := m[name]; ok {
+		return
+	}
+	if value = cleanText(value); value != "" {
+		m[name] = value
+	}
+}
+
+// Makes text from files safe to output: invalid UTF-8 is taken as
+// Latin-1, like older cameras write it, and control characters other
+// than newlines and tabs are removed.
+func cleanText(s string) string {
+	if !utf8.ValidString(s) {
+		r := make([]rune, len(s))
+		for i := 0; i < len(s); i++ {
+			r[i] = rune(s[i])
+		}
+		s = string(r)
+	}
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// Fields that can be extracted from the contents of files.
+var metaFieldNames = map[string]bool{
+	// Columns of sys_file_metadata that are always written
+	"title":       true,
+	"description": true,
+	"alternative": true,
+	// Comma separated
+	"keywords": true,
+	// Unix time when the contents were created or last modified
+	"content_creation_date":     true,
+	"content_modification_date": true,
+	// Program that created the file
+	"creator_tool": true,
+	"creator":      true,
+	"copyright":    true,
+	// Color space as in TYPO3: RGB, sRGB, CMYK, grey or indx
+	"color_space": true,
+	// Decimal degrees, negative south and west, altitude in meters
+	"latitude":  true,
+	"longitude": true,
+	"altitude":  true,
+	// Photos
+	"camera_make":   true,
+	"camera_model":  true,
+	"lens_model":    true,
+	"exposure_time": true,
+	"f_number":      true,
+	"iso_speed":     true,
+	"focal_length":  true,
+	// EXIF orientation, 1 to 8
+	"orientation": true,
+	// Documents
+	"pages":      true,
+	"word_count": true,
+	// Audio and video, in seconds and bits per second
+	"duration": true,
+	"bitrate":  true,
+}
+
+func metaFieldList() string {
+	names := make([]string, 0, len(metaFieldNames))
+	for name := range metaFieldNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Columns of sys_file_metadata filled by the filemetadata preset.
+// Their names are the ones of the extension of the same name.
+var filemetadataColumns = []string{
+	"content_creation_date", "content_modification_date", "creator_tool",
+	"creator", "copyright", "color_space", "latitude", "longitude", "keywords",
+	"pages", "duration",
+}
+
+// Columns of sys_file_metadata with metadata that are always written.
+var builtinColumns = []string{"title", "description", "alternative"}
+
+// Column of sys_file_metadata and the field it is filled with.
+type metaColumn struct {
+	column, field string
+}
+
+// Additional columns of sys_file_metadata, as a comma separated flag
+// value of "column=field", "field" for a column with the same name, or
+// "filemetadata" for the columns of that extension.
+type metaColumnList []metaColumn
+
+func (l *metaColumnList) String() string {
+	s := make([]string, len(*l))
+	for i, c := range *l {
+		s[i] = c.column
+		if c.field != c.column {
+			s[i] += "=" + c.field
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *metaColumnList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "filemetadata" {
+			for _, name := range filemetadataColumns {
+				if err := l.add(name, name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		column, field, ok := strings.Cut(item, "=")
+		if !ok {
+			field = column
+		}
+		if err := l.add(strings.TrimSpace(column), strings.TrimSpace(field)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *metaColumnList) add(column, field string) error {
+	if !metaFieldNames[field] {
+		return fmt.Errorf("unknown field %q, valid ones are %s", field, metaFieldList())
+	}
+	// Column names are written as they are in SQL statements
+	if !validColumn(column) {
+		return fmt.Errorf("invalid column name %q", column)
+	}
+	for _, c := range append(builtinColumns, "width", "height") {
+		if column == c {
+			return fmt.Errorf("column %s is always written", column)
+		}
+	}
+	for _, c := range *l {
+		if c.column == column {
+			return fmt.Errorf("column %s listed twice", column)
+		}
+	}
+	*l = append(*l, metaColumn{column, field})
+	return nil
+}
+
+func validColumn(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Extracts metadata from the contents of a file.
+type extractor func(c *contents, m metadata) error
+
+// Extractors for each MIME type, in order of precedence.
+var extractors = map[string][]extractor{
+	"image/jpeg":      {jpegMeta},
+	"image/tiff":      {tiffMeta},
+	"image/png":       {pngMeta},
+	"image/svg+xml":   {svgMeta},
+	"application/pdf": {pdfMeta},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {ooxmlMeta},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.template":   {ooxmlMeta},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {ooxmlMeta},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.template":      {ooxmlMeta},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {ooxmlMeta},
+	"application/vnd.openxmlformats-officedocument.presentationml.slideshow":    {ooxmlMeta},
+	"application/vnd.openxmlformats-officedocument.presentationml.template":     {ooxmlMeta},
+	"application/vnd.oasis.opendocument.text":                                   {odfMeta},
+	"application/vnd.oasis.opendocument.text-template":                          {odfMeta},
+	"application/vnd.oasis.opendocument.spreadsheet":                            {odfMeta},
+	"application/vnd.oasis.opendocument.spreadsheet-template":                   {odfMeta},
+	"application/vnd.oasis.opendocument.presentation":                           {odfMeta},
+	"application/vnd.oasis.opendocument.presentation-template":                  {odfMeta},
+	"application/vnd.oasis.opendocument.graphics":                               {odfMeta},
+	"application/vnd.oasis.opendocument.formula":                                {odfMeta},
+	"video/mp4":        {mp4Meta},
+	"video/quicktime":  {mp4Meta},
+	"video/3gpp":       {mp4Meta},
+	"video/3gpp2":      {mp4Meta},
+	"audio/x-m4a":      {mp4Meta},
+	"video/webm":       {matroskaMeta},
+	"video/x-matroska": {matroskaMeta},
+	"audio/mpeg":       {mp3Meta},
+	"audio/x-wav":      {wavMeta},
+	"audio/flac":       {flacMeta},
+	"audio/ogg":        {oggMeta},
+	"video/ogg":        {oggMeta},
+}
+
+// Extracts the metadata of the file from its contents.
+func (p *props) extract(c *contents) error {
+	fns := extractors[p.mime]
+	if len(fns) == 0 {
+		return nil
+	}
+	if p.meta == nil {
+		p.meta = make(metadata)
+	}
+	var first error
+	for _, fn := range fns {
+		if err := fn(c, p.meta); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Returns the size set by extractors of formats that the image
+// package does not decode, in the "width" and "height" fields.
+func (m metadata) size() (image.Point, bool) {
+	w, err := strconv.Atoi(m["width"])
+	if err != nil || w <= 0 {
+		return image.Point{}, false
+	}
+	h, err := strconv.Atoi(m["height"])
+	if err != nil || h <= 0 {
+		return image.Point{}, false
+	}
+	return image.Point{w, h}, true
+}
+
+// Color space of an image, as in TYPO3.
+func colorSpace(m color.Model) string {
+	switch m {
+	case color.GrayModel, color.Gray16Model:
+		return "grey"
+	case color.CMYKModel:
+		return "CMYK"
+	}
+	if _, ok := m.(color.Palette); ok {
+		return "indx"
+	}
+	return "RGB"
+}
+
+// Metadata columns as quoted CSV fields, each preceded by a comma.
+func (p *props) metaValues() string {
+	var b strings.Builder
+	for _, c := range metaColumns {
+		b.WriteString(`,"`)
+		b.WriteString(escape(p.meta[c.field]))
+		b.WriteString(`"`)
+	}
+	return b.String()
+}
+
+// Metadata columns with a value and their values for SQL statements,
+// each preceded by a comma.  Columns without a value keep the default
+// of the table.
+func (p *props) metaSQL() (string, string) {
+	var cols, vals strings.Builder
+	for _, c := range builtinColumns {
+		if v, ok := p.meta[c]; ok {
+			fmt.Fprintf(&cols, ", %s", c)
+			fmt.Fprintf(&vals, `,"%s"`, escape(v))
+		}
+	}
+	for _, c := range metaColumns {
+		v, ok := p.meta[c.field]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&cols, ", %s", c.column)
+		fmt.Fprintf(&vals, `,"%s"`, escape(v))
+	}
+	return cols.String(), vals.String()
+}
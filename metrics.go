@@ -0,0 +1,183 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stage of the scan where entries are stat'ed, only counted in metrics.
+const stageStat = "stat"
+
+// Stages with file and byte counters, in the order they happen.
+var statStages = []string{stageStat, stageOpen, stageSniff, stageHash, stageImage, stageMeta, stageText}
+
+// Upper bounds in seconds of the buckets of per-file latency.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+// Counters updated while scanning and processing.
+type stats struct {
+	// Files found by the scan
+	found atomic.Int64
+	// Files whose processing is finished
+	processed atomic.Int64
+	// Files whose delta entry was used or not
+	hits, misses atomic.Int64
+	// Records written to the output
+	written atomic.Int64
+	// Files and bytes that went through each stage.  The
+	// map is never changed after creation.
+	stages map[string]*stageStats
+	// Time to process a file
+	latency histogram
+}
+
+type stageStats struct {
+	files atomic.Int64
+	bytes atomic.Int64
+}
+
+func newStats() *stats {
+	s := &stats{
+		stages:  make(map[string]*stageStats),
+		latency: histogram{counts: make([]atomic.Int64, len(latencyBuckets))},
+	}
+	for _, name := range statStages {
+		s.stages[name] = &stageStats{}
+	}
+	return s
+}
+
+func (s *stats) stage(name string) *stageStats {
+	return s.stages[name]
+}
+
+func (s *stageStats) add(bytes int64) {
+	s.files.Add(1)
+	s.bytes.Add(bytes)
+}
+
+// Histogram of durations, cumulated when written.
+type histogram struct {
+	// Observations below each bucket's bound, not cumulated
+	counts []atomic.Int64
+	count  atomic.Int64
+	// Sum of all observations in nanoseconds
+	sum atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if secs <= bound {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Serves the metrics of a run in Prometheus text format.
+type metrics struct {
+	stats  *stats
+	idx    *indexer
+	writer *writer
+	errors *errorReport
+}
+
+// Starts serving the metrics on addr in the background.
+func (m *metrics) listen(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Print("Metrics: ", err)
+		}
+	}()
+}
+
+func (m *metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w := bufio.NewWriter(rw)
+	m.writeTo(w)
+	w.Flush()
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	s := m.stats
+	metric(w, "files_found_total", "counter", "Files found by the scan.", s.found.Load())
+	metric(w, "files_processed_total", "counter", "Files completely processed.", s.processed.Load())
+	metric(w, "records_written_total", "counter", "Records written to the output.", s.written.Load())
+	metric(w, "delta_hits_total", "counter", "Files whose record was taken from the delta.", s.hits.Load())
+	metric(w, "delta_misses_total", "counter", "Files not found unchanged in the delta.", s.misses.Load())
+	hits, misses := s.hits.Load(), s.misses.Load()
+	var ratio float64
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	metric(w, "delta_hit_ratio", "gauge", "Ratio of files whose record was taken from the delta.", ratio)
+
+	header(w, "stage_files_total", "counter", "Files that went through each stage.")
+	for _, name := range statStages {
+		fmt.Fprintf(w, "sys_file_indexer_stage_files_total{stage=\"%s\"} %d\n", labelValue(name), s.stage(name).files.Load())
+	}
+	header(w, "stage_bytes_total", "counter", "Bytes read in each stage.")
+	for _, name := range statStages {
+		fmt.Fprintf(w, "sys_file_indexer_stage_bytes_total{stage=\"%s\"} %d\n", labelValue(name), s.stage(name).bytes.Load())
+	}
+	header(w, "errors_total", "counter", "Errors in each stage.")
+	counts := m.errors.stageCounts()
+	stages := make([]string, 0, len(counts))
+	for stage := range counts {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		fmt.Fprintf(w, "sys_file_indexer_errors_total{stage=\"%s\"} %d\n", labelValue(stage), counts[stage])
+	}
+
+	header(w, "file_duration_seconds", "histogram", "Time to process one file.")
+	var cum int64
+	for i, bound := range latencyBuckets {
+		cum += s.latency.counts[i].Load()
+		fmt.Fprintf(w, "sys_file_indexer_file_duration_seconds_bucket{le=%q} %d\n",
+			strconv.FormatFloat(bound, 'g', -1, 64), cum)
+	}
+	count := s.latency.count.Load()
+	fmt.Fprintf(w, "sys_file_indexer_file_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "sys_file_indexer_file_duration_seconds_sum %g\n", time.Duration(s.latency.sum.Load()).Seconds())
+	fmt.Fprintf(w, "sys_file_indexer_file_duration_seconds_count %d\n", count)
+
+	metric(w, "dirs_pending", "gauge", "Directories waiting to be scanned.", m.idx.pending())
+	metric(w, "scan_workers_active", "gauge", "Workers scanning a directory.", m.idx.scanning())
+	metric(w, "writer_backlog", "gauge", "Records waiting to be written.", m.writer.backlog())
+}
+
+// Escapes label values like the text format expects, which
+// differs from Go quoting for other control characters.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP sys_file_indexer_%s %s\n# TYPE sys_file_indexer_%s %s\n", name, help, name, typ)
+}
+
+func metric(w io.Writer, name, typ, help string, v interface{}) {
+	header(w, name, typ, help)
+	fmt.Fprintf(w, "sys_file_indexer_%s %v\n", name, v)
+}
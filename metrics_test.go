@@ -0,0 +1,105 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHTTP(t *testing.T) {
+	s := newStats()
+	s.found.Add(3)
+	s.hits.Add(1)
+	s.misses.Add(3)
+	s.stage(stageHash).add(100)
+	s.latency.observe(2 * time.Millisecond)
+	errs := newErrorReport(nil)
+	errs.add(newFileError("a.jpg", stageImage, "decode", errors.New("bad")))
+	// Not a real stage: label values are escaped like the text format
+	// expects, a tab is written as is
+	errs.add(newFileError("b.jpg", "a\"b\\c\nd\te", "read", errors.New("bad")))
+	m := &metrics{stats: s, idx: newIndexer(1, 0, 10), writer: newWriter(io.Discard, false, 1, 1), errors: errs}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	types := make(map[string]string)
+	samples := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("invalid sample %q", line)
+		}
+		samples[line[:i]] = line[i+1:]
+		name := line[:i]
+		if j := strings.IndexByte(name, '{'); j >= 0 {
+			name = name[:j]
+		}
+		family := name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if f := strings.TrimSuffix(name, suffix); types[f] == "histogram" {
+				family = f
+			}
+		}
+		if types[family] == "" {
+			t.Errorf("sample %s without type", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expectedTypes := map[string]string{
+		"sys_file_indexer_files_found_total":     "counter",
+		"sys_file_indexer_delta_hit_ratio":       "gauge",
+		"sys_file_indexer_stage_bytes_total":     "counter",
+		"sys_file_indexer_errors_total":          "counter",
+		"sys_file_indexer_file_duration_seconds": "histogram",
+		"sys_file_indexer_dirs_pending":          "gauge",
+		"sys_file_indexer_writer_backlog":        "gauge",
+	}
+	for name, typ := range expectedTypes {
+		if types[name] != typ {
+			t.Errorf("%s: expected type %s got %q", name, typ, types[name])
+		}
+	}
+	expectedSamples := map[string]string{
+		"sys_file_indexer_files_found_total":                          "3",
+		"sys_file_indexer_delta_hit_ratio":                            "0.25",
+		`sys_file_indexer_stage_bytes_total{stage="hash"}`:            "100",
+		`sys_file_indexer_errors_total{stage="image"}`:                "1",
+		"sys_file_indexer_errors_total{stage=\"a\\\"b\\\\c\\nd\te\"}": "1",
+		`sys_file_indexer_file_duration_seconds_bucket{le="+Inf"}`:    "1",
+		"sys_file_indexer_file_duration_seconds_count":                "1",
+		"sys_file_indexer_file_duration_seconds_sum":                  "0.002",
+	}
+	for sample, v := range expectedSamples {
+		if samples[sample] != v {
+			t.Errorf("%s: expected %s got %q", sample, v, samples[sample])
+		}
+	}
+}
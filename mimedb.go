@@ -0,0 +1,95 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+//go:embed mime.types
+var embeddedMIMETypes []byte
+
+// Table of MIME types by extension.  The same table gives the
+// same results on every host.
+type mimeTable struct {
+	version string
+	types   map[string]string
+}
+
+// Table used to guess MIME types by extension.
+var mimeTypes = mustParseMIMETypes(embeddedMIMETypes)
+
+func mustParseMIMETypes(data []byte) *mimeTable {
+	t, err := parseMIMETypes(bytes.NewReader(data))
+	if err != nil {
+		panic("embedded mime.types: " + err.Error())
+	}
+	return t
+}
+
+// Parses a table in the format of mime.types, with a version line.
+func parseMIMETypes(r io.Reader) (*mimeTable, error) {
+	t := &mimeTable{types: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "version" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: version must be one word", n)
+			}
+			t.version = fields[1]
+			continue
+		}
+		if !strings.Contains(fields[0], "/") {
+			return nil, fmt.Errorf("line %d: invalid MIME type %s", n, fields[0])
+		}
+		for _, ext := range fields[1:] {
+			t.types[strings.ToLower(strings.TrimPrefix(ext, "."))] = fields[0]
+		}
+	}
+	return t, scanner.Err()
+}
+
+// Overrides the types in t with the ones in file name.  The version
+// of t then also identifies the overrides: their own version, or a
+// digest of the file if they have none.
+func (t *mimeTable) override(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	o, err := parseMIMETypes(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	for ext, mime := range o.types {
+		t.types[ext] = mime
+	}
+	if o.version == "" {
+		o.version = fmt.Sprintf("sha1-%x", sha1.Sum(data))[:13]
+	}
+	t.version += "+" + o.version
+	return nil
+}
+
+// Returns the MIME type for an extension without dot, or an
+// empty string if it is not known.
+func (t *mimeTable) lookup(ext string) string {
+	return t.types[strings.ToLower(ext)]
+}
@@ -0,0 +1,43 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedMIMETypes(t *testing.T) {
+	if mimeTypes.version == "" {
+		t.Error("embedded MIME types have no version")
+	}
+	var equivs = []struct {
+		ext  string
+		mime string
+	}{
+		{"xlsm", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"JPG", "image/jpeg"},
+		{"htaccess", "text/plain"},
+		{"unknown", ""},
+	}
+	for _, e := range equivs {
+		if mime := mimeTypes.lookup(e.ext); mime != e.mime {
+			t.Errorf("%s: expected %q got %q", e.ext, e.mime, mime)
+		}
+	}
+}
+
+func TestParseMIMETypes(t *testing.T) {
+	table, err := parseMIMETypes(strings.NewReader("# comment\nversion 3\ntext/x-a a .B # c\ntext/x-b b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.version != "3" || table.lookup("a") != "text/x-a" || table.lookup("b") != "text/x-b" {
+		t.Errorf("unexpected table: %+v", table)
+	}
+	if _, err := parseMIMETypes(strings.NewReader("nonsense a b\n")); err == nil {
+		t.Error("expected an error for an invalid type")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Severities of a file whose extension does not match its contents
+const (
+	// Script or executable with the extension of something else
+	severityCritical = "critical"
+	// Markup that browsers run scripts from, with the extension of
+	// media or documents
+	severityHigh = "high"
+	// Completely different kind of contents
+	severityMedium = "medium"
+	// Different format of the same media, like a PNG named .jpg
+	severityLow = "low"
+)
+
+var severities = []string{severityCritical, severityHigh, severityMedium, severityLow}
+
+// Contents that can run code when executed or included.
+var activeMIME = map[string]bool{
+	"text/x-php":                   true,
+	"text/x-shellscript":           true,
+	"text/x-sh":                    true,
+	"text/x-script.python":         true,
+	"text/x-python":                true,
+	"text/x-perl":                  true,
+	"text/x-ruby":                  true,
+	"application/javascript":       true,
+	"text/javascript":              true,
+	"application/x-dosexec":        true,
+	"application/x-executable":     true,
+	"application/x-sharedlib":      true,
+	"application/x-pie-executable": true,
+}
+
+// Contents detected as a generic container, and the types
+// of the extensions that are based on them.
+var containerMIME = map[string]func(ext string) bool{
+	"application/zip": func(ext string) bool {
+		return strings.HasPrefix(ext, "application/vnd.openxmlformats-officedocument.") ||
+			strings.HasPrefix(ext, "application/vnd.oasis.opendocument.") ||
+			ext == "application/epub+zip" || ext == "application/java-archive" ||
+			ext == "application/vnd.android.package-archive"
+	},
+	"application/vnd.ms-office": func(ext string) bool {
+		return strings.HasPrefix(ext, "application/vnd.ms-") ||
+			ext == "application/msword" || ext == "application/vnd.visio"
+	},
+	"text/plain": isTextMIME,
+	"text/xml": func(ext string) bool {
+		return strings.HasSuffix(ext, "xml") || ext == "application/x-freemind" || ext == "text/html"
+	},
+	"font/sfnt": func(ext string) bool {
+		return ext == "font/ttf" || ext == "font/otf"
+	},
+	"image/tiff": func(ext string) bool {
+		// Raw formats of cameras
+		return ext == "image/x-canon-cr2" || ext == "image/x-nikon-nef" || ext == "image/x-adobe-dng"
+	},
+	"image/heif":      func(ext string) bool { return ext == "image/heic" },
+	"image/heic":      func(ext string) bool { return ext == "image/heif" },
+	"video/mp4":       func(ext string) bool { return ext == "audio/x-m4a" || ext == "audio/aac" },
+	"audio/ogg":       func(ext string) bool { return ext == "video/ogg" },
+	"video/ogg":       func(ext string) bool { return ext == "audio/ogg" },
+	"application/pdf": func(ext string) bool { return ext == "application/postscript" },
+}
+
+func isTextMIME(m string) bool {
+	if strings.HasPrefix(m, "text/") {
+		return true
+	}
+	switch m {
+	case "application/json", "application/ld+json", "application/xml", "application/rss+xml",
+		"application/atom+xml", "application/x-yaml", "image/svg+xml", "message/rfc822":
+		return true
+	}
+	return false
+}
+
+func topType(m string) string {
+	if i := strings.IndexByte(m, '/'); i >= 0 {
+		return m[:i]
+	}
+	return m
+}
+
+// Compares the MIME type of the extension with the one of the contents.
+// Returns an empty severity if they match or either is not known.
+func mismatchSeverity(ext, content string) string {
+	if ext == "" || content == "" || ext == content || ext == "application/octet-stream" {
+		return ""
+	}
+	if activeMIME[content] {
+		// Scripts named after their language or another one
+		if activeMIME[ext] || (content == "text/x-php" && ext == "text/html") {
+			return ""
+		}
+		return severityCritical
+	}
+	// Both ways, a .zip can contain an OpenDocument or the
+	// other way around
+	if compatible := containerMIME[content]; compatible != nil && compatible(ext) {
+		return ""
+	}
+	if compatible := containerMIME[ext]; compatible != nil && compatible(content) {
+		return ""
+	}
+	if content == "text/html" || content == "image/svg+xml" {
+		switch topType(ext) {
+		case "image", "audio", "video", "font":
+			return severityHigh
+		}
+		if ext == "application/pdf" {
+			return severityHigh
+		}
+	}
+	// Applications are all different kinds of contents
+	if top := topType(ext); top == topType(content) && top != "application" {
+		return severityLow
+	}
+	return severityMedium
+}
+
+// Collects files whose extension does not match their contents,
+// writing them as CSV.
+type mismatchReport struct {
+	mu     sync.Mutex
+	w      *csv.Writer
+	counts map[string]int
+}
+
+func newMismatchReport(w io.Writer) *mismatchReport {
+	r := &mismatchReport{
+		w:      csv.NewWriter(w),
+		counts: make(map[string]int),
+	}
+	r.w.Write([]string{"path", "extension", "extension_mime", "content_mime", "severity"})
+	return r
+}
+
+// Checks the file name with extension ext, whose contents start with head.
+func (r *mismatchReport) check(name, ext string, head []byte) {
+	if r == nil || len(head) == 0 {
+		return
+	}
+	extMIME, content := guessMIME(ext), detectMIME(head)
+	severity := mismatchSeverity(extMIME, content)
+	if severity == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[severity]++
+	r.w.Write([]string{name, ext, extMIME, content, severity})
+}
+
+func (r *mismatchReport) flush() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// Writes the number of mismatching files for each severity.
+func (r *mismatchReport) summary(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range severities {
+		if r.counts[s] > 0 {
+			fmt.Fprintf(w, "Files not matching their extension, %s: %d\n", s, r.counts[s])
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestMismatchSeverity(t *testing.T) {
+	var tests = []struct {
+		ext, content string
+		severity     string
+	}{
+		{"image/jpeg", "image/jpeg", ""},
+		{"image/jpeg", "image/png", severityLow},
+		{"image/jpeg", "text/x-php", severityCritical},
+		{"application/pdf", "application/x-dosexec", severityCritical},
+		{"image/gif", "text/html", severityHigh},
+		{"application/pdf", "application/zip", severityMedium},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip", ""},
+		{"application/zip", "application/vnd.oasis.opendocument.text", ""},
+		{"application/msword", "application/vnd.ms-office", ""},
+		{"text/css", "text/plain", ""},
+		{"text/x-php", "text/x-php", ""},
+		{"text/html", "text/x-php", ""},
+		{"", "image/png", ""},
+		{"image/png", "", ""},
+	}
+	for _, tt := range tests {
+		if s := mismatchSeverity(tt.ext, tt.content); s != tt.severity {
+			t.Errorf("%s as %s: expected %q got %q", tt.content, tt.ext, tt.severity, s)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Namespaces of the properties of office documents
+const (
+	nsCoreProps = "http://schemas.openxmlformats.org/package/2006/metadata/core-properties"
+	nsAppProps  = "http://schemas.openxmlformats.org/officeDocument/2006/extended-properties"
+	nsDCTerms   = "http://purl.org/dc/terms/"
+	nsODFMeta   = "urn:oasis:names:tc:opendocument:xmlns:meta:1.0"
+	nsODFText   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+)
+
+// Reads the parts not kept through the file, for archive/zip.
+func (c *contents) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	n := min(int64(len(p)), c.size-off)
+	b := c.at(off, n)
+	if b == nil {
+		return 0, fmt.Errorf("%d bytes at %d not readable", n, off)
+	}
+	copy(p, b)
+	if int(n) < len(p) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// Maximum size of a part of a package with properties, uncompressed.
+const docPropsSize = 1 << 20
+
+var errDocPropsSize = errors.New("document properties too big")
+
+// Returns the uncompressed parts of a ZIP package by name, nil for
+// those that are not there.  Only the central directory at the end
+// and the parts are read.
+func zipParts(c *contents, names ...string) ([][]byte, error) {
+	parts := make([][]byte, len(names))
+	if !bytes.HasPrefix(c.head, []byte("PK\x03\x04")) {
+		return parts, nil
+	}
+	r, err := zip.NewReader(c, c.size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.File {
+		for i, name := range names {
+			if f.Name != name {
+				continue
+			}
+			if f.UncompressedSize64 > docPropsSize {
+				return nil, fmt.Errorf("%s: %s", name, errDocPropsSize)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			parts[i], err = io.ReadAll(io.LimitReader(rc, docPropsSize))
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	return parts, nil
+}
+
+// Parses the properties of office documents, the text of elements and
+// the attributes, by namespace and name.
+func parseDocProps(data []byte, props xmpProps) error {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("XML: %s", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			text.Reset()
+			for _, a := range t.Attr {
+				props[a.Name] = append(props[a.Name], a.Value)
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if s := strings.TrimSpace(text.String()); s != "" {
+				props[t.Name] = append(props[t.Name], s)
+			}
+			text.Reset()
+		}
+	}
+}
+
+// Extracts the metadata of Office Open XML documents from their core
+// and extended properties.
+func ooxmlMeta(c *contents, m metadata) error {
+	parts, err := zipParts(c, "docProps/core.xml", "docProps/app.xml")
+	if err != nil {
+		return err
+	}
+	p := make(xmpProps)
+	for _, part := range parts {
+		if part == nil {
+			continue
+		}
+		if err = parseDocProps(part, p); err != nil {
+			break
+		}
+	}
+	// Properties before an error are still used
+	m.set("title", p.first(nsDC, "title"))
+	m.set("description", p.first(nsDC, "description"))
+	m.set("description", p.first(nsDC, "subject"))
+	m.set("keywords", p.first(nsCoreProps, "keywords"))
+	m.set("creator", p.first(nsDC, "creator"))
+	m.set("creator_tool", p.first(nsAppProps, "Application"))
+	m.set("content_creation_date", xmpTime(p.first(nsDCTerms, "created")))
+	m.set("content_modification_date", xmpTime(p.first(nsDCTerms, "modified")))
+	// Slides of presentations are their pages
+	m.set("pages", p.first(nsAppProps, "Pages"))
+	m.set("pages", p.first(nsAppProps, "Slides"))
+	m.set("word_count", p.first(nsAppProps, "Words"))
+	return err
+}
+
+// Extracts the metadata of OpenDocument files from their meta.xml.
+func odfMeta(c *contents, m metadata) error {
+	parts, err := zipParts(c, "meta.xml")
+	if parts == nil || parts[0] == nil {
+		return err
+	}
+	p := make(xmpProps)
+	err = parseDocProps(parts[0], p)
+	m.set("title", p.first(nsDC, "title"))
+	m.set("description", p.first(nsDC, "description"))
+	m.set("description", p.first(nsDC, "subject"))
+	m.set("keywords", p.join(nsODFMeta, "keyword"))
+	m.set("creator", p.first(nsODFMeta, "initial-creator"))
+	m.set("creator", p.first(nsDC, "creator"))
+	m.set("creator_tool", p.first(nsODFMeta, "generator"))
+	m.set("content_creation_date", xmpTime(p.first(nsODFMeta, "creation-date")))
+	m.set("content_modification_date", xmpTime(p.first(nsDC, "date")))
+	m.set("pages", p.first(nsODFMeta, "page-count"))
+	m.set("word_count", p.first(nsODFMeta, "word-count"))
+	return err
+}
+
+// Roles of the elements of documents for their plain text
+const (
+	// Character data is text
+	xmlText = 1 << iota
+	// Ends with a new line
+	xmlBlock
+)
+
+// Adds the text of the XML document in r, with role giving the roles
+// of elements and the text they stand for, like tabs.
+func xmlPlainText(r io.Reader, t *plainText, role func(xml.StartElement) (int, string)) error {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+	// Roles of the open elements, and how many are text
+	var roles []int
+	text := 0
+	for !t.full() {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("XML: %s", err)
+		}
+		switch e := tok.(type) {
+		case xml.StartElement:
+			r, s := role(e)
+			roles = append(roles, r)
+			if r&xmlText != 0 {
+				text++
+			}
+			t.write(s)
+		case xml.CharData:
+			if text > 0 {
+				t.write(string(e))
+			}
+		case xml.EndElement:
+			if len(roles) == 0 {
+				break
+			}
+			r := roles[len(roles)-1]
+			roles = roles[:len(roles)-1]
+			if r&xmlText != 0 {
+				text--
+			}
+			if r&xmlBlock != 0 {
+				t.newline()
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the text of the parts of a ZIP package, in order.
+func zipText(t *plainText, files []*zip.File, role func(xml.StartElement) (int, string)) error {
+	for _, f := range files {
+		if t.full() {
+			return nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err)
+		}
+		err = xmlPlainText(rc, t, role)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err)
+		}
+		t.newline()
+	}
+	return nil
+}
+
+// Extracts the text of Office Open XML documents: of the body of word
+// processing documents, the shared strings of spreadsheets and the
+// slides of presentations.
+func ooxmlText(c *contents, t *plainText) error {
+	if !bytes.HasPrefix(c.head, []byte("PK\x03\x04")) {
+		return nil
+	}
+	r, err := zip.NewReader(c, c.size)
+	if err != nil {
+		return err
+	}
+	var files []*zip.File
+	// Slides by number, not by name
+	slides := make(map[*zip.File]int)
+	for _, f := range r.File {
+		switch f.Name {
+		case "word/document.xml", "xl/sharedStrings.xml":
+			files = append(files, f)
+			continue
+		}
+		name, ok := strings.CutPrefix(f.Name, "ppt/slides/slide")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(name, ".xml")); err == nil {
+			slides[f] = n
+			files = append(files, f)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return slides[files[i]] < slides[files[j]]
+	})
+	return zipText(t, files, func(e xml.StartElement) (int, string) {
+		switch e.Name.Local {
+		case "t":
+			return xmlText, ""
+		case "p", "si":
+			return xmlBlock, ""
+		case "tab":
+			return 0, "\t"
+		case "br", "cr":
+			return 0, "\n"
+		}
+		return 0, ""
+	})
+}
+
+// Extracts the text of the paragraphs and headings of OpenDocument
+// files from their content.xml.
+func odfText(c *contents, t *plainText) error {
+	if !bytes.HasPrefix(c.head, []byte("PK\x03\x04")) {
+		return nil
+	}
+	r, err := zip.NewReader(c, c.size)
+	if err != nil {
+		return err
+	}
+	var files []*zip.File
+	for _, f := range r.File {
+		if f.Name == "content.xml" {
+			files = append(files, f)
+		}
+	}
+	return zipText(t, files, func(e xml.StartElement) (int, string) {
+		if e.Name.Space != nsODFText {
+			return 0, ""
+		}
+		switch e.Name.Local {
+		case "p", "h":
+			return xmlText | xmlBlock, ""
+		case "s":
+			// Consecutive spaces are counted
+			n := 1
+			for _, a := range e.Attr {
+				if a.Name.Local == "c" {
+					if c, err := strconv.Atoi(a.Value); err == nil && c > 1 && c <= 100 {
+						n = c
+					}
+				}
+			}
+			return 0, strings.Repeat(" ", n)
+		case "tab":
+			return 0, "\t"
+		case "line-break":
+			return 0, "\n"
+		}
+		return 0, ""
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func buildZip(t *testing.T, files ...string) []byte {
+	var b bytes.Buffer
+	z := zip.NewWriter(&b)
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := z.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+const testCoreXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties"
+ xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/"
+ xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+ <dc:title>Report</dc:title><dc:subject>Finance</dc:subject><dc:creator>Jane Doe</dc:creator>
+ <cp:keywords>money, q3</cp:keywords>
+ <dcterms:created xsi:type="dcterms:W3CDTF">2015-03-04T05:06:07Z</dcterms:created>
+</cp:coreProperties>`
+
+const testAppXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties">
+ <Slides>12</Slides><Words>3456</Words><Application>Microsoft Office PowerPoint</Application>
+</Properties>`
+
+const testMetaXML = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+ xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+ <office:meta><dc:title>Letter</dc:title><dc:creator>Bob</dc:creator>
+ <meta:keyword>one</meta:keyword><meta:keyword>two</meta:keyword>
+ <meta:document-statistic meta:page-count="2" meta:word-count="345"/></office:meta>
+</office:document-meta>`
+
+func TestOffice(t *testing.T) {
+	created := fmt.Sprint(time.Date(2015, 3, 4, 5, 6, 7, 0, time.UTC).Unix())
+	tests := []struct {
+		name   string
+		fn     extractor
+		data   []byte
+		expect metadata
+	}{
+		{"pptx", ooxmlMeta, buildZip(t, "ppt/presentation.xml", "<p/>", "docProps/core.xml", testCoreXML, "docProps/app.xml", testAppXML), metadata{
+			"title":                 "Report",
+			"description":           "Finance",
+			"creator":               "Jane Doe",
+			"keywords":              "money, q3",
+			"content_creation_date": created,
+			"creator_tool":          "Microsoft Office PowerPoint",
+			"pages":                 "12",
+			"word_count":            "3456",
+		}},
+		{"odt", odfMeta, buildZip(t, "mimetype", "application/vnd.oasis.opendocument.text", "meta.xml", testMetaXML), metadata{
+			"title":      "Letter",
+			"creator":    "Bob",
+			"keywords":   "one, two",
+			"pages":      "2",
+			"word_count": "345",
+		}},
+	}
+	for _, tt := range tests {
+		m := make(metadata)
+		if err := tt.fn(&contents{head: tt.data, tail: tt.data, size: int64(len(tt.data))}, m); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		for k, v := range tt.expect {
+			if m[k] != v {
+				t.Errorf("%s: %s: expected %q, got %q", tt.name, k, v, m[k])
+			}
+		}
+	}
+}
+
+func TestOfficeText(t *testing.T) {
+	const (
+		w = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"`
+		a = `xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"`
+		o = `xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"`
+	)
+	tests := []struct {
+		name string
+		fn   textExtractor
+		data []byte
+		text string
+	}{
+		{"docx", ooxmlText, buildZip(t, "word/document.xml", `<w:document `+w+`><w:body>
+			<w:p><w:r><w:t>Hello</w:t><w:t xml:space="preserve"> world</w:t><w:tab/><w:t>R&amp;D</w:t></w:r></w:p>
+			<w:p><w:r><w:instrText>PAGE</w:instrText><w:t>Last</w:t><w:br/><w:t>line</w:t></w:r></w:p></w:body></w:document>`),
+			"Hello world\tR&D\nLast\nline"},
+		{"pptx", ooxmlText, buildZip(t,
+			"ppt/slides/slide10.xml", `<p:sld `+a+`><a:p><a:t>Ten</a:t></a:p></p:sld>`,
+			"ppt/slides/slide2.xml", `<p:sld `+a+`><a:p><a:t>Two</a:t></a:p></p:sld>`),
+			"Two\nTen"},
+		{"odt", odfText, buildZip(t, "content.xml", `<office:document-content `+o+`><office:body><office:text>
+			<text:h>Title</text:h><text:p>One<text:s text:c="2"/>two<text:line-break/><text:span>three</text:span></text:p>
+			</office:text></office:body></office:document-content>`),
+			"Title\nOne  two\nthree"},
+	}
+	for _, tt := range tests {
+		text := &plainText{max: 100}
+		if err := tt.fn(&contents{head: tt.data, tail: tt.data, size: int64(len(tt.data))}, text); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if text.String() != tt.text {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.text, text.String())
+		}
+	}
+}
@@ -7,14 +7,15 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/csv"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"image"
 	"io"
 	"log"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -36,32 +37,68 @@ func parseHex(dest []byte, s string) {
 
 func loadCSV(fin io.Reader, w *writer) error {
 	var buf bytes.Buffer
-	r := csv.NewReader(fin)
+	r := newRecordReader(fin)
 	defer w.close()
 	for {
-		rec, err := r.Read()
+		rec, err := r.next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
-		ctime := time.Unix(parseInt(rec[2]), 0)
+		file, meta := rec.fileFields, rec.metaFields
+		if len(meta) < 22 {
+			return fmt.Errorf("expected at least 22 meta fields, got %d", len(meta))
+		}
+		if v := r.info["digests"]; v != extraDigests.String() {
+			return fmt.Errorf("digests %q differ from %q set with -digests", v, extraDigests.String())
+		}
+		if n := len(file) - 18; n != len(extraDigests) {
+			return fmt.Errorf("%s: expected %d additional digests, got %d", file[8], len(extraDigests), n)
+		}
+		if v := r.info["meta_columns"]; v != metaColumns.String() {
+			return fmt.Errorf("metadata columns %q differ from %q set with -meta-columns", v, metaColumns.String())
+		}
+		if n := metaCount(meta); n != len(metaColumns) {
+			return fmt.Errorf("%s: expected %d metadata columns, got %d", file[8], len(metaColumns), n)
+		}
+		ctime := time.Unix(parseInt(file[2]), 0)
 		p := props{
-			fname:   rec[8],
-			bname:   rec[13],
-			ext:     rec[11],
-			dir:     filepath.Dir(rec[8]),
-			mime:    rec[12],
-			isize:   image.Point{int(parseInt(rec[38])), int(parseInt(rec[39]))},
-			size:    parseInt(rec[15]),
-			ftype:   int(parseInt(rec[6])),
+			fname:   file[8],
+			bname:   file[13],
+			ext:     file[11],
+			dir:     filepath.Dir(file[8]),
+			mime:    file[12],
+			isize:   image.Point{int(parseInt(meta[20])), int(parseInt(meta[21]))},
+			size:    parseInt(file[15]),
+			ftype:   int(parseInt(file[6])),
 			modtime: ctime,
 			ctime:   ctime,
+			missing: file[4] == "1",
+			failed:  file[14] == "",
+		}
+		parseHex(p.ident[:], file[9])
+		parseHex(p.dident[:], file[10])
+		parseHex(p.chash[:], file[14])
+		for _, s := range file[18:] {
+			sum, err := hex.DecodeString(s)
+			if err != nil {
+				log.Fatal(err)
+			}
+			p.sums = append(p.sums, sum)
+		}
+		p.meta = make(metadata)
+		for i, c := range builtinColumns {
+			if j := metaBuiltin[i]; j < len(meta) && meta[j] != "" {
+				p.meta[c] = meta[j]
+			}
+		}
+		for i, c := range metaColumns {
+			if v := meta[metaFirst+i]; v != "" {
+				p.meta[c.field] = v
+			}
 		}
-		parseHex(p.ident[:], rec[9])
-		parseHex(p.dident[:], rec[10])
-		parseHex(p.chash[:], rec[14])
 		p.writeSQL(&buf)
 		w.write(buf.String())
 		buf.Reset()
@@ -69,53 +106,195 @@ func loadCSV(fin io.Reader, w *writer) error {
 	return nil
 }
 
-type prefixReader struct {
+// A record of the normal mode output.
+type record struct {
+	fileLine, metaLine     string
+	fileFields, metaFields []string
+}
+
+// Index of the first metadata column in meta lines.
+const metaFirst = 25
+
+// Indexes of the columns of builtinColumns in meta lines.
+var metaBuiltin = []int{19, 22, 23}
+
+// Number of metadata columns of a meta line.
+func metaCount(meta []string) int {
+	if len(meta) < metaFirst {
+		return 0
+	}
+	return len(meta) - metaFirst
+}
+
+// Maximum size of a line of the normal mode output.  Metadata values
+// are read from at most contentsReadSize bytes of each file, and
+// escaping can double their size.
+const maxLineSize = 4 * contentsReadSize
+
+// Returns a scanner of the lines of the normal mode output.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+	return scanner
+}
+
+// Reads the pairs of file and meta lines of the normal mode output.
+type recordReader struct {
 	scanner *bufio.Scanner
-	buf     bytes.Buffer
+	// Values of the info lines found so far
+	info map[string]string
 }
 
-func newPrefixReader(r io.Reader) *prefixReader {
-	return &prefixReader{
-		scanner: bufio.NewScanner(r),
-		buf:     bytes.Buffer{},
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{
+		scanner: newLineScanner(r),
+		info:    make(map[string]string),
 	}
 }
 
-func (p *prefixReader) Read(buf []byte) (n int, err error) {
-	// handle half reads from the buffered data
-	n, err = p.buf.Read(buf)
-	if n != 0 {
-		return
+// Returns true if the output was written by an earlier version,
+// without the format version, that only escaped quotes.
+func (r *recordReader) legacy() bool {
+	return r.info["format"] == ""
+}
+
+// Parses the fields of line after its prefix.
+func (r *recordReader) parse(line string) ([]string, error) {
+	return parseFields(line[5:], r.legacy())
+}
+
+// Escapes a line written by an earlier version, that only escaped
+// quotes, like this version does.
+func upgradeLine(line string) string {
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && line[i+1] == '"' {
+			b.WriteString(`\"`)
+			i++
+			continue
+		}
+		if c == '\\' || c == '\r' || c == 0 {
+			b.WriteString(escape(string(c)))
+			continue
+		}
+		b.WriteByte(c)
 	}
-	var hasFile bool
-	// read two new lines, file and meta
-	for p.scanner.Scan() {
-		var readReady bool
-		line := p.scanner.Text()
-		prefix := line[:5]
-		line = line[5:]
-		switch prefix {
-		case "file:":
-			if hasFile {
-				return 0, errors.New("invalid line: 'file:' line expected")
+	return b.String()
+}
+
+var errQuote = errors.New("missing closing quote")
+
+// Parses comma separated fields, quoted or not.  Quoted fields are
+// escaped with backslashes like MySQL does, or by doubling quotes.
+// If legacy is true, only quotes are escaped with a backslash and
+// other backslashes are kept, as in outputs of earlier versions.
+func parseFields(s string, legacy bool) ([]string, error) {
+	var (
+		fields []string
+		b      bytes.Buffer
+	)
+	for {
+		if !strings.HasPrefix(s, `"`) {
+			i := strings.IndexByte(s, ',')
+			if i < 0 {
+				return append(fields, s), nil
+			}
+			fields = append(fields, s[:i])
+			s = s[i+1:]
+			continue
+		}
+		b.Reset()
+		i := 1
+		for ; ; i++ {
+			if i >= len(s) {
+				return nil, errQuote
 			}
-			hasFile = true
-		case "meta:":
-			if !hasFile {
-				return 0, errors.New("invalid line: 'meta:' line expected")
+			c := s[i]
+			if c == '\\' && i+1 < len(s) && (!legacy || s[i+1] == '"') {
+				i++
+				b.WriteByte(unescapeByte(s[i]))
+				continue
+			}
+			if c == '"' {
+				if i+1 < len(s) && s[i+1] == '"' {
+					i++
+					b.WriteByte('"')
+					continue
+				}
+				break
 			}
-			readReady = true
-			p.buf.WriteByte(',') // append 'meta:' to the last 'file:' line
-		default:
-			return 0, errors.New("invalid line: must start with 'meta:' or 'file:'")
+			b.WriteByte(c)
 		}
-		p.buf.WriteString(line)
-		if !readReady {
-			continue
+		fields = append(fields, b.String())
+		s = s[i+1:]
+		if s == "" {
+			return fields, nil
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("unexpected %q after quoted field", s[0])
 		}
-		p.buf.WriteByte('\n')
-		n, _ = p.buf.Read(buf)
-		return n, p.scanner.Err()
+		s = s[1:]
+	}
+}
+
+func unescapeByte(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case '0':
+		return 0
+	}
+	return c
+}
+
+// Returns the next record, or io.EOF at the end of the input.
+func (r *recordReader) next() (*record, error) {
+	for {
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		line := r.scanner.Text()
+		if !strings.HasPrefix(line, "info:") {
+			break
+		}
+		fields, err := r.parse(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected 2 fields in info line, got %d", len(fields))
+		}
+		r.info[fields[0]] = fields[1]
+	}
+	rec := &record{fileLine: r.scanner.Text()}
+	if !strings.HasPrefix(rec.fileLine, "file:") {
+		return nil, fmt.Errorf("invalid file line: %s", rec.fileLine)
+	}
+	var err error
+	if rec.fileFields, err = r.parse(rec.fileLine); err != nil {
+		return nil, err
+	}
+	if len(rec.fileFields) < 18 {
+		return nil, fmt.Errorf("expected at least 18 fields, got %d", len(rec.fileFields))
+	}
+	// Read the next line that contains the "meta:" data
+	if !r.scanner.Scan() {
+		return nil, fmt.Errorf("expected a meta: line, got error: %v", r.scanner.Err())
+	}
+	rec.metaLine = r.scanner.Text()
+	if !strings.HasPrefix(rec.metaLine, "meta:") {
+		return nil, fmt.Errorf("invalid meta line: %s", rec.metaLine)
+	}
+	if rec.metaFields, err = r.parse(rec.metaLine); err != nil {
+		return nil, err
 	}
-	return 0, io.EOF
+	return rec, nil
 }
@@ -0,0 +1,90 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	var tests = []struct {
+		line   string
+		fields []string
+	}{
+		{`"a","b",""`, []string{"a", "b", ""}},
+		{`"0",UID,"x"`, []string{"0", "UID", "x"}},
+		{`"say \"hi\"","c:\\dir","a""b"`, []string{`say "hi"`, `c:\dir`, `a"b`}},
+		{`"two\nlines","x,y"`, []string{"two\nlines", "x,y"}},
+		{`"` + escape("\\\"\n\r\x00,end\\") + `"`, []string{"\\\"\n\r\x00,end\\"}},
+	}
+	for _, tt := range tests {
+		fields, err := parseFields(tt.line, false)
+		if err != nil {
+			t.Errorf("%s: %s", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: expected %q got %q", tt.line, tt.fields, fields)
+		}
+	}
+	for _, line := range []string{`"open`, `"a"b`, `"a\"`} {
+		if _, err := parseFields(line, false); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
+
+func TestRecordReaderLongLines(t *testing.T) {
+	p := newMissingProps(sha1.New(), "docs/long.pdf")
+	p.meta = metadata{"description": strings.Repeat("long text ", 20000)}
+	line := p.marshal(&bytes.Buffer{})
+	rec, err := newRecordReader(strings.NewReader(line)).next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.metaFields[22] != p.meta["description"] {
+		t.Errorf("expected the description of %d bytes, got %d bytes", len(p.meta["description"]), len(rec.metaFields[22]))
+	}
+	var out bytes.Buffer
+	if err := (splitWriter{"meta:", strings.NewReader(line), 2, 1, 1, true}).write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), p.meta["description"]) {
+		t.Error("description missing from the split output")
+	}
+}
+
+func TestParseLegacyFields(t *testing.T) {
+	// Earlier versions only escaped quotes
+	fields, err := parseFields(`"c:\dir\n\"x\"","a"`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{`c:\dir\n"x"`, "a"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %q got %q", expected, fields)
+	}
+	p := newMissingProps(sha1.New(), `dir\new.txt`)
+	var b bytes.Buffer
+	writeInfo(&b, "format", outputFormat)
+	line := b.String() + p.marshal(&bytes.Buffer{})
+	legacy := strings.Replace(line[strings.IndexByte(line, '\n')+1:], `\\`, `\`, -1)
+	for _, s := range []string{line, legacy} {
+		rec, err := newRecordReader(strings.NewReader(s)).next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.fileFields[8] != p.fname {
+			t.Errorf("%s: expected name %q, got %q", s, p.fname, rec.fileFields[8])
+		}
+	}
+	// Delta records are written again escaped like this version
+	if upgraded := upgradeLine(legacy); upgraded != line[strings.IndexByte(line, '\n')+1:] {
+		t.Errorf("expected %q, got %q", line, upgraded)
+	}
+}
@@ -0,0 +1,1272 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Objects of PDF files.  Numbers are float64, strings are pdfString,
+// booleans are bool and null is nil.
+type (
+	pdfName   string
+	pdfString string
+	pdfArray  []interface{}
+	pdfDict   map[pdfName]interface{}
+	pdfRef    struct{ num, gen int64 }
+	// Keyword other than true, false and null
+	pdfKeyword string
+	// Stream, with the offset of its data in the file
+	pdfStream struct {
+		dict pdfDict
+		off  int64
+	}
+)
+
+var (
+	errPDF          = errors.New("PDF: invalid object")
+	errPDFEncrypted = errors.New("PDF: encrypted, only pages are read")
+	errPDFNoXref    = errors.New("PDF: cross-reference table not found")
+	errPDFNoText    = errors.New("PDF: encrypted, text is not read")
+)
+
+// Reads the objects of PDF syntax in b.
+type pdfLexer struct {
+	b   []byte
+	pos int
+}
+
+func isPDFSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelim(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return isPDFSpace(c)
+}
+
+// Skips spaces and comments.
+func (l *pdfLexer) skip() {
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		if c == '%' {
+			for l.pos < len(l.b) && l.b[l.pos] != '\n' && l.b[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// Returns the regular characters at the current position.
+func (l *pdfLexer) word() string {
+	start := l.pos
+	for l.pos < len(l.b) && !isPDFDelim(l.b[l.pos]) {
+		l.pos++
+	}
+	return string(l.b[start:l.pos])
+}
+
+// Maximum nesting of arrays and dictionaries.
+const pdfMaxDepth = 64
+
+// Reads the next object.  References are returned as they are.
+func (l *pdfLexer) value() (interface{}, error) {
+	return l.valueDepth(0)
+}
+
+func (l *pdfLexer) valueDepth(depth int) (interface{}, error) {
+	if depth > pdfMaxDepth {
+		return nil, errPDF
+	}
+	l.skip()
+	if l.pos >= len(l.b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch c := l.b[l.pos]; {
+	case c == '/':
+		l.pos++
+		return pdfName(unescapeName(l.word())), nil
+	case c == '(':
+		return l.literal()
+	case c == '<' && l.pos+1 < len(l.b) && l.b[l.pos+1] == '<':
+		l.pos += 2
+		d := make(pdfDict)
+		for {
+			l.skip()
+			if l.pos+1 < len(l.b) && l.b[l.pos] == '>' && l.b[l.pos+1] == '>' {
+				l.pos += 2
+				return d, nil
+			}
+			k, err := l.valueDepth(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := k.(pdfName)
+			if !ok {
+				return nil, errPDF
+			}
+			v, err := l.valueDepth(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			d[name] = v
+		}
+	case c == '<':
+		return l.hex()
+	case c == '[':
+		l.pos++
+		var a pdfArray
+		for {
+			l.skip()
+			if l.pos < len(l.b) && l.b[l.pos] == ']' {
+				l.pos++
+				return a, nil
+			}
+			v, err := l.valueDepth(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		w := l.word()
+		n, err := strconv.ParseFloat(w, 64)
+		if err != nil {
+			return nil, errPDF
+		}
+		// An integer can start a reference "num gen R"
+		if strings.IndexAny(w, "+-.") < 0 {
+			save := l.pos
+			l.skip()
+			gen := l.word()
+			l.skip()
+			if g, err := strconv.ParseInt(gen, 10, 64); err == nil && l.word() == "R" {
+				return pdfRef{int64(n), g}, nil
+			}
+			l.pos = save
+		}
+		return n, nil
+	case isPDFDelim(c):
+		return nil, errPDF
+	}
+	switch w := l.word(); w {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	default:
+		return pdfKeyword(w), nil
+	}
+}
+
+// Decodes the #xx escapes of names.
+func unescapeName(s string) string {
+	if !strings.Contains(s, "#") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '#' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (l *pdfLexer) literal() (pdfString, error) {
+	var b []byte
+	nest := 0
+	for l.pos++; l.pos < len(l.b); l.pos++ {
+		c := l.b[l.pos]
+		switch c {
+		case '(':
+			nest++
+		case ')':
+			if nest == 0 {
+				l.pos++
+				return pdfString(b), nil
+			}
+			nest--
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.b) {
+				return "", io.ErrUnexpectedEOF
+			}
+			c = l.b[l.pos]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// Line continuation
+				if l.pos+1 < len(l.b) && l.b[l.pos+1] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			}
+			if c >= '0' && c <= '7' {
+				n := 0
+				for i := 0; i < 3 && l.pos < len(l.b) && l.b[l.pos] >= '0' && l.b[l.pos] <= '7'; i++ {
+					n = n*8 + int(l.b[l.pos]-'0')
+					l.pos++
+				}
+				l.pos--
+				c = byte(n)
+			}
+		}
+		b = append(b, c)
+	}
+	return "", io.ErrUnexpectedEOF
+}
+
+func (l *pdfLexer) hex() (pdfString, error) {
+	var b []byte
+	var digit int = -1
+	for l.pos++; l.pos < len(l.b); l.pos++ {
+		c := l.b[l.pos]
+		if c == '>' {
+			if digit >= 0 {
+				b = append(b, byte(digit<<4))
+			}
+			l.pos++
+			return pdfString(b), nil
+		}
+		var n int
+		switch {
+		case c >= '0' && c <= '9':
+			n = int(c - '0')
+		case c >= 'a' && c <= 'f':
+			n = int(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			n = int(c-'A') + 10
+		case isPDFSpace(c):
+			continue
+		default:
+			return "", errPDF
+		}
+		if digit < 0 {
+			digit = n
+		} else {
+			b = append(b, byte(digit<<4|n))
+			digit = -1
+		}
+	}
+	return "", io.ErrUnexpectedEOF
+}
+
+// Entry of the cross-reference table
+type pdfXref struct {
+	// Offset in the file, or index in the object stream
+	off int64
+	// Object stream containing the object, if not zero
+	stream int64
+}
+
+// A PDF file being read from its contents.
+type pdfFile struct {
+	c       *contents
+	xref    map[int64]pdfXref
+	trailer pdfDict
+	// Decoded object streams
+	streams map[int64]*pdfObjStream
+	// Objects being resolved, against loops
+	resolving int
+	// Fonts read for their text, by reference
+	fonts map[pdfRef]*pdfFont
+}
+
+// Objects of an object stream
+type pdfObjStream struct {
+	data []byte
+	// Offset of each object in data
+	offs []int
+}
+
+// Sizes of the windows of the file parsed for an object.
+const (
+	pdfWindow    = 16 << 10
+	pdfMaxWindow = 8 << 20
+)
+
+// Reads the object at offset off: "num gen obj" followed by a value
+// and, for streams, their data.
+func (f *pdfFile) object(off int64) (interface{}, error) {
+	for window := int64(pdfWindow); ; window *= 4 {
+		n := window
+		if rest := f.c.size - off; n >= rest {
+			n = rest
+		}
+		b := f.c.at(off, n)
+		if b == nil {
+			return nil, fmt.Errorf("PDF: object at %d not readable", off)
+		}
+		v, err := f.parseObject(b, off)
+		if err != io.ErrUnexpectedEOF || n < window || window >= pdfMaxWindow {
+			return v, err
+		}
+	}
+}
+
+func (f *pdfFile) parseObject(b []byte, off int64) (interface{}, error) {
+	l := &pdfLexer{b: b}
+	for i, want := range []string{"", "", "obj"} {
+		l.skip()
+		w := l.word()
+		if (i < 2 && w == "") || (i == 2 && w != want) {
+			if l.pos >= len(b) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("PDF: no object at %d", off)
+		}
+	}
+	v, err := l.value()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(pdfDict)
+	if !ok {
+		return v, nil
+	}
+	l.skip()
+	if !bytes.HasPrefix(b[l.pos:], []byte("stream")) {
+		return v, nil
+	}
+	l.pos += len("stream")
+	if bytes.HasPrefix(b[l.pos:], []byte("\r\n")) {
+		l.pos += 2
+	} else if l.pos < len(b) && (b[l.pos] == '\n' || b[l.pos] == '\r') {
+		l.pos++
+	}
+	return &pdfStream{dict: d, off: off + int64(l.pos)}, nil
+}
+
+// Maximum size of decoded streams.
+const pdfStreamSize = 16 << 20
+
+// Returns the decoded data of stream s.  Only the Flate filter
+// is supported, which is the one used for metadata.
+func (f *pdfFile) streamData(s *pdfStream) ([]byte, error) {
+	n, ok := f.resolve(s.dict["Length"]).(float64)
+	if !ok || n < 0 || n > pdfStreamSize {
+		return nil, errPDF
+	}
+	data := f.c.at(s.off, int64(n))
+	if data == nil {
+		return nil, fmt.Errorf("PDF: stream at %d not readable", s.off)
+	}
+	filter := f.resolve(s.dict["Filter"])
+	parms, _ := f.resolve(s.dict["DecodeParms"]).(pdfDict)
+	if a, ok := filter.(pdfArray); ok {
+		if len(a) > 1 {
+			return nil, fmt.Errorf("PDF: unsupported filters %v", a)
+		}
+		filter = nil
+		if len(a) == 1 {
+			filter = f.resolve(a[0])
+		}
+		if p, ok := f.resolve(s.dict["DecodeParms"]).(pdfArray); ok && len(p) == 1 {
+			parms, _ = f.resolve(p[0]).(pdfDict)
+		}
+	}
+	switch filter {
+	case nil:
+		return data, nil
+	case pdfName("FlateDecode"):
+	default:
+		return nil, fmt.Errorf("PDF: unsupported filter %v", filter)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("PDF: %s", err)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, pdfStreamSize))
+	// Data before a corrupt end is still good
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("PDF: %s", err)
+	}
+	if p, ok := parms["Predictor"].(float64); ok && p >= 10 {
+		columns, _ := parms["Columns"].(float64)
+		return unpredict(out, int(columns))
+	}
+	return out, nil
+}
+
+// Reverses the PNG predictors of rows of columns bytes.
+func unpredict(data []byte, columns int) ([]byte, error) {
+	if columns < 1 {
+		columns = 1
+	}
+	row := columns + 1
+	out := make([]byte, 0, len(data)/row*columns)
+	prev := make([]byte, columns)
+	for len(data) >= row {
+		filter, cur := data[0], data[1:row]
+		for i := range cur {
+			var left, up, upLeft byte
+			if i > 0 {
+				left, upLeft = cur[i-1], prev[i-1]
+			}
+			up = prev[i]
+			switch filter {
+			case 0:
+			case 1:
+				cur[i] += left
+			case 2:
+				cur[i] += up
+			case 3:
+				cur[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				cur[i] += paeth(left, up, upLeft)
+			default:
+				return nil, errPDF
+			}
+		}
+		out = append(out, cur...)
+		copy(prev, cur)
+		data = data[row:]
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Maximum depth of references followed to resolve an object.
+const pdfMaxResolve = 32
+
+// Returns the object v refers to, or v itself if it is not a reference.
+func (f *pdfFile) resolve(v interface{}) interface{} {
+	ref, ok := v.(pdfRef)
+	if !ok {
+		return v
+	}
+	if f.resolving > pdfMaxResolve {
+		return nil
+	}
+	f.resolving++
+	defer func() { f.resolving-- }()
+	x, ok := f.xref[ref.num]
+	if !ok {
+		return nil
+	}
+	if x.stream != 0 {
+		s, err := f.objStream(x.stream)
+		if err != nil || x.off < 0 || x.off >= int64(len(s.offs)) {
+			return nil
+		}
+		l := &pdfLexer{b: s.data, pos: s.offs[x.off]}
+		obj, _ := l.value()
+		return f.resolve(obj)
+	}
+	obj, err := f.object(x.off)
+	if err != nil {
+		return nil
+	}
+	return f.resolve(obj)
+}
+
+func (f *pdfFile) objStream(num int64) (*pdfObjStream, error) {
+	if s, ok := f.streams[num]; ok {
+		return s, nil
+	}
+	// Failures are remembered too
+	f.streams[num] = &pdfObjStream{}
+	x, ok := f.xref[num]
+	if !ok || x.stream != 0 {
+		return nil, errPDF
+	}
+	obj, err := f.object(x.off)
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := obj.(*pdfStream)
+	if !ok {
+		return nil, errPDF
+	}
+	data, err := f.streamData(stream)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := stream.dict["N"].(float64)
+	first, _ := stream.dict["First"].(float64)
+	s := &pdfObjStream{data: data}
+	l := &pdfLexer{b: data}
+	for i := 0; i < int(n); i++ {
+		l.value()
+		off, err := l.value()
+		o, ok := off.(float64)
+		if err != nil || !ok || first+o < 0 || int(first+o) >= len(data) {
+			break
+		}
+		s.offs = append(s.offs, int(first+o))
+	}
+	f.streams[num] = s
+	return s, nil
+}
+
+var startxref = []byte("startxref")
+
+// Loads the cross-reference tables, from the last one to the first.
+func (f *pdfFile) loadXref() error {
+	tail := f.c.tail
+	i := bytes.LastIndex(tail, startxref)
+	if i < 0 {
+		return errPDFNoXref
+	}
+	l := &pdfLexer{b: tail, pos: i + len(startxref)}
+	v, _ := l.value()
+	start, ok := v.(float64)
+	if !ok {
+		return errPDFNoXref
+	}
+	seen := make(map[int64]bool)
+	for off := int64(start); off > 0 && !seen[off]; {
+		seen[off] = true
+		trailer, err := f.loadXrefAt(off)
+		if err != nil {
+			return err
+		}
+		for k, v := range trailer {
+			if _, ok := f.trailer[k]; !ok {
+				f.trailer[k] = v
+			}
+		}
+		// Hybrid files have a stream with the objects in object streams
+		if stm, ok := trailer["XRefStm"].(float64); ok && !seen[int64(stm)] {
+			seen[int64(stm)] = true
+			if _, err := f.loadXrefAt(int64(stm)); err != nil {
+				return err
+			}
+		}
+		prev, _ := trailer["Prev"].(float64)
+		off = int64(prev)
+	}
+	return nil
+}
+
+// Loads the table at offset off, keeping entries already loaded,
+// and returns its trailer.
+func (f *pdfFile) loadXrefAt(off int64) (pdfDict, error) {
+	n := f.c.size - off
+	if n > pdfMaxWindow {
+		n = pdfMaxWindow
+	}
+	b := f.c.at(off, n)
+	if b == nil {
+		return nil, errPDFNoXref
+	}
+	if !bytes.HasPrefix(b, []byte("xref")) {
+		return f.loadXrefStream(off)
+	}
+	l := &pdfLexer{b: b, pos: len("xref")}
+	for {
+		v, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+		if v == pdfKeyword("trailer") {
+			break
+		}
+		first, ok := v.(float64)
+		v, err = l.value()
+		count, ok2 := v.(float64)
+		if err != nil || !ok || !ok2 {
+			return nil, errPDFNoXref
+		}
+		for i := int64(0); i < int64(count); i++ {
+			o, _ := l.value()
+			l.value()
+			typ, _ := l.value()
+			offset, ok := o.(float64)
+			if !ok {
+				return nil, errPDFNoXref
+			}
+			num := int64(first) + i
+			if _, ok := f.xref[num]; !ok && typ == pdfKeyword("n") {
+				f.xref[num] = pdfXref{off: int64(offset)}
+			}
+		}
+	}
+	v, err := l.value()
+	trailer, ok := v.(pdfDict)
+	if err != nil || !ok {
+		return nil, errPDFNoXref
+	}
+	return trailer, nil
+}
+
+func (f *pdfFile) loadXrefStream(off int64) (pdfDict, error) {
+	obj, err := f.object(off)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := obj.(*pdfStream)
+	if !ok || s.dict["Type"] != pdfName("XRef") {
+		return nil, errPDFNoXref
+	}
+	data, err := f.streamData(s)
+	if err != nil {
+		return nil, err
+	}
+	w, _ := s.dict["W"].(pdfArray)
+	if len(w) != 3 {
+		return nil, errPDFNoXref
+	}
+	var widths [3]int
+	row := 0
+	for i := range w {
+		n, _ := w[i].(float64)
+		if n < 0 || n > 8 {
+			return nil, errPDFNoXref
+		}
+		widths[i] = int(n)
+		row += int(n)
+	}
+	size, _ := s.dict["Size"].(float64)
+	index, _ := s.dict["Index"].(pdfArray)
+	if index == nil {
+		index = pdfArray{0.0, size}
+	}
+	for i := 0; i+1 < len(index); i += 2 {
+		first, _ := index[i].(float64)
+		count, _ := index[i+1].(float64)
+		for j := int64(0); j < int64(count) && len(data) >= row && row > 0; j++ {
+			var fields [3]int64
+			pos := 0
+			for k, n := range widths {
+				for _, c := range data[pos : pos+n] {
+					fields[k] = fields[k]<<8 | int64(c)
+				}
+				pos += n
+			}
+			data = data[row:]
+			// Without the first field all entries are offsets
+			if widths[0] == 0 {
+				fields[0] = 1
+			}
+			num := int64(first) + j
+			if _, ok := f.xref[num]; ok {
+				continue
+			}
+			// Fields of 8 bytes can be negative
+			if fields[1] < 0 || fields[2] < 0 {
+				continue
+			}
+			switch fields[0] {
+			case 1:
+				f.xref[num] = pdfXref{off: fields[1]}
+			case 2:
+				f.xref[num] = pdfXref{off: fields[2], stream: fields[1]}
+			}
+		}
+	}
+	return s.dict, nil
+}
+
+var pdfObjectRe = regexp.MustCompile(`(?:^|[\r\n\s])(\d+)\s+(\d+)\s+obj\b`)
+
+// Rebuilds the cross-reference table of a broken file from the
+// objects found in the head and in the tail.
+func (f *pdfFile) reconstruct() error {
+	parts := []struct {
+		b   []byte
+		off int64
+	}{{f.c.head, 0}, {f.c.tail, f.c.size - int64(len(f.c.tail))}}
+	for _, p := range parts {
+		for _, m := range pdfObjectRe.FindAllSubmatchIndex(p.b, -1) {
+			num, _ := strconv.ParseInt(string(p.b[m[2]:m[3]]), 10, 64)
+			// Later objects replace earlier ones, like updates do
+			f.xref[num] = pdfXref{off: p.off + int64(m[2])}
+		}
+	}
+	for num := range f.xref {
+		d, ok := f.resolve(pdfRef{num, 0}).(pdfDict)
+		if ok && d["Type"] == pdfName("Catalog") {
+			f.trailer["Root"] = pdfRef{num, 0}
+		}
+	}
+	if _, ok := f.trailer["Root"]; !ok {
+		return errPDFNoXref
+	}
+	// The trailer of the last update has the Info dictionary
+	if i := bytes.LastIndex(f.c.tail, []byte("trailer")); i >= 0 {
+		l := &pdfLexer{b: f.c.tail, pos: i + len("trailer")}
+		if t, err := l.value(); err == nil {
+			if t, ok := t.(pdfDict); ok {
+				f.trailer["Info"] = t["Info"]
+			}
+		}
+	}
+	return nil
+}
+
+// Reads the cross-reference table of the PDF file in c and returns
+// the file with its document catalog.  Broken files are read as far
+// as possible: the file is returned with the error of the table if
+// the catalog is found anyway.
+func openPDF(c *contents) (*pdfFile, pdfDict, error) {
+	f := &pdfFile{
+		c:       c,
+		xref:    make(map[int64]pdfXref),
+		trailer: make(pdfDict),
+		streams: make(map[int64]*pdfObjStream),
+	}
+	err := f.loadXref()
+	root, ok := f.resolve(f.trailer["Root"]).(pdfDict)
+	if !ok {
+		f.xref = make(map[int64]pdfXref)
+		f.trailer = make(pdfDict)
+		f.streams = make(map[int64]*pdfObjStream)
+		if rerr := f.reconstruct(); rerr != nil && err != nil {
+			return nil, nil, err
+		}
+		if root, ok = f.resolve(f.trailer["Root"]).(pdfDict); !ok {
+			return nil, nil, fmt.Errorf("PDF: document catalog not found")
+		}
+	}
+	return f, root, err
+}
+
+// Extracts the metadata of PDF files: the XMP metadata and the
+// document information, the number of pages and the size of the
+// first page, in points.
+func pdfMeta(c *contents, m metadata) error {
+	if !bytes.HasPrefix(c.head, []byte("%PDF-")) {
+		return nil
+	}
+	f, root, err := openPDF(c)
+	if f == nil {
+		return err
+	}
+	f.readPages(root, m)
+	// Strings and streams of encrypted files cannot be read
+	if _, ok := f.trailer["Encrypt"]; ok {
+		return errPDFEncrypted
+	}
+	if s, ok := f.resolve(root["Metadata"]).(*pdfStream); ok {
+		if data, err := f.streamData(s); err == nil {
+			readXMP(data, m)
+		}
+	}
+	if info, ok := f.resolve(f.trailer["Info"]).(pdfDict); ok {
+		text := func(key pdfName) string {
+			s, _ := f.resolve(info[key]).(pdfString)
+			return pdfText(s)
+		}
+		m.set("title", text("Title"))
+		m.set("description", text("Subject"))
+		m.set("keywords", text("Keywords"))
+		m.set("creator", text("Author"))
+		m.set("creator_tool", text("Creator"))
+		m.set("creator_tool", text("Producer"))
+		m.set("content_creation_date", pdfTime(text("CreationDate")))
+		m.set("content_modification_date", pdfTime(text("ModDate")))
+	}
+	return err
+}
+
+// Maximum depth of the page tree.
+const pdfMaxPageDepth = 32
+
+// Sets the number of pages and the size of the first one.
+func (f *pdfFile) readPages(root pdfDict, m metadata) {
+	node, ok := f.resolve(root["Pages"]).(pdfDict)
+	if !ok {
+		return
+	}
+	if n, ok := f.resolve(node["Count"]).(float64); ok && n >= 0 {
+		m.set("pages", strconv.Itoa(int(n)))
+	}
+	// Size and rotation are inherited from the parents
+	var (
+		box    pdfArray
+		rotate float64
+	)
+	for depth := 0; depth < pdfMaxPageDepth; depth++ {
+		if b, ok := f.resolve(node["MediaBox"]).(pdfArray); ok && len(b) == 4 {
+			box = b
+		}
+		if r, ok := f.resolve(node["Rotate"]).(float64); ok {
+			rotate = r
+		}
+		kids, ok := f.resolve(node["Kids"]).(pdfArray)
+		if !ok || len(kids) == 0 {
+			break
+		}
+		if node, ok = f.resolve(kids[0]).(pdfDict); !ok {
+			return
+		}
+	}
+	if box == nil {
+		return
+	}
+	var v [4]float64
+	for i := range box {
+		n, ok := f.resolve(box[i]).(float64)
+		if !ok {
+			return
+		}
+		v[i] = n
+	}
+	w, h := math.Round(math.Abs(v[2]-v[0])), math.Round(math.Abs(v[3]-v[1]))
+	if int(rotate)%180 != 0 {
+		w, h = h, w
+	}
+	m.set("width", strconv.Itoa(int(w)))
+	m.set("height", strconv.Itoa(int(h)))
+}
+
+// Characters 0x80 to 0xa0 of PDFDocEncoding; the others are Latin-1.
+var pdfDocEncoding = []rune("•†‡…—–ƒ⁄‹›−‰„“”‘’‚™ﬁﬂŁŒŠŸŽıłœšž�€")
+
+// Decodes a text string, in UTF-16 or UTF-8 with a byte order mark,
+// or in PDFDocEncoding.
+func pdfText(s pdfString) string {
+	switch {
+	case strings.HasPrefix(string(s), "\xfe\xff"):
+		return string(utf16.Decode(utf16Units(s[2:])))
+	case strings.HasPrefix(string(s), "\xef\xbb\xbf"):
+		return string(s[3:])
+	}
+	r := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x80 && c <= 0xa0 {
+			r[i] = pdfDocEncoding[c-0x80]
+		} else {
+			r[i] = rune(c)
+		}
+	}
+	return string(r)
+}
+
+// Returns the Unix time of a PDF date, "D:YYYYMMDDHHmmSSOHH'mm'" where
+// all but the year are optional, as a string.  Dates without time zone
+// are in dateZone.
+func pdfTime(s string) string {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "D:")
+	var digits int
+	for digits < len(s) && digits < 14 && s[digits] >= '0' && s[digits] <= '9' {
+		digits++
+	}
+	if digits < 4 || digits%2 != 0 {
+		return ""
+	}
+	// Missing month and day are the first
+	date := s[:digits] + "0101000000"[digits-4:]
+	t, err := time.ParseInLocation("20060102150405", date, dateZone)
+	if err != nil {
+		return ""
+	}
+	zone := strings.Replace(strings.TrimSuffix(s[digits:], "'"), "'", "", -1)
+	switch {
+	case zone == "Z" || strings.HasPrefix(zone, "Z0"):
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	case len(zone) == 5 && (zone[0] == '+' || zone[0] == '-'):
+		if z, err := time.Parse("-0700", zone); err == nil {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, z.Location())
+		}
+	case len(zone) == 3 && (zone[0] == '+' || zone[0] == '-'):
+		if z, err := time.Parse("-07", zone); err == nil {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, z.Location())
+		}
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// Extracts the text shown on the pages of PDF files, in the order it
+// is drawn, which is usually the order it is read in.
+func pdfPlainText(c *contents, t *plainText) error {
+	if !bytes.HasPrefix(c.head, []byte("%PDF-")) {
+		return nil
+	}
+	f, root, err := openPDF(c)
+	if f == nil {
+		return err
+	}
+	if _, ok := f.trailer["Encrypt"]; ok {
+		return errPDFNoText
+	}
+	if node, ok := f.resolve(root["Pages"]).(pdfDict); ok {
+		f.pagesText(node, nil, make(map[pdfRef]bool), 0, t)
+	}
+	return err
+}
+
+// Adds the text of the pages under node of the page tree, with the
+// resources inherited from the parents.  Pages already seen are
+// skipped, against loops.
+func (f *pdfFile) pagesText(node, resources pdfDict, seen map[pdfRef]bool, depth int, t *plainText) {
+	if res, ok := f.resolve(node["Resources"]).(pdfDict); ok {
+		resources = res
+	}
+	kids, ok := f.resolve(node["Kids"]).(pdfArray)
+	if !ok {
+		f.pageText(node, resources, t)
+		t.newline()
+		return
+	}
+	if depth >= pdfMaxPageDepth {
+		return
+	}
+	for _, kid := range kids {
+		if t.full() {
+			return
+		}
+		if ref, ok := kid.(pdfRef); ok {
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+		}
+		if d, ok := f.resolve(kid).(pdfDict); ok {
+			f.pagesText(d, resources, seen, depth+1, t)
+		}
+	}
+}
+
+// Adds the text of the content streams of page.
+func (f *pdfFile) pageText(page, resources pdfDict, t *plainText) {
+	streams, ok := f.resolve(page["Contents"]).(pdfArray)
+	if !ok {
+		streams = pdfArray{page["Contents"]}
+	}
+	var data []byte
+	for _, v := range streams {
+		s, ok := f.resolve(v).(*pdfStream)
+		if !ok {
+			continue
+		}
+		// Streams that cannot be decoded are left out
+		if b, err := f.streamData(s); err == nil {
+			data = append(data, b...)
+			data = append(data, '\n')
+		}
+	}
+	fonts, _ := f.resolve(resources["Font"]).(pdfDict)
+	f.contentText(data, fonts, t)
+}
+
+// Adds the text shown by the operators of a content stream.  Lines
+// are guessed from the movements of the text position.
+func (f *pdfFile) contentText(data []byte, fonts pdfDict, t *plainText) {
+	l := &pdfLexer{b: data}
+	var (
+		// Operands of the next operator
+		args []interface{}
+		font *pdfFont
+		// Vertical position of the last text matrix
+		y float64
+	)
+	show := func(v interface{}) {
+		if s, ok := v.(pdfString); ok {
+			t.write(font.text(s))
+		}
+	}
+	for !t.full() {
+		v, err := l.value()
+		if err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			// Skip what is neither an operand nor an operator
+			l.pos++
+			args = args[:0]
+			continue
+		}
+		op, ok := v.(pdfKeyword)
+		if !ok {
+			args = append(args, v)
+			continue
+		}
+		var last interface{}
+		if len(args) > 0 {
+			last = args[len(args)-1]
+		}
+		switch op {
+		case "Tf":
+			if len(args) == 2 {
+				name, _ := args[0].(pdfName)
+				font = f.font(fonts[name])
+			}
+		case "Tj":
+			show(last)
+		case "'", "\"":
+			t.newline()
+			show(last)
+		case "TJ":
+			a, _ := last.(pdfArray)
+			for _, v := range a {
+				// Large adjustments are the spaces between words
+				if n, ok := v.(float64); ok && n < -200 {
+					t.space()
+				}
+				show(v)
+			}
+		case "Td", "TD":
+			if len(args) == 2 {
+				if ty, _ := args[1].(float64); ty != 0 {
+					t.newline()
+				} else {
+					t.space()
+				}
+			}
+		case "T*":
+			t.newline()
+		case "Tm":
+			if ny, ok := last.(float64); ok && len(args) == 6 {
+				if ny != y {
+					t.newline()
+				} else {
+					t.space()
+				}
+				y = ny
+			}
+		case "ID":
+			// Data of inline images ends with EI between spaces
+			for {
+				i := bytes.Index(l.b[l.pos:], []byte("EI"))
+				if i < 0 {
+					return
+				}
+				end := l.pos + i + 2
+				if isPDFSpace(l.b[end-3]) && (end == len(l.b) || isPDFSpace(l.b[end])) {
+					l.pos = end
+					break
+				}
+				l.pos = end
+			}
+		}
+		args = args[:0]
+	}
+}
+
+// Maps the character codes of a font to text.
+type pdfFont struct {
+	// Bytes of each code
+	width int
+	// Text of codes and ranges of codes, from the ToUnicode CMap
+	unicode bool
+	chars   map[uint32]string
+	ranges  []pdfRange
+}
+
+// Range of codes of a CMap
+type pdfRange struct {
+	lo, hi uint32
+	// Text of lo, the last character is incremented for the others
+	base []uint16
+	// Text of each code, instead of base
+	texts []string
+}
+
+// Returns the font of the font dictionary v, read once for each
+// reference.
+func (f *pdfFile) font(v interface{}) *pdfFont {
+	ref, isRef := v.(pdfRef)
+	if font, ok := f.fonts[ref]; isRef && ok {
+		return font
+	}
+	d, ok := f.resolve(v).(pdfDict)
+	if !ok {
+		return nil
+	}
+	// Codes of composite fonts are two bytes, unless the CMap says else
+	font := &pdfFont{width: 1}
+	if f.resolve(d["Subtype"]) == pdfName("Type0") {
+		font.width = 2
+	}
+	if s, ok := f.resolve(d["ToUnicode"]).(*pdfStream); ok {
+		if data, err := f.streamData(s); err == nil {
+			font.readCMap(data)
+		}
+	}
+	if isRef {
+		if f.fonts == nil {
+			f.fonts = make(map[pdfRef]*pdfFont)
+		}
+		f.fonts[ref] = font
+	}
+	return font
+}
+
+// Reads the code space and the text of codes of a ToUnicode CMap.
+func (font *pdfFont) readCMap(data []byte) {
+	font.chars = make(map[uint32]string)
+	l := &pdfLexer{b: data}
+	var args []interface{}
+	for {
+		v, err := l.value()
+		if err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			l.pos++
+			args = args[:0]
+			continue
+		}
+		op, ok := v.(pdfKeyword)
+		if !ok {
+			args = append(args, v)
+			continue
+		}
+		switch op {
+		case "endcodespacerange":
+			// Only the first range, codes of mixed sizes are rare
+			if len(args) < 2 {
+				break
+			}
+			if s, ok := args[0].(pdfString); ok && len(s) >= 1 && len(s) <= 4 {
+				font.width = len(s)
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(args); i += 2 {
+				src, _ := args[i].(pdfString)
+				dst, _ := args[i+1].(pdfString)
+				font.chars[pdfCode(src)] = string(utf16.Decode(utf16Units(dst)))
+				font.unicode = true
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(args); i += 3 {
+				lo, _ := args[i].(pdfString)
+				hi, _ := args[i+1].(pdfString)
+				r := pdfRange{lo: pdfCode(lo), hi: pdfCode(hi)}
+				switch dst := args[i+2].(type) {
+				case pdfString:
+					r.base = utf16Units(dst)
+				case pdfArray:
+					for _, v := range dst {
+						s, _ := v.(pdfString)
+						r.texts = append(r.texts, string(utf16.Decode(utf16Units(s))))
+					}
+				}
+				if r.hi >= r.lo {
+					font.ranges = append(font.ranges, r)
+					font.unicode = true
+				}
+			}
+		}
+		args = args[:0]
+	}
+}
+
+// Returns the code in the bytes of s, big-endian.
+func pdfCode(s pdfString) uint32 {
+	var code uint32
+	for i := 0; i < len(s) && i < 4; i++ {
+		code = code<<8 | uint32(s[i])
+	}
+	return code
+}
+
+// Returns the UTF-16 units of s, big-endian.
+func utf16Units(s pdfString) []uint16 {
+	u := make([]uint16, 0, len(s)/2)
+	for i := 0; i+1 < len(s); i += 2 {
+		u = append(u, uint16(s[i])<<8|uint16(s[i+1]))
+	}
+	return u
+}
+
+// Returns the text of code, and false if the CMap does not map it.
+func (font *pdfFont) lookup(code uint32) (string, bool) {
+	if s, ok := font.chars[code]; ok {
+		return s, true
+	}
+	for _, r := range font.ranges {
+		if code < r.lo || code > r.hi {
+			continue
+		}
+		i := code - r.lo
+		if r.texts != nil {
+			if i < uint32(len(r.texts)) {
+				return r.texts[i], true
+			}
+			return "", false
+		}
+		if len(r.base) == 0 {
+			return "", false
+		}
+		u := append([]uint16(nil), r.base...)
+		u[len(u)-1] += uint16(i)
+		return string(utf16.Decode(u)), true
+	}
+	return "", false
+}
+
+// Returns the text of the codes in string s shown with font.  Without
+// a ToUnicode CMap, codes of simple fonts are taken as WinAnsiEncoding
+// and those of composite fonts, glyph numbers, have no text.
+func (font *pdfFont) text(s pdfString) string {
+	if font == nil || (!font.unicode && font.width == 1) {
+		return winAnsiText([]byte(s))
+	}
+	if !font.unicode {
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i+font.width <= len(s); i += font.width {
+		if u, ok := font.lookup(pdfCode(s[i : i+font.width])); ok {
+			b.WriteString(u)
+		} else if font.width == 1 {
+			b.WriteString(winAnsiText([]byte{s[i]}))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds a PDF file with objects numbered from 1 and a classic
+// cross-reference table, with offsets moved by shift.
+func buildPDF(objects []string, trailer string, shift int) []byte {
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offs := make([]int, len(objects))
+	for i, o := range objects {
+		offs[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	start := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offs {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off+shift)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d %s >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, trailer, start)
+	return []byte(b.String())
+}
+
+var testPDFObjects = []string{
+	"<< /Type /Catalog /Pages 2 0 R >>",
+	"<< /Type /Pages /Kids [3 0 R] /Count 3 /MediaBox [0 0 595.28 841.89] /Rotate 90 >>",
+	"<< /Type /Page /Parent 2 0 R >>",
+	`<< /Title (Annual \(draft\)\r\nreport) /Author <FEFF004A00FC00720067> /Keywords (a, b)
+	   /Producer (Writer) /CreationDate (D:20150304050607+01'00') /ModDate (D:2016) >>`,
+}
+
+func TestPDF(t *testing.T) {
+	data := buildPDF(testPDFObjects, "/Root 1 0 R /Info 4 0 R", 0)
+	m := make(metadata)
+	if err := pdfMeta(&contents{head: data, tail: data, size: int64(len(data))}, m); err != nil {
+		t.Fatal(err)
+	}
+	expect := metadata{
+		// Control characters are removed
+		"title":                     "Annual (draft)\nreport",
+		"creator":                   "Jürg",
+		"keywords":                  "a, b",
+		"creator_tool":              "Writer",
+		"content_creation_date":     fmt.Sprint(time.Date(2015, 3, 4, 4, 6, 7, 0, time.UTC).Unix()),
+		"content_modification_date": fmt.Sprint(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC).Unix()),
+		"pages":                     "3",
+		"width":                     "842",
+		"height":                    "595",
+	}
+	for k, v := range expect {
+		if m[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, m[k])
+		}
+	}
+}
+
+// Builds a PDF file with the catalog in an object stream with header,
+// at index in a cross-reference stream with fields of 8 bytes.
+func buildPDFObjStm(header string, index uint64) []byte {
+	var b strings.Builder
+	b.WriteString("%PDF-1.5\n")
+	objstm := b.Len()
+	data := header + " << /Type /Catalog >>"
+	fmt.Fprintf(&b, "2 0 obj\n<< /Type /ObjStm /N 1 /First %d /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(header)+1, len(data), data)
+	xref := b.Len()
+	var rows []byte
+	for _, row := range [][3]uint64{{0, 0, 0}, {2, 2, index}, {1, uint64(objstm), 0}, {1, uint64(xref), 0}} {
+		rows = append(rows, byte(row[0]))
+		rows = binary.BigEndian.AppendUint64(rows, row[1])
+		rows = binary.BigEndian.AppendUint64(rows, row[2])
+	}
+	fmt.Fprintf(&b, "3 0 obj\n<< /Type /XRef /W [1 8 8] /Size 4 /Root 1 0 R /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(rows), rows)
+	fmt.Fprintf(&b, "startxref\n%d\n%%%%EOF\n", xref)
+	return []byte(b.String())
+}
+
+func TestPDFBroken(t *testing.T) {
+	// Wrong offsets, the objects are found by scanning
+	data := buildPDF(testPDFObjects, "/Root 1 0 R /Info 4 0 R", 7)
+	m := make(metadata)
+	if err := pdfMeta(&contents{head: data, tail: data, size: int64(len(data))}, m); err != nil {
+		t.Fatal(err)
+	}
+	if m["pages"] != "3" || m["creator_tool"] != "Writer" {
+		t.Errorf("unexpected metadata %v", m)
+	}
+	data = buildPDF(testPDFObjects, "/Root 1 0 R /Info 4 0 R /Encrypt << /Filter /Standard >>", 0)
+	m = make(metadata)
+	if err := pdfMeta(&contents{head: data, tail: data, size: int64(len(data))}, m); err != errPDFEncrypted {
+		t.Errorf("expected error %v, got %v", errPDFEncrypted, err)
+	}
+	if m["pages"] != "3" || m["title"] != "" {
+		t.Errorf("unexpected metadata %v", m)
+	}
+}
+
+func TestPDFObjStm(t *testing.T) {
+	data := buildPDFObjStm("1 0", 0)
+	m := make(metadata)
+	if err := pdfMeta(&contents{head: data, tail: data, size: int64(len(data))}, m); err != nil {
+		t.Fatal(err)
+	}
+	// Negative indexes and offsets are not read
+	for _, data := range [][]byte{buildPDFObjStm("1 0", 1<<64-1), buildPDFObjStm("1 -9", 0)} {
+		if err := pdfMeta(&contents{head: data, tail: data, size: int64(len(data))}, make(metadata)); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+}
+
+func pdfStreamObject(data string) string {
+	return fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(data), data)
+}
+
+func TestPDFText(t *testing.T) {
+	data := buildPDF([]string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 7 0 R >>",
+		"<< /Type /Page /Parent 2 0 R /Contents [8 0 R] >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type0 /BaseFont /Subset /ToUnicode 9 0 R >>",
+		pdfStreamObject(`BT /F1 12 Tf 72 720 Td (Caf\351 ) Tj [(au) -250 (lait)] TJ 0 -14 Td (Next) Tj ET`),
+		pdfStreamObject("BT /F2 12 Tf <00010002> Tj ET"),
+		pdfStreamObject("1 begincodespacerange <0000> <FFFF> endcodespacerange\n" +
+			"1 beginbfchar <0001> <0048> endbfchar\n1 beginbfrange <0002> <0003> <0069> endbfrange"),
+	}, "/Root 1 0 R", 0)
+	text := &plainText{max: 100}
+	if err := pdfPlainText(&contents{head: data, tail: data, size: int64(len(data))}, text); err != nil {
+		t.Fatal(err)
+	}
+	if expect := "Caf\u00e9 au lait\nNext\nHi"; text.String() != expect {
+		t.Errorf("expected %q, got %q", expect, text.String())
+	}
+}
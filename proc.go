@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"database/sql"
@@ -13,6 +14,7 @@ import (
 	"fmt"
 	_ "golang.org/x/image/bmp"
 	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 	"hash"
 	"image"
 	_ "image/gif"
@@ -20,11 +22,10 @@ import (
 	_ "image/png"
 	"io"
 	"log"
-	"mime"
 	"net/http"
 	"os"
 	"path"
-    "path/filepath"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -33,53 +34,23 @@ import (
 )
 
 const queryInsertFile = `INSERT INTO sys_file (uid, pid, tstamp, last_indexed, missing, storage, type, metadata,
-	identifier, identifier_hash, folder_hash, extension, mime_type, name, sha1, size, creation_date, modification_date) VALUES
-("UID","0","%d","0","0","1","%d","0","%s","%x","%x","%s","%s","%s","%x","%d","%d","%d");
+	identifier, identifier_hash, folder_hash, extension, mime_type, name, sha1, size, creation_date, modification_date%s) VALUES
+("UID","0","%d","0","0","1","%d","0","%s","%x","%x","%s","%s","%s","%s","%d","%d","%d"%s);
 `
 
-const querySelect = `SELECT f.uid, f.tstamp, f.type, f.identifier, f.identifier_hash,
+const queryUpdateMissing = `UPDATE sys_file SET tstamp="%d", missing="1" WHERE identifier_hash="%x";
+`
+
+const querySelect = `SELECT f.uid, f.tstamp, f.missing, f.type, f.identifier, f.identifier_hash,
 	f.folder_hash, f.extension, f.mime_type, f.name, f.sha1, f.size,
-    m.uid, m.width, m.height
+    m.uid, m.width, m.height, m.title, m.description, m.alternative%s
     FROM sys_file f JOIN sys_file_metadata m ON f.uid=m.file;
 `
 
-const queryInsertMeta = `INSERT INTO sys_file_metadata (tstamp, crdate, file, width, height) VALUES
-("%d","%d","UID","%d","%d");
+const queryInsertMeta = `INSERT INTO sys_file_metadata (tstamp, crdate, file, width, height%s) VALUES
+("%d","%d","UID","%d","%d"%s);
 `
 
-var knownMIME = map[string]string{
-	"xls":      "application/vnd.ms-excel",
-	"doc":      "application/msword",
-	"docx":     "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
-	"pps":      "application/vnd.ms-powerpoint",
-	"ppt":      "application/vnd.ms-powerpoint",
-	"pptm":     "application/vnd.openxmlformats-officedocument.presentationml.presentation",
-	"ods":      "application/vnd.oasis.opendocument.spreadsheet",
-	"odt":      "application/vnd.oasis.opendocument.text",
-	"pptx":     "application/vnd.openxmlformats-officedocument.presentationml.presentation",
-	"xlsx":     "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
-	"xlsm":     "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
-	"docm":     "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
-	"7z":       "application/x-7z-compressed",
-	"exe":      "application/x-dosexec",
-	"mm":       "application/x-freemind",
-	"mdb":      "application/x-msaccess",
-	"rar":      "application/x-rar",
-	"swf":      "application/x-shockwave-flash",
-	"xml":      "application/xml",
-	"wav":      "audio/x-wav",
-	"tif":      "image/tiff",
-	"bmp":      "image/x-ms-bmp",
-	"rtf":      "text/rtf",
-	"mp4":      "video/mp4",
-	"mpg":      "video/mpeg",
-	"mov":      "video/quicktime",
-	"flv":      "video/x-flv",
-	"wmv":      "video/x-ms-asf",
-	"avi":      "video/x-msvideo",
-	"htaccess": "text/plain",
-}
-
 type processor struct {
 	nproc  int
 	delta  delta
@@ -87,29 +58,114 @@ type processor struct {
 	wg     sync.WaitGroup
 	in     <-chan file
 	tools  chan *tools
+	// Files are not processed anymore when ctx is canceled
+	ctx   context.Context
+	abort context.CancelCauseFunc
+	// What to do with files that cannot be read
+	onError string
+	errors  *errorReport
+	// Tracks written records for checkpoints, if not nil
+	track *tracker
+	stats *stats
+	// Files not matching their extension, if not nil
+	mismatches *mismatchReport
+	// Files that should not be in the storage, if not nil
+	audit *auditor
+	// Plain text of documents, if not nil
+	text *textWriter
 }
 
+// Size of the buffer used to read files.
+const readSize = 256 << 10
+
 type tools struct {
 	hash hash.Hash
+	// Additional digests of the contents
+	sums []hash.Hash
 	buf  bytes.Buffer
+	// Buffer for reading files
+	rbuf []byte
+	// Start and end of the file last read
+	capture *capture
+	// Everything the contents are written to
+	sinks []io.Writer
+}
+
+func newTools(useMd5 bool, digests digestList) *tools {
+	t := &tools{
+		sums:    digests.hashes(),
+		rbuf:    make([]byte, readSize),
+		capture: newCapture(headSize, tailSize),
+	}
+	if useMd5 {
+		t.hash = md5.New()
+	} else {
+		t.hash = sha1.New()
+	}
+	t.sinks = append(t.sinks, t.hash)
+	for _, h := range t.sums {
+		t.sinks = append(t.sinks, h)
+	}
+	t.sinks = append(t.sinks, t.capture)
+	return t
+}
+
+// Reads r sequentially once, computing all digests and capturing
+// the head and tail of the contents.  Returns the number of bytes read.
+func (t *tools) read(r io.Reader) (int64, error) {
+	t.hash.Reset()
+	for _, h := range t.sums {
+		h.Reset()
+	}
+	t.capture.reset()
+	var read int64
+	for {
+		n, err := r.Read(t.rbuf)
+		if n > 0 {
+			read += int64(n)
+			// Hashes and captures never fail
+			for _, w := range t.sinks {
+				w.Write(t.rbuf[:n])
+			}
+		}
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// Returns the digest in the sha1 column and the additional ones
+// of the contents last read.
+func (t *tools) digests() ([]byte, [][]byte) {
+	sum := t.hash.Sum(nil)
+	// The hash is also used for names
+	t.hash.Reset()
+	sums := make([][]byte, len(t.sums))
+	for i, h := range t.sums {
+		sums[i] = h.Sum(nil)
+	}
+	return sum, sums
 }
 
-func newProcessor(useMd5 bool, in <-chan file, w *writer, n int, d delta) *processor {
+func newProcessor(useMd5 bool, digests digestList, in <-chan file, w *writer, n int, d delta) *processor {
 	p := &processor{
 		nproc:  n,
 		in:     in,
 		writer: w,
 		delta:  d,
 		tools:  make(chan *tools, n),
+		ctx:    context.Background(),
+		abort:  func(error) {},
+		// Emit records of failed files with an empty hash
+		onError: onErrorFlag,
+		errors:  newErrorReport(nil),
+		stats:   newStats(),
 	}
 	for i := 0; i < n; i++ {
-		t := &tools{buf: bytes.Buffer{}}
-		if useMd5 {
-			t.hash = md5.New()
-		} else {
-			t.hash = sha1.New()
-		}
-		p.tools <- t
+		p.tools <- newTools(useMd5, digests)
 	}
 	return p
 }
@@ -118,26 +174,80 @@ func (p *processor) runOne() {
 	defer p.wg.Done()
 	useDelta := len(p.delta) > 0
 	for f := range p.in {
+		// When stopped, only drain the remaining files
+		if p.ctx.Err() != nil {
+			continue
+		}
 		var done bool
+		start := time.Now()
 		// Get one of the available tool structs
 		tools := <-p.tools
 		// Init basic data for this prop
 		name := f.name()
+		// Deleted files only produce a record marking them as missing
+		if f.deleted {
+			pr := newMissingProps(tools.hash, name)
+			p.writer.write(pr.marshal(&tools.buf))
+			p.stats.processed.Add(1)
+			p.tools <- tools
+			continue
+		}
 		pr := newProps(tools.hash, f, name)
+		if !p.audit.check(pr.fname, &f) {
+			p.track.release(f.path)
+			p.stats.processed.Add(1)
+			p.tools <- tools
+			continue
+		}
+		// When resuming, files can be already written
+		if p.track.wasWritten(pr.ident) {
+			p.track.release(f.path)
+			p.stats.processed.Add(1)
+			p.tools <- tools
+			continue
+		}
 		// If in delta mode, see if there is a cached delta entry
 		if useDelta {
 			entry := p.delta[pr.ident]
 			// If we have an entry and it's modtime is unchanged, use cached entry
-			if entry != nil && f.ModTime().Unix() == entry.mtime {
+			if entry != nil && entry.valid(f.ModTime().Unix()) {
 				p.writer.write(fmt.Sprintf("%s\n%s\n", entry.file, entry.meta))
+				p.track.release(f.path)
+				p.stats.hits.Add(1)
 				done = true
+			} else {
+				p.stats.misses.Add(1)
 			}
 		}
 		// Do the normal work to create a new prop then write it
 		if !done {
-			pr.load(tools.hash, name)
+			err := pr.load(tools, name, p.stats, p.text)
+			if err == nil || !err.failed() {
+				p.mismatches.check(pr.fname, pr.ext, tools.capture.head)
+			}
+			if err != nil {
+				p.errors.add(err)
+				if err.failed() {
+					switch p.onError {
+					case onErrorSkip:
+						p.track.release(f.path)
+						done = true
+					case onErrorAbort:
+						// Not released: it will be retried on resume
+						p.abort(fmt.Errorf("aborted after error: %w", err))
+						done = true
+					default:
+						pr.failed = true
+					}
+				}
+			}
+		}
+		if !done {
 			p.writer.write(pr.marshal(&tools.buf))
+			p.track.release(f.path)
 		}
+		p.stats.processed.Add(1)
+		p.stats.latency.observe(time.Since(start))
 		// Free up this tool struct for another worker
 		p.tools <- tools
 	}
@@ -167,36 +277,17 @@ func strhash(data string, h hash.Hash) []byte {
 	return h.Sum(nil)
 }
 
-func filehash(name string, h hash.Hash, r io.Reader) []byte {
-	defer h.Reset()
-	if _, err := io.Copy(h, r); err != nil {
-		log.Print(name, ": Copy to SHA1: ", err)
-		return nil
-	}
-	return h.Sum(nil)
-}
-
 func guessMIME(ext string) string {
-	ext = strings.ToLower(ext)
-	if m, ok := knownMIME[ext]; ok {
-		return m
-	}
-	return mime.TypeByExtension(ext)
+	return mimeTypes.lookup(ext)
 }
 
-func sniffMIME(name string, r *os.File) string {
-	if _, err := r.Seek(0, 0); err != nil {
-		log.Print(name, ": Seek: ", err)
-		return ""
-	}
-	buf := make([]byte, 255)
-	n, err := r.Read(buf)
-	if n == 0 && err != nil {
-		log.Print(name, ": Read: ", err)
-		return ""
-	}
-	mimetype := http.DetectContentType(buf)
-	n = strings.Index(mimetype, "; ")
+// Detects the MIME type from the start of the contents.  Only the
+// first 255 bytes are used, padded with zeros for shorter files.
+func sniffMIME(head []byte) string {
+	var buf [255]byte
+	copy(buf[:], head)
+	mimetype := http.DetectContentType(buf[:])
+	n := strings.Index(mimetype, "; ")
 	if n >= 0 {
 		mimetype = mimetype[:n]
 	}
@@ -215,6 +306,8 @@ type props struct {
 	dident digest
 	// SHA1 hash of file contents
 	chash digest
+	// Additional digests of the contents, in the order of -digests
+	sums [][]byte
 	// Full filename
 	fname string
 	// Basename
@@ -227,6 +320,8 @@ type props struct {
 	mime string
 	// If image, width x height
 	isize image.Point
+	// Metadata extracted from the contents
+	meta metadata
 	// File size in bytes
 	size int64
 	// Type of file
@@ -235,6 +330,10 @@ type props struct {
 	modtime time.Time
 	// Creation time (of this structure)
 	ctime time.Time
+	// File does not exist anymore
+	missing bool
+	// File could not be read, content hash is not valid
+	failed bool
 }
 
 func mapType(mime string) int {
@@ -284,52 +383,175 @@ func newProps(h hash.Hash, f file, name string) *props {
 	return p
 }
 
-// Slower operations to fill props struct
-func (p *props) load(h hash.Hash, name string) {
+// Props of a file that was deleted
+func newMissingProps(h hash.Hash, name string) *props {
+	fname := path.Clean(name)
+	dir := filepath.Dir(fname)
+	now := time.Now()
+	p := &props{
+		modtime: now,
+		ctime:   now,
+		fname:   fname,
+		ext:     fileExt(fname),
+		dir:     dir,
+		bname:   filepath.Base(fname),
+		missing: true,
+	}
+	copy(p.ident[:], strhash(fname, h))
+	copy(p.dident[:], strhash(dir, h))
+	return p
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Slower operations to fill props struct, and to write the plain text
+// of documents if text is not nil.  Returns an error if the file could
+// not be read or its content could not be decoded.
+func (p *props) load(t *tools, name string, s *stats, text *textWriter) *fileError {
+	h := t.hash
+	copy(p.dident[:], strhash(p.dir, h))
 	// Empty files always have this special MIME type
 	if p.size == 0 {
 		p.mime = "inode/x-empty"
-	} else {
+	} else if *mimeMode == mimeExtension {
 		p.mime = guessMIME(p.ext)
 	}
-	r, err := os.Open(name)
+	p.ftype = mapType(p.mime)
+	f, err := os.Open(name)
 	if err != nil {
-		log.Print(name, ": Props: ", err)
-		return
+		return newFileError(name, stageOpen, "open", err)
+	}
+	defer f.Close()
+	s.stage(stageOpen).add(0)
+	// The file is read only once: everything else
+	// works on the captured head of the contents.
+	n, err := t.read(f)
+	s.stage(stageHash).add(n)
+	if err != nil {
+		return newFileError(name, stageHash, "read", err)
+	}
+	sum, sums := t.digests()
+	copy(p.chash[:], sum)
+	p.sums = sums
+	head := t.capture.head
+	// Contents are trusted more than the extension, unless
+	// they are not known.
+	if *mimeMode == mimeContent && p.size > 0 {
+		p.mime = detectMIME(head)
+		if p.mime == "" {
+			p.mime = guessMIME(p.ext)
+		}
+		p.ftype = mapType(p.mime)
+		s.stage(stageSniff).add(int64(len(head)))
 	}
-	defer r.Close()
 	// If the extension is empty, we need to detect
 	// the MIME type via file contents
 	if p.mime == "" {
-		p.mime = sniffMIME(name, r)
+		p.mime = sniffMIME(head)
+		p.ftype = mapType(p.mime)
+		s.stage(stageSniff).add(int64(len(head)))
 	}
-	p.ftype = mapType(p.mime)
-	if _, err := r.Seek(0, 0); err != nil {
-		log.Print(name, ": Seek: ", err)
-		return
+	// Metadata of known formats, from the start and end of the contents
+	// and from sidecar files, which take precedence
+	var ferr *fileError
+	if _, ok := extractors[p.mime]; ok {
+		p.meta = make(metadata)
+		if err := readSidecar(name, p.meta); err != nil {
+			ferr = newFileError(name, stageMeta, "sidecar", err)
+		}
+		if err := p.extract(t.capture.contents(f)); err != nil && ferr == nil {
+			ferr = newFileError(name, stageMeta, "extract", err)
+		}
+		if size, ok := p.meta.size(); ok {
+			p.isize = size
+		}
+		s.stage(stageMeta).add(int64(len(head)))
+	}
+	// Plain text for full-text search
+	if text != nil && textExtractorOf(p.mime) != nil {
+		n, err := text.extract(p, t.capture.contents(f))
+		if err != nil && ferr == nil {
+			ferr = newFileError(name, stageText, "extract", err)
+		}
+		s.stage(stageText).add(int64(n))
 	}
-	// TODO: this is quite unreadable
-	copy(p.chash[:], filehash(name, h, r))
-	copy(p.dident[:], strhash(p.dir, h))
 	// Non-images are completely processed at this point
 	if !strings.HasPrefix(p.mime, "image/") {
-		return
+		return ferr
+	}
+	// Vector images are not decoded, their size is read as metadata
+	if p.mime == "image/svg+xml" {
+		return ferr
 	}
 	// Image-specific processing
-	if _, err := r.Seek(0, 0); err != nil {
-		log.Print(name, ": Seek: ", err)
-		return
+	imgconf, _, err := image.DecodeConfig(bytes.NewReader(head))
+	// Headers can be after the head, like the IFD that TIFF encoders
+	// write after the pixels: those are read from the file.
+	if err != nil && !t.capture.complete() {
+		imgconf, _, err = image.DecodeConfig(io.NewSectionReader(f, 0, p.size))
 	}
-	imgconf, _, err := image.DecodeConfig(r)
+	s.stage(stageImage).add(int64(len(head)))
 	if err != nil {
-		log.Print(name, ": Image decoder: ", err)
-		return
+		return newFileError(name, stageImage, "decode", err)
 	}
 	p.isize = image.Point{imgconf.Width, imgconf.Height}
+	if p.meta == nil {
+		p.meta = make(metadata)
+	}
+	p.meta.set("color_space", colorSpace(imgconf.ColorModel))
+	// Rotated by a quarter turn, width and height are swapped
+	switch p.meta["orientation"] {
+	case "5", "6", "7", "8":
+		p.isize.X, p.isize.Y = p.isize.Y, p.isize.X
+	}
+	return ferr
+}
+
+// Content hash, empty if the file could not be read
+func (p *props) sum() string {
+	if p.failed {
+		return ""
+	}
+	return fmt.Sprintf("%x", p.chash)
+}
+
+// Additional digests as quoted CSV fields, each preceded by a comma.
+// Digests are empty if the file could not be read.
+func (p *props) sumFields() string {
+	var b strings.Builder
+	for i := range extraDigests {
+		b.WriteString(`,"`)
+		if !p.failed && i < len(p.sums) {
+			fmt.Fprintf(&b, "%x", p.sums[i])
+		}
+		b.WriteString(`"`)
+	}
+	return b.String()
 }
 
+// Names of the columns of the additional digests for SQL statements.
+func sumColumns() string {
+	var b strings.Builder
+	for _, name := range extraDigests {
+		fmt.Fprintf(&b, ", %s", name)
+	}
+	return b.String()
+}
+
+// Version of the format of the normal mode output, written at its start.
+// Outputs of earlier versions, without it, only have quotes escaped.
+const outputFormat = "2"
+
+// Escapes like MySQL expects in strings and in LOAD DATA.
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\x00", `\0`)
+
 func escape(s string) string {
-	return strings.Replace(s, `"`, `\"`, -1)
+	return escaper.Replace(s)
 }
 
 func (p *props) marshal(w *bytes.Buffer) string {
@@ -345,20 +567,56 @@ func (p *props) marshal(w *bytes.Buffer) string {
 	return w.String()
 }
 
+// Writes a line with information about the run, before all records.
+// Single mode has no such line.
+func writeInfo(w io.Writer, key, value string) {
+	switch true {
+	case *singleMode:
+	case *sqlMode:
+		fmt.Fprintf(w, "-- %s: %s\n", key, value)
+	default:
+		fmt.Fprintf(w, "info:\"%s\",\"%s\"\n", key, value)
+	}
+}
+
+// Writes the info lines that start the output: the versions of the
+// format and of the MIME types, and the additional columns.  Outputs
+// used as delta must start with them to be read correctly.
+func writeHeader(w io.Writer) {
+	writeInfo(w, "format", outputFormat)
+	writeInfo(w, "mime_types", mimeTypes.version)
+	if len(extraDigests) > 0 {
+		writeInfo(w, "digests", extraDigests.String())
+	}
+	if len(metaColumns) > 0 {
+		writeInfo(w, "meta_columns", metaColumns.String())
+	}
+}
+
 // Single mode writes a single condensed line.  Used for debugging comparison with tester/tester.
 func (p *props) writeSingle(w io.Writer) {
-	fmt.Fprintf(w, `"0","0","1","%d","0","%s",`, p.ftype, escape(p.fname))
+	fmt.Fprintf(w, `"0","%d","1","%d","0","%s",`, boolInt(p.missing), p.ftype, escape(p.fname))
 	fmt.Fprintf(w, `"%x","%x",`, p.ident, p.dident)
 	fmt.Fprintf(w, `"%s","%s","%s",`, p.ext, p.mime, escape(p.bname))
-	fmt.Fprintf(w, `"%x",`, p.chash)
-	fmt.Fprintf(w, "\"%d\",\"%d\",\"%d\"\n", p.size, p.isize.X, p.isize.Y)
+	fmt.Fprintf(w, `"%s",`, p.sum())
+	fmt.Fprintf(w, "\"%d\",\"%d\",\"%d\"%s%s\n", p.size, p.isize.X, p.isize.Y, p.sumFields(), p.metaValues())
 }
 
 func (p *props) writeSQL(w io.Writer) {
-	fmt.Fprintf(w, queryInsertFile, p.ctime.Unix(), p.ftype, escape(p.fname),
-		p.ident, p.dident, p.ext, p.mime, escape(p.bname), p.chash, p.size,
-		p.ctime.Unix(), p.modtime.Unix())
-	fmt.Fprintf(w, queryInsertMeta, p.modtime.Unix(), p.ctime.Unix(), p.isize.X, p.isize.Y)
+	if p.missing {
+		fmt.Fprintf(w, queryUpdateMissing, p.ctime.Unix(), p.ident)
+		return
+	}
+	// Stock TYPO3 has no columns for the additional digests
+	var sumCols, sumVals string
+	if *digestColumns {
+		sumCols, sumVals = sumColumns(), p.sumFields()
+	}
+	fmt.Fprintf(w, queryInsertFile, sumCols, p.ctime.Unix(), p.ftype, escape(p.fname),
+		p.ident, p.dident, p.ext, p.mime, escape(p.bname), p.sum(), p.size,
+		p.ctime.Unix(), p.modtime.Unix(), sumVals)
+	cols, vals := p.metaSQL()
+	fmt.Fprintf(w, queryInsertMeta, cols, p.modtime.Unix(), p.ctime.Unix(), p.isize.X, p.isize.Y, vals)
 }
 
 func (p *props) writeNormal(w io.Writer) {
@@ -371,18 +629,18 @@ func (p *props) writeNormal(w io.Writer) {
 		metaUid = fmt.Sprintf("%d", p.metaUid)
 	}
 	// Write file entry
-	fmt.Fprintf(w, `file:"%s","0","%d","0","0","1","%d","0","`, uid, p.ctime.Unix(), p.ftype)
+	fmt.Fprintf(w, `file:"%s","0","%d","0","%d","1","%d","0","`, uid, p.ctime.Unix(), boolInt(p.missing), p.ftype)
 	io.WriteString(w, escape(p.fname))
 	fmt.Fprintf(w, `","%x","%x",`, p.ident, p.dident)
 	fmt.Fprintf(w, `"%s","%s","`, p.ext, p.mime)
 	io.WriteString(w, escape(p.bname))
-	fmt.Fprintf(w, `","%x","%d",`, p.chash, p.size)
-	fmt.Fprintf(w, "\"%d\",\"%d\"\n", p.ctime.Unix(), p.modtime.Unix())
+	fmt.Fprintf(w, `","%s","%d",`, p.sum(), p.size)
+	fmt.Fprintf(w, "\"%d\",\"%d\"%s\n", p.ctime.Unix(), p.modtime.Unix(), p.sumFields())
 	// Write metadata
 	fmt.Fprintf(w, `meta:"%s","0","%d","%d","0","0","0","",`, metaUid, p.modtime.Unix(), p.ctime.Unix())
 	io.WriteString(w, `"0","0","0","","0","0","0","0","0","0",`)
-	fmt.Fprintf(w, `"%s","","%d","%d",`, uid, p.isize.X, p.isize.Y)
-	io.WriteString(w, "\"\",\"\",\"0\"\n")
+	fmt.Fprintf(w, `"%s","%s","%d","%d",`, uid, escape(p.meta["title"]), p.isize.X, p.isize.Y)
+	fmt.Fprintf(w, "\"%s\",\"%s\",\"0\"%s\n", escape(p.meta["description"]), escape(p.meta["alternative"]), p.metaValues())
 }
 
 func dumpDatabase(dsn string, w io.Writer) error {
@@ -390,12 +648,25 @@ func dumpDatabase(dsn string, w io.Writer) error {
 	if err != nil {
 		return fmt.Errorf("cannot open DB: %s", err)
 	}
-	rows, err := db.Query(querySelect)
+	if len(extraDigests) > 0 && !*digestColumns {
+		return fmt.Errorf("cannot read the additional digests from sys_file without -digest-columns")
+	}
+	// The output can be used as a delta with the same columns
+	writeHeader(w)
+	var cols strings.Builder
+	for _, c := range metaColumns {
+		fmt.Fprintf(&cols, ", m.%s", c.column)
+	}
+	for _, name := range extraDigests {
+		fmt.Fprintf(&cols, ", f.%s", name)
+	}
+	rows, err := db.Query(fmt.Sprintf(querySelect, cols.String()))
 	if err != nil {
 		return fmt.Errorf("cannot execute query: %s", err)
 	}
 	defer rows.Close()
 	p := &props{}
+	values := make([]sql.NullString, len(builtinColumns)+len(metaColumns)+len(extraDigests))
 	for rows.Next() {
 		var (
 			tstamp int64
@@ -403,11 +674,34 @@ func dumpDatabase(dsn string, w io.Writer) error {
 			dident string
 			chash  string
 		)
-		if err := rows.Scan(&p.uid, &tstamp, &p.ftype, &p.fname, &ident,
+		dest := []interface{}{&p.uid, &tstamp, &p.missing, &p.ftype, &p.fname, &ident,
 			&dident, &p.ext, &p.mime, &p.bname, &chash, &p.size,
-			&p.metaUid, &p.isize.X, &p.isize.Y); err != nil {
+			&p.metaUid, &p.isize.X, &p.isize.Y}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
 			return fmt.Errorf("reading row failed: %s", err)
 		}
+		p.meta = make(metadata)
+		for i, c := range builtinColumns {
+			if values[i].Valid {
+				p.meta[c] = values[i].String
+			}
+		}
+		for i, c := range metaColumns {
+			if v := values[len(builtinColumns)+i]; v.Valid {
+				p.meta[c.field] = v.String
+			}
+		}
+		p.sums = p.sums[:0]
+		for i := range extraDigests {
+			sum, err := hex.DecodeString(values[len(builtinColumns)+len(metaColumns)+i].String)
+			if err != nil {
+				return fmt.Errorf("parsing %s digest of %s: %s", extraDigests[i], p.fname, err)
+			}
+			p.sums = append(p.sums, sum)
+		}
 		// Adapt some fields to internal representation. Quite wasteful, but OK for now.
 		p.ctime = time.Unix(tstamp, 0)
 		p.modtime = p.ctime
@@ -426,6 +720,7 @@ func dumpDatabase(dsn string, w io.Writer) error {
 			return fmt.Errorf("parsing %s: %s", chash, err)
 		}
 		copy(p.chash[:], hash)
+		p.failed = chash == ""
 		// Write the CSV normal double entry
 		p.writeNormal(w)
 	}
@@ -4,7 +4,20 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
 
 func TestMapFtype(t *testing.T) {
 	var equivs = []struct {
@@ -24,3 +37,95 @@ func TestMapFtype(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadTIFFSize(t *testing.T) {
+	// The IFD is written after the pixels, beyond the captured head
+	name := filepath.Join(t.TempDir(), "large.tif")
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tiff.Encode(out, image.NewRGBA(image.Rect(0, 0, 600, 500)), nil); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	finfo, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Size() <= headSize {
+		t.Fatalf("expected a file larger than the head, got %d bytes", finfo.Size())
+	}
+	tl := newTools(false, nil)
+	p := newProps(tl.hash, makeFile(finfo, name), name)
+	if ferr := p.load(tl, name, newStats(), nil); ferr != nil {
+		t.Fatal(ferr)
+	}
+	if p.isize.X != 600 || p.isize.Y != 500 {
+		t.Errorf("expected 600x500, got %dx%d", p.isize.X, p.isize.Y)
+	}
+}
+
+func TestInterruptDrains(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for d := 0; d < 20; d++ {
+		for f := 0; f < 10; f++ {
+			names = append(names, fmt.Sprintf("d%02d/f%d.txt", d, f))
+		}
+	}
+	makeTree(t, dir, names...)
+	root := filepath.ToSlash(dir)
+	// Interrupt like on a signal, in the middle of the scan
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	idx := newIndexer(1, 0, 10)
+	var dirs atomic.Int32
+	idx.onDir = func(string) {
+		if dirs.Add(1) == 5 {
+			cancel(errInterrupted)
+		}
+	}
+	var out bytes.Buffer
+	w := newWriter(&out, false, 1, 1)
+	var header bytes.Buffer
+	writeHeader(&header)
+	w.header(header.String())
+	go w.run()
+	p := newProcessor(false, nil, idx.sink(), w, 4, nil)
+	p.ctx = ctx
+	p.abort = cancel
+	p.run()
+	scanErr := idx.scan(ctx, []string{root}, 4)
+	p.wait()
+	if !errors.Is(scanErr, context.Canceled) || context.Cause(ctx) != errInterrupted {
+		t.Fatalf("expected the scan to be interrupted, got %v, cause %v", scanErr, context.Cause(ctx))
+	}
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+	if w.count == 0 || w.count >= len(names) {
+		t.Errorf("expected some of %d records, got %d", len(names), w.count)
+	}
+	r := newRecordReader(bytes.NewReader(out.Bytes()))
+	var n int
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("record %d: %s", n+1, err)
+		}
+		if _, err := os.Stat(rec.fileFields[8]); err != nil {
+			t.Errorf("record of unknown file: %s", err)
+		}
+		n++
+	}
+	if n != w.count {
+		t.Errorf("expected %d records, got %d", w.count, n)
+	}
+	if r.legacy() {
+		t.Error("output without header")
+	}
+}
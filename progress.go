@@ -0,0 +1,97 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Reports the progress of a run.
+type progress struct {
+	stats *stats
+	idx   *indexer
+	// Expected number of files, zero if unknown
+	total int
+	start time.Time
+	w     io.Writer
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newProgress(s *stats, idx *indexer, total int, w io.Writer) *progress {
+	return &progress{
+		stats: s,
+		idx:   idx,
+		total: total,
+		start: time.Now(),
+		w:     w,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Prints the progress every interval, and immediately every time
+// a snapshot is requested, until finish is called.
+func (p *progress) run(every time.Duration, snapshot <-chan struct{}) {
+	defer close(p.done)
+	var tick <-chan time.Time
+	if every > 0 {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			p.print()
+		case <-snapshot:
+			p.print()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *progress) print() {
+	elapsed := time.Since(p.start)
+	found := p.stats.found.Load()
+	processed := p.stats.processed.Load()
+	hashed := p.stats.stage(stageHash).bytes.Load()
+	fmt.Fprintf(p.w, "Progress: %d directories pending, %d files found, %d processed (%d cached, %d not cached), %s hashed at %s/s, elapsed %s, ETA %s\n",
+		p.idx.pending(), found, processed, p.stats.hits.Load(), p.stats.misses.Load(),
+		formatBytes(hashed), formatBytes(int64(float64(hashed)/elapsed.Seconds())),
+		elapsed.Round(time.Second), p.eta(processed, elapsed))
+}
+
+// Estimates the remaining time from the number of files in the
+// delta.  The estimate is unknown without delta or once more files
+// than expected were processed.
+func (p *progress) eta(processed int64, elapsed time.Duration) string {
+	if p.total == 0 || processed == 0 || processed >= int64(p.total) {
+		return "unknown"
+	}
+	left := time.Duration(float64(elapsed) / float64(processed) * float64(int64(p.total)-processed))
+	return left.Round(time.Second).String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
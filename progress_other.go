@@ -0,0 +1,12 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+
+package main
+
+// There is no signal to request a snapshot on this platform.
+func notifySnapshot() <-chan struct{} {
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1 << 20, "1.0 MiB"},
+		{5 << 30, "5.0 GiB"},
+		{1 << 62, "4.0 EiB"},
+	}
+	for _, test := range tests {
+		if s := formatBytes(test.n); s != test.expected {
+			t.Errorf("%d: expected %q got %q", test.n, test.expected, s)
+		}
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	tests := []struct {
+		total     int
+		processed int64
+		elapsed   time.Duration
+		expected  string
+	}{
+		{0, 10, time.Minute, "unknown"},
+		{100, 0, time.Minute, "unknown"},
+		{100, 100, time.Minute, "unknown"},
+		{100, 150, time.Minute, "unknown"},
+		{100, 25, time.Minute, "3m0s"},
+		{3, 1, 1500 * time.Millisecond, "3s"},
+	}
+	for _, test := range tests {
+		p := &progress{total: test.total}
+		if s := p.eta(test.processed, test.elapsed); s != test.expected {
+			t.Errorf("%d of %d in %s: expected %q got %q", test.processed, test.total, test.elapsed, test.expected, s)
+		}
+	}
+}
+
+func TestProgressPrint(t *testing.T) {
+	s := newStats()
+	s.found.Add(10)
+	s.processed.Add(4)
+	s.hits.Add(3)
+	s.misses.Add(1)
+	s.stage(stageHash).add(2048)
+	i := newIndexer(1, 0, 10)
+	i.depth.Store(2)
+	var out strings.Builder
+	p := newProgress(s, i, 8, &out)
+	p.start = time.Now().Add(-time.Minute)
+	p.print()
+	expected := "Progress: 2 directories pending, 10 files found, 4 processed (3 cached, 1 not cached), 2.0 KiB hashed at "
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("expected prefix %q, got %q", expected, out.String())
+	}
+	if !strings.Contains(out.String(), ", elapsed 1m0s, ETA 1m0s\n") {
+		t.Errorf("unexpected elapsed time or ETA: %q", out.String())
+	}
+}
+
+func TestProgressSnapshot(t *testing.T) {
+	var out strings.Builder
+	p := newProgress(newStats(), newIndexer(1, 0, 10), 0, &out)
+	snapshot := make(chan struct{})
+	go p.run(0, snapshot)
+	snapshot <- struct{}{}
+	snapshot <- struct{}{}
+	p.finish()
+	if n := strings.Count(out.String(), "Progress: "); n != 2 {
+		t.Errorf("expected a progress line for each snapshot, got %q", out.String())
+	}
+}
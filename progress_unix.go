@@ -0,0 +1,26 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Returns a channel that receives a value every time SIGUSR1 is received.
+func notifySnapshot() <-chan struct{} {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	c := make(chan struct{})
+	go func() {
+		for range sigs {
+			c <- struct{}{}
+		}
+	}()
+	return c
+}
@@ -0,0 +1,125 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// FIFO queue of directories to scan.  At most max directories are
+// kept in memory, the others are spilled to a temporary file.
+type dirQueue struct {
+	max  int
+	mem  []string
+	head int
+	// Temporary file, created at the first spill
+	file *os.File
+	w    *bufio.Writer
+	// Offsets of the next entry to read and write
+	roff, woff int64
+	// Number of entries in the file not yet read back
+	spilled int
+}
+
+func newDirQueue(max int) *dirQueue {
+	if max < 1 {
+		max = 1
+	}
+	return &dirQueue{max: max}
+}
+
+func (q *dirQueue) len() int {
+	return len(q.mem) - q.head + q.spilled
+}
+
+func (q *dirQueue) push(dir string) error {
+	// Once something is spilled, everything after it must
+	// be spilled too to keep the order.
+	if q.spilled == 0 && len(q.mem)-q.head < q.max {
+		// Reuse the space of directories already popped.
+		if q.head > 0 && len(q.mem) == cap(q.mem) {
+			n := copy(q.mem, q.mem[q.head:])
+			q.mem, q.head = q.mem[:n], 0
+		}
+		q.mem = append(q.mem, dir)
+		return nil
+	}
+	if q.file == nil {
+		f, err := os.CreateTemp("", "sys-file-indexer-queue-")
+		if err != nil {
+			return err
+		}
+		q.file = f
+		q.w = bufio.NewWriter(f)
+	}
+	// Names cannot contain NUL, so it's a safe separator.
+	if _, err := q.w.WriteString(dir); err != nil {
+		return err
+	}
+	if err := q.w.WriteByte(0); err != nil {
+		return err
+	}
+	q.woff += int64(len(dir)) + 1
+	q.spilled++
+	return nil
+}
+
+// Returns the first directory in the queue without removing it.
+func (q *dirQueue) peek() (string, error) {
+	if len(q.mem) == 0 {
+		if err := q.refill(); err != nil {
+			return "", err
+		}
+	}
+	return q.mem[q.head], nil
+}
+
+func (q *dirQueue) pop() {
+	q.mem[q.head] = ""
+	q.head++
+	if q.head == len(q.mem) {
+		q.mem, q.head = q.mem[:0], 0
+	}
+}
+
+// Reads back spilled entries into memory.
+func (q *dirQueue) refill() error {
+	if err := q.w.Flush(); err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(q.file, q.roff, q.woff-q.roff))
+	for len(q.mem) < q.max && q.spilled > 0 {
+		dir, err := r.ReadString(0)
+		if err != nil {
+			return err
+		}
+		q.mem = append(q.mem, dir[:len(dir)-1])
+		q.roff += int64(len(dir))
+		q.spilled--
+	}
+	// Everything was read back: start over with an empty file.
+	if q.spilled == 0 {
+		if err := q.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := q.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		q.w.Reset(q.file)
+		q.roff, q.woff = 0, 0
+	}
+	return nil
+}
+
+// Removes the temporary file, if any.
+func (q *dirQueue) close() error {
+	if q.file == nil {
+		return nil
+	}
+	q.file.Close()
+	return os.Remove(q.file.Name())
+}
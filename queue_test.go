@@ -0,0 +1,48 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDirQueueSpill(t *testing.T) {
+	q := newDirQueue(3)
+	defer q.close()
+	var next, last int
+	push := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := q.push(fmt.Sprintf("dir%d", last)); err != nil {
+				t.Fatal(err)
+			}
+			last++
+		}
+	}
+	pop := func(n int) {
+		for i := 0; i < n; i++ {
+			dir, err := q.peek()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := fmt.Sprintf("dir%d", next); dir != expected {
+				t.Fatalf("expected %s got %s", expected, dir)
+			}
+			q.pop()
+			next++
+		}
+	}
+	push(10)
+	pop(4)
+	push(5)
+	pop(8)
+	push(2)
+	pop(5)
+	if q.len() != 0 {
+		t.Errorf("expected empty queue, got %d entries", q.len())
+	}
+	push(7)
+	pop(7)
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Stages of processing where a file can fail
+const (
+	stageScan  = "scan"
+	stageOpen  = "open"
+	stageSniff = "sniff"
+	stageHash  = "hash"
+	stageImage = "image"
+	stageMeta  = "metadata"
+	stageText  = "text"
+)
+
+// Policies for files that could not be read
+const (
+	onErrorSkip  = "skip"
+	onErrorFlag  = "flag"
+	onErrorAbort = "abort"
+)
+
+func validErrorPolicy(s string) bool {
+	switch s {
+	case onErrorSkip, onErrorFlag, onErrorAbort:
+		return true
+	}
+	return false
+}
+
+// Error while processing a single file or directory
+type fileError struct {
+	path  string
+	stage string
+	op    string
+	err   error
+}
+
+func newFileError(path, stage, op string, err error) *fileError {
+	// Operation from the OS error is more precise
+	var perr *fs.PathError
+	if errors.As(err, &perr) {
+		op = perr.Op
+	}
+	return &fileError{path, stage, op, err}
+}
+
+func (e *fileError) Error() string {
+	// OS errors already contain the operation and the path
+	var perr *fs.PathError
+	if errors.As(e.err, &perr) {
+		return fmt.Sprintf("%s: %s", e.stage, e.err)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", e.path, e.stage, e.op, e.err)
+}
+
+func (e *fileError) Unwrap() error {
+	return e.err
+}
+
+// Returns true if the content of the file could not be read.
+// Errors decoding the content do not make a file fail.
+func (e *fileError) failed() bool {
+	return e.stage != stageImage && e.stage != stageMeta && e.stage != stageText
+}
+
+// Collects all errors, optionally writing them as CSV.
+type errorReport struct {
+	mu     sync.Mutex
+	w      *csv.Writer
+	counts map[string]int
+	failed int
+}
+
+func newErrorReport(w io.Writer) *errorReport {
+	r := &errorReport{counts: make(map[string]int)}
+	if w != nil {
+		r.w = csv.NewWriter(w)
+		r.w.Write([]string{"path", "stage", "op", "errno", "error"})
+	}
+	return r
+}
+
+func (r *errorReport) add(e *fileError) {
+	log.Print(e)
+	var errno syscall.Errno
+	var num string
+	if errors.As(e.err, &errno) {
+		num = strconv.Itoa(int(errno))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[e.stage]++
+	if e.failed() {
+		r.failed++
+	}
+	if r.w != nil {
+		r.w.Write([]string{e.path, e.stage, e.op, num, e.err.Error()})
+	}
+}
+
+// Number of errors in each stage.
+func (r *errorReport) stageCounts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int, len(r.counts))
+	for s, n := range r.counts {
+		counts[s] = n
+	}
+	return counts
+}
+
+// Number of files and directories that could not be read.
+func (r *errorReport) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+func (r *errorReport) flush() error {
+	if r.w == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// Writes the number of errors for each stage.
+func (r *errorReport) summary(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.counts) == 0 {
+		return
+	}
+	stages := make([]string, 0, len(r.counts))
+	for s := range r.counts {
+		stages = append(stages, s)
+	}
+	sort.Strings(stages)
+	fmt.Fprintf(w, "Failed files and directories: %d\n", r.failed)
+	for _, s := range stages {
+		fmt.Fprintf(w, "Errors in stage %s: %d\n", s, r.counts[s])
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestErrorReportCSV(t *testing.T) {
+	var out bytes.Buffer
+	r := newErrorReport(&out)
+	r.add(newFileError("/x/missing", stageOpen, "read", &fs.PathError{Op: "open", Path: "/x/missing", Err: syscall.ENOENT}))
+	r.add(newFileError("a,b.jpg", stageImage, "decode", errors.New(`bad "size", truncated`)))
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "path,stage,op,errno,error\n" +
+		"/x/missing,open,open,2,open /x/missing: no such file or directory\n" +
+		`"a,b.jpg",image,decode,,"bad ""size"", truncated"` + "\n"
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+	// Decoding errors do not make the file fail
+	if r.count() != 1 {
+		t.Errorf("expected 1 failed file, got %d", r.count())
+	}
+}
+
+// Processes a readable and an unreadable file with policy onError and
+// returns the records written and the exit error.
+func runPolicy(t *testing.T, onError string, maxErrors int) (string, error) {
+	dir := t.TempDir()
+	makeTree(t, dir, "good.txt", "gone.txt")
+	var files []file
+	for _, name := range []string{"good.txt", "gone.txt"} {
+		name = filepath.Join(dir, name)
+		finfo, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, makeFile(finfo, name))
+	}
+	if err := os.Remove(files[1].name()); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan file, len(files))
+	for _, f := range files {
+		in <- f
+	}
+	close(in)
+	var out bytes.Buffer
+	w := newWriter(&out, false, 1, 1)
+	go w.run()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	p := newProcessor(false, nil, in, w, 1, nil)
+	p.ctx = ctx
+	p.abort = cancel
+	p.onError = onError
+	p.run()
+	p.wait()
+	var err error
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	return out.String(), exitError(err, p.errors.count(), maxErrors)
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		onError   string
+		maxErrors int
+		// Prefix of the exit error, empty for success
+		exit    string
+		records int
+	}{
+		{onErrorSkip, -1, "", 1},
+		{onErrorSkip, 0, "Too many files could not be read: 1", 1},
+		{onErrorSkip, 1, "", 1},
+		{onErrorFlag, -1, "", 2},
+		{onErrorFlag, 0, "Too many files could not be read: 1", 2},
+		{onErrorFlag, 1, "", 2},
+		{onErrorAbort, -1, "Scan failed: aborted after error: ", 1},
+		{onErrorAbort, 1, "Scan failed: aborted after error: ", 1},
+	}
+	for _, test := range tests {
+		out, err := runPolicy(t, test.onError, test.maxErrors)
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		if !strings.HasPrefix(msg, test.exit) || (test.exit == "") != (err == nil) {
+			t.Errorf("-on-error %s -max-errors %d: expected exit error %q, got %v", test.onError, test.maxErrors, test.exit, err)
+		}
+		if n := strings.Count(out, "file:"); n != test.records {
+			t.Errorf("-on-error %s -max-errors %d: expected %d records, got %d", test.onError, test.maxErrors, test.records, n)
+		}
+	}
+	if err := exitError(errInterrupted, 5, 0); err != errInterrupted {
+		t.Errorf("interrupted run: expected %v, got %v", errInterrupted, err)
+	}
+}
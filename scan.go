@@ -5,10 +5,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 func sumBytes(bs []byte) int {
@@ -23,39 +32,113 @@ type file struct {
 	os.FileInfo
 	path string
 	base string
+	// File was deleted, FileInfo is nil
+	deleted bool
 }
 
 func makeFile(f os.FileInfo, name string) file {
-	return file{f, path.Dir(name), path.Base(name)}
+	return file{f, path.Dir(name), path.Base(name), false}
+}
+
+func makeDeletedFile(name string) file {
+	return file{nil, path.Dir(name), path.Base(name), true}
 }
 
 func (f *file) name() string {
 	return path.Join(f.path, f.base)
 }
 
+// Policies for symbolic links found while scanning.
+const (
+	linksSkip       = "skip"
+	linksFollow     = "follow"
+	linksWithinRoot = "within-root"
+)
+
+func validLinkPolicy(s string) bool {
+	switch s {
+	case linksSkip, linksFollow, linksWithinRoot:
+		return true
+	}
+	return false
+}
+
+// A symbolic link that was not followed.
+type skippedLink struct {
+	name   string
+	target string
+	reason string
+}
+
 type indexer struct {
-	stash chan string
-	dirs  chan string
-	wn    chan int
-	out   chan file
-	ws    int
-	wi    int
+	stash  chan string
+	dirs   chan string
+	done   chan struct{}
+	out    chan file
+	queue  *dirQueue
+	depth  atomic.Int64
+	active atomic.Int64
+	ws     int
+	wi     int
+	roots  []string
+	filter *pathFilter
+	links  string
+	// Called with each directory before it is scanned.
+	onDir func(dir string)
+	// All errors found while scanning.
+	errors *errorReport
+	// Tracks completed directories for checkpoints, if not nil.
+	track *tracker
+	// Progress counters.
+	stats *stats
+	// Directories found through symlinks.
+	aliases chan string
+	// Directories to scan instead of the roots when resuming.
+	start   []string
+	resumed bool
+	// Do not cross into other filesystems, except allowed mounts.
+	xdev   bool
+	mounts []pattern
+	// Protects the fields below, shared by all workers.
+	mu sync.Mutex
+	// Directories already queued, to detect loops.
+	visited map[fileID]bool
+	// Roots with all symlinks resolved.
+	realRoots map[string]string
+	skipped   []skippedLink
+	// Devices of roots and allowed mount points.
+	devices map[uint64]bool
+	// Mount points that were not scanned.
+	skippedMounts []string
+	// Directories whose scan was interrupted.
+	interrupted []string
 }
 
-func newIndexer(ws, wi int) *indexer {
+func newIndexer(ws, wi, queued int) *indexer {
 	return &indexer{
 		// dirs scheduled to be scanned.
 		stash: make(chan string),
+		// dirs found through symlinks, followed after the others.
+		aliases: make(chan string),
 		// dirs is for directories to scan from dispatcher to workers.
 		dirs: make(chan string),
-		// wn is for workers status.
-		wn: make(chan int),
+		// done is for workers finishing a directory.
+		done: make(chan struct{}),
 		// out is for all found files.
 		out: make(chan file),
+		// dirs waiting to be scanned, at most queued in memory.
+		queue: newDirQueue(queued),
 		// number of workers
 		ws: ws,
 		// unmber of this worker
 		wi: wi,
+		// symlink policy
+		links:     linksFollow,
+		visited:   make(map[fileID]bool),
+		realRoots: make(map[string]string),
+		devices:   make(map[uint64]bool),
+		errors:    newErrorReport(nil),
+		stats:     newStats(),
 	}
 }
 
@@ -70,131 +153,539 @@ func (i *indexer) sink() <-chan file {
 	return i.out
 }
 
-func (s *indexer) scan(root string, n int) {
+// Root directory that contains name, the longest one if roots are nested.
+func (i *indexer) rootOf(name string) string {
+	var root string
+	for _, r := range i.roots {
+		if len(r) <= len(root) {
+			continue
+		}
+		switch {
+		case r == ".":
+			if !path.IsAbs(name) && name != ".." && !strings.HasPrefix(name, "../") {
+				root = r
+			}
+		case r == "/":
+			if path.IsAbs(name) {
+				root = r
+			}
+		case name == r || strings.HasPrefix(name, r+"/"):
+			root = r
+		}
+	}
+	return root
+}
+
+// Returns true if name must not be scanned or processed because
+// of include and exclude patterns.
+func (i *indexer) skip(name string, dir bool) bool {
+	if i.filter == nil {
+		return false
+	}
+	return i.filter.skip(relPath(i.rootOf(name), name), dir)
+}
+
+// Returns true if a directory containing name is excluded, so that
+// name would not be found by scanning its root.
+func (i *indexer) skipParents(name string) bool {
+	if i.filter == nil {
+		return false
+	}
+	rel := relPath(i.rootOf(name), name)
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if i.filter.skip(dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the storage roots to scan or validate paths against.
+// Returns the roots to scan, without those that are the same
+// directory as an earlier root.
+func (s *indexer) setRoots(roots []string) []string {
+	s.roots = roots
+	var scan []string
+	seen := make(map[string]bool)
+	for _, root := range roots {
+		if seen[root] {
+			continue
+		}
+		seen[root] = true
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			if real, err = filepath.Abs(real); err == nil {
+				s.realRoots[root] = real
+			}
+		}
+		if finfo, err := os.Stat(root); err == nil {
+			if !s.visit(finfo) {
+				continue
+			}
+			if id, ok := statID(finfo); ok {
+				s.devices[id.dev] = true
+			}
+		}
+		scan = append(scan, root)
+	}
+	return scan
+}
+
+// Scans all roots with n workers until all directories are scanned,
+// an error occurs or ctx is canceled.  The output is closed when all
+// workers have stopped.
+func (s *indexer) scan(ctx context.Context, roots []string, n int) error {
+	defer close(s.out)
+	if len(roots) == 0 {
+		return nil
+	}
+	roots = s.setRoots(roots)
+	defer s.queue.close()
+	// Workers are stopped also when dispatching fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(n)
 	for i := 0; i < n; i++ {
-		go s.worker(i)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx)
+		}()
+	}
+	// All roots are queued like any other directory so that
+	// all trees share the same workers and output stream.
+	start := roots
+	if s.resumed {
+		start = s.start
+		s.visitTracked()
+	} else {
+		for _, root := range roots {
+			s.track.queue(root)
+		}
 	}
-	// One worker will pick this up and stop until dispatch starts.
-	s.dirs <- root
-	s.dispatch(n)
+	err := s.dispatch(ctx, start)
+	close(s.dirs)
+	cancel()
+	wg.Wait()
+	return err
 }
 
-func (i *indexer) worker(n int) {
+func (i *indexer) worker(ctx context.Context) {
 	for dir := range i.dirs {
-		i.wn <- n
-		i.readdir(dir)
-		i.wn <- n
+		if i.readdir(ctx, dir) {
+			i.track.scanned(dir)
+		} else {
+			i.mu.Lock()
+			i.interrupted = append(i.interrupted, dir)
+			i.mu.Unlock()
+		}
+		select {
+		case i.done <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (s *indexer) dispatch(n int) {
-	workerActive := make(map[int]bool)
-	dirs := make([]string, 0)
-	for {
-		select {
-		// Append a directory to scan.
-		case dir := <-s.stash:
-			dirs = append(dirs, dir)
-		// A worker has started or stopped working.
-		case m := <-s.wn:
-			// Flip this worker between active and inactive
-			workerActive[m] = !workerActive[m]
-		}
-		freeWorkers := 0
-		for i := 0; i < n; i++ {
-			// Send one dir out per free worker.
-			// If no worker is free, send nothing and
-			// keep collecting dirs until a worker is free.
-			if !workerActive[i] {
-				freeWorkers++
-			}
+// Scan the pending directories of an interrupted run instead of the roots.
+func (s *indexer) resume(dirs []string) {
+	s.start = dirs
+	s.resumed = true
+}
+
+// Marks the directories completed or pending in the interrupted run as
+// visited, so that symlinks to them are not followed and scanned again.
+func (s *indexer) visitTracked() {
+	completed, pending := s.track.snapshot()
+	for _, dir := range append(completed, pending...) {
+		if finfo, err := os.Stat(dir); err == nil {
+			s.visit(finfo)
 		}
-		// If there are more directories to scan,
-		// send out the first one and one worker will
-		// pick it up.  The dirs chan shouldn't be buffered.
-		if len(dirs) == 0 && freeWorkers == n {
-			break
+	}
+}
+
+// Hands out queued directories to free workers and queues the
+// subdirectories they find, until there is nothing left to scan.
+func (s *indexer) dispatch(ctx context.Context, start []string) error {
+	for _, dir := range start {
+		if err := s.queue.push(dir); err != nil {
+			return err
 		}
-		if len(dirs) == 0 {
+	}
+	var (
+		active int
+		// Directories found through symlinks, scanned when
+		// nothing else is left.
+		aliases []string
+	)
+	for s.queue.len() > 0 || active > 0 || len(aliases) > 0 {
+		s.depth.Store(int64(s.queue.len() + len(aliases)))
+		s.active.Store(int64(active))
+		if s.queue.len() == 0 && active == 0 {
+			var err error
+			if aliases, err = s.followAliases(aliases); err != nil {
+				return err
+			}
 			continue
 		}
-		for i := 0; i < freeWorkers; i++ {
-			var dir string
-			dir, dirs = dirs[0], dirs[1:]
-			s.dirs <- dir
-			for m := range s.wn {
-				workerActive[m] = !workerActive[m]
-				if workerActive[m] {
-					break
-				}
-			}
-			if len(dirs) == 0 {
-				break
+		// Only try to send when there is something to send:
+		// a nil channel is never ready.
+		var (
+			dirs chan<- string
+			next string
+		)
+		if s.queue.len() > 0 {
+			var err error
+			if next, err = s.queue.peek(); err != nil {
+				return err
 			}
+			dirs = s.dirs
 		}
-		// If there are no pending dirs to scan,
-		// and no worker is still active, we have finished.
-		var cont bool
-		for i := 0; i < n; i++ {
-			if workerActive[i] {
-				cont = true
-				break
+		select {
+		case dir := <-s.stash:
+			if err := s.queue.push(dir); err != nil {
+				return err
 			}
+		case dir := <-s.aliases:
+			aliases = append(aliases, dir)
+		case dirs <- next:
+			s.queue.pop()
+			active++
+		case <-s.done:
+			active--
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.depth.Store(0)
+	s.active.Store(0)
+	return nil
+}
+
+// Queues the first of the directories found through symlinks that was
+// not already visited by another path.  Those that were are reported
+// and not scanned.  Returns the directories left.
+func (s *indexer) followAliases(aliases []string) ([]string, error) {
+	sort.Strings(aliases)
+	for len(aliases) > 0 {
+		name := aliases[0]
+		aliases = aliases[1:]
+		finfo, err := os.Stat(name)
+		if err != nil {
+			s.errors.add(newFileError(name, stageScan, "stat", err))
+			s.track.scanned(name)
+			continue
 		}
-		if !cont {
-			break
+		if !s.visit(finfo) {
+			target, _ := os.Readlink(name)
+			s.skipLink(name, target, "already visited")
+			s.track.scanned(name)
+			continue
 		}
+		return aliases, s.queue.push(name)
 	}
-	close(s.stash)
-	close(s.dirs)
-	close(s.out)
-	close(s.wn)
+	return nil, nil
+}
+
+// Number of directories waiting to be scanned.
+func (i *indexer) pending() int {
+	return int(i.depth.Load())
+}
+
+// Number of workers scanning a directory.
+func (i *indexer) scanning() int {
+	return int(i.active.Load())
+}
+
+// Marks a directory as visited.  Returns false if it was
+// already visited, which means that following it would loop.
+func (i *indexer) visit(finfo os.FileInfo) bool {
+	id, ok := statID(finfo)
+	if !ok {
+		return true
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.visited[id] {
+		return false
+	}
+	i.visited[id] = true
+	return true
+}
+
+// Returns false if the directory is a mount point that must not
+// be crossed in one-filesystem mode.
+func (i *indexer) sameDevice(name string, finfo os.FileInfo) bool {
+	if !i.xdev {
+		return true
+	}
+	id, ok := statID(finfo)
+	if !ok {
+		return true
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.devices[id.dev] {
+		return true
+	}
+	// The device of an allowed mount point is allowed from now on,
+	// so that its subdirectories are scanned too.
+	if lastMatch(i.mounts, relPath(i.rootOf(name), name), true) {
+		i.devices[id.dev] = true
+		return true
+	}
+	i.skippedMounts = append(i.skippedMounts, name)
+	return false
+}
+
+func (i *indexer) skipLink(name, target, reason string) {
+	i.mu.Lock()
+	i.skipped = append(i.skipped, skippedLink{name, target, reason})
+	i.mu.Unlock()
+}
+
+// Returns true if the resolved name is inside the root it was found in.
+func (i *indexer) withinRoot(name string) bool {
+	real, ok := i.realRoots[i.rootOf(name)]
+	if !ok {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return false
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return false
+	}
+	return target == real || strings.HasPrefix(target, strings.TrimSuffix(real, "/")+"/")
+}
+
+// Applies the symlink policy to f, updating its finfo with that of the
+// file pointed by the symlink, but keeping the link name.  Returns false
+// if the link must not be followed.
+func (i *indexer) followLink(f *file) bool {
+	name := f.name()
+	target, _ := os.Readlink(name)
+	if i.links == linksSkip {
+		i.skipLink(name, target, "skipped")
+		return false
+	}
+	finfo, err := os.Stat(name)
+	if err != nil {
+		i.skipLink(name, target, "broken")
+		return false
+	}
+	if i.links == linksWithinRoot && !i.withinRoot(name) {
+		i.skipLink(name, target, "outside root")
+		return false
+	}
+	f.FileInfo = finfo
+	return true
+}
+
+// Applies the symlink policy to the directories that contain name,
+// which scanning would have reached through symlinks if they do not
+// resolve to the same path below the root.  Returns false if name
+// would not have been found by scanning.
+func (i *indexer) followParents(name string) bool {
+	if i.links == linksFollow {
+		return true
+	}
+	dir := path.Dir(name)
+	target, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		// Reported when name cannot be read.
+		return true
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return true
+	}
+	root := i.rootOf(dir)
+	if real, ok := i.realRoots[root]; ok && target == filepath.Join(real, relPath(root, dir)) {
+		return true
+	}
+	if i.links == linksSkip {
+		i.skipLink(dir, target, "skipped")
+		return false
+	}
+	if !i.withinRoot(dir) {
+		i.skipLink(dir, target, "outside root")
+		return false
+	}
+	return true
 }
 
-func (i *indexer) readdir(dirname string) {
+// Writes a report of all symlinks that were not followed
+// and all mount points that were not crossed.
+func (i *indexer) report(w io.Writer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, l := range i.skipped {
+		fmt.Fprintf(w, "Symlink %s: %s -> %s\n", l.reason, l.name, l.target)
+	}
+	for _, m := range i.skippedMounts {
+		fmt.Fprintf(w, "Mount point skipped: %s\n", m)
+	}
+}
+
+// Scans a directory.  Returns false if ctx was canceled
+// before the directory was completely scanned.
+func (i *indexer) readdir(ctx context.Context, dirname string) bool {
+	if i.onDir != nil {
+		i.onDir(dirname)
+	}
 	dir, err := os.Open(dirname)
 	if err != nil {
-		log.Print(err)
-		return
+		i.errors.add(newFileError(dirname, stageScan, "open", err))
+		return true
 	}
 	defer dir.Close()
 	for {
 		names, err := dir.Readdirnames(1024)
 		if err != nil {
 			if err != io.EOF {
-				log.Print(err)
+				i.errors.add(newFileError(dirname, stageScan, "readdir", err))
 			}
-			return
+			return true
 		}
 		for _, name := range names {
 			name = path.Join(dirname, name)
 			finfo, err := os.Lstat(name)
 			if err != nil {
-				log.Print(err)
+				i.errors.add(newFileError(name, stageScan, "lstat", err))
 				continue
 			}
+			i.stats.stage(stageStat).add(0)
 			f := makeFile(finfo, name)
-			// For synlinks, update the finfo with that of the file
-			// pointed by the symlink, but keep the link name.
-			if f.Mode()&os.ModeSymlink == os.ModeSymlink {
-				finfo, err = os.Stat(name)
-				if err != nil {
-					log.Print(err)
-					continue
-				}
-				f.FileInfo = finfo
+			link := f.Mode()&os.ModeSymlink == os.ModeSymlink
+			if link && !i.followLink(&f) {
+				continue
 			}
-			// Subdirectories are queued for scanning
+			// Subdirectories are queued for scanning, unless excluded:
+			// pruning here means excluded trees are never opened.
 			if f.IsDir() {
-				i.stash <- f.name()
+				if i.skip(name, true) || !i.sameDevice(name, f.FileInfo) {
+					continue
+				}
+				// Links are followed after all other directories are
+				// scanned: directories are then found by their real path,
+				// and their files have the same identifiers in every run.
+				queue := i.stash
+				if link {
+					queue = i.aliases
+				} else if !i.visit(f.FileInfo) {
+					continue
+				}
+				// When resuming, directories can be already known.
+				if !i.track.queue(name) {
+					continue
+				}
+				select {
+				case queue <- f.name():
+				case <-ctx.Done():
+					return false
+				}
 				continue
 			}
-			// Regular files are queued for processing
-			if f.Mode().IsRegular() {
-				if i.canProcess(f) {
-					i.out <- f
-				}
+			if !i.emit(ctx, f) {
+				return false
 			}
 		}
 	}
 }
+
+// Writes where an interrupted scan stopped.
+func (i *indexer) stopped(w io.Writer) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fmt.Fprintf(w, "Directories not scanned: %d\n", i.pending())
+	for _, dir := range i.interrupted {
+		fmt.Fprintf(w, "Directory partially scanned: %s\n", dir)
+	}
+}
+
+// Regular files are queued for processing.  Returns false
+// if ctx was canceled.
+func (i *indexer) emit(ctx context.Context, f file) bool {
+	if f.Mode().IsRegular() && !i.skip(f.name(), false) {
+		if i.canProcess(f) {
+			i.track.add(f.path)
+			i.stats.found.Add(1)
+			select {
+			case i.out <- f:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns name as it would be found by scanning the root that
+// contains it, or an error if name is outside of all storage roots.
+func (i *indexer) storagePath(name string) (string, error) {
+	name = path.Clean(filepath.ToSlash(name))
+	if root := i.rootOf(name); root != "" && root != name {
+		return name, nil
+	}
+	// The list could use absolute paths while roots are
+	// relative, or the other way around.
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range i.roots {
+		rabs, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(abs, strings.TrimSuffix(rabs, "/")+"/") {
+			return path.Join(root, relPath(rabs, abs)), nil
+		}
+	}
+	return "", errors.New("outside of storage root")
+}
+
+// Index files listed in r instead of scanning the roots.  Names
+// are separated by sep and must be inside one of the roots.
+func (i *indexer) list(ctx context.Context, roots []string, r io.Reader, sep byte) error {
+	defer close(i.out)
+	i.setRoots(roots)
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if n := bytes.IndexByte(data, sep); n >= 0 {
+			return n + 1, data[:n], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		name, err := i.storagePath(line)
+		if err != nil {
+			i.errors.add(newFileError(line, stageScan, "validate", err))
+			continue
+		}
+		if i.skipParents(name) || !i.followParents(name) {
+			continue
+		}
+		finfo, err := os.Lstat(name)
+		if err != nil {
+			i.errors.add(newFileError(name, stageScan, "lstat", err))
+			continue
+		}
+		i.stats.stage(stageStat).add(0)
+		f := makeFile(finfo, name)
+		if f.Mode()&os.ModeSymlink == os.ModeSymlink && !i.followLink(&f) {
+			continue
+		}
+		if !i.emit(ctx, f) {
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
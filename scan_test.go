@@ -0,0 +1,251 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Creates the files and, for names with a "->", symlinks below dir.
+func makeTree(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		if link, target, ok := strings.Cut(name, " -> "); ok {
+			if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns the sorted names of the files found by run.
+func collect(i *indexer, run func() error) ([]string, error) {
+	var names []string
+	done := make(chan struct{})
+	go func() {
+		for f := range i.sink() {
+			names = append(names, f.name())
+		}
+		close(done)
+	}()
+	err := run()
+	<-done
+	sort.Strings(names)
+	return names, err
+}
+
+func TestListFilters(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	makeTree(t, outside, "passwd.txt")
+	makeTree(t, dir, "root/a/x.txt", "root/_processed_/x.txt", "root/link -> "+outside)
+	root := filepath.ToSlash(filepath.Join(dir, "root"))
+	list := strings.Join([]string{
+		root + "/a/x.txt",
+		root + "/_processed_/x.txt",
+		root + "/link/passwd.txt",
+	}, "\n")
+	for _, links := range []string{linksFollow, linksWithinRoot, linksSkip} {
+		i := newIndexer(1, 0, 10)
+		i.filter = newPathFilter([]string{"_processed_/"}, nil)
+		i.links = links
+		names, err := collect(i, func() error {
+			return i.list(context.Background(), []string{root}, strings.NewReader(list), '\n')
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{root + "/a/x.txt"}
+		if links == linksFollow {
+			expected = append(expected, root+"/link/passwd.txt")
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("symlinks %s: expected %v got %v", links, expected, names)
+		}
+	}
+}
+
+func TestScanPrefersRealPath(t *testing.T) {
+	dir := t.TempDir()
+	// The alias is found and sorts before the directory it points to
+	makeTree(t, dir, "z/real/f.txt", "a -> z/real")
+	root := filepath.ToSlash(dir)
+	for run := 0; run < 3; run++ {
+		i := newIndexer(1, 0, 10)
+		names, err := collect(i, func() error {
+			return i.scan(context.Background(), []string{root}, 4)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{root + "/z/real/f.txt"}; !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected %v got %v", expected, names)
+		}
+		var report strings.Builder
+		i.report(&report)
+		if !strings.Contains(report.String(), "already visited: "+root+"/a ") {
+			t.Errorf("alias not reported: %q", report.String())
+		}
+	}
+}
+
+func TestScanResumeSkipsCompleted(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "z/real/f.txt", "b/g.txt", "b/link -> ../z/real")
+	root := filepath.ToSlash(dir)
+	i := newIndexer(1, 0, 10)
+	i.track = newTracker()
+	c := &checkpoint{
+		Completed: []string{root, root + "/z", root + "/z/real"},
+		Pending:   []string{root + "/b"},
+	}
+	if err := c.restore(i.track, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	i.resume(c.Pending)
+	names, err := collect(i, func() error {
+		return i.scan(context.Background(), []string{root}, 4)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{root + "/b/g.txt"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v got %v", expected, names)
+	}
+}
+
+func TestScanMultipleRoots(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "fileadmin/a.txt", "fileadmin/sub/b.txt", "uploads/c.txt", "alias -> fileadmin")
+	root := filepath.ToSlash(dir)
+	fileadmin, uploads, sub := root+"/fileadmin", root+"/uploads", root+"/fileadmin/sub"
+	all := []string{fileadmin + "/a.txt", fileadmin + "/sub/b.txt", uploads + "/c.txt"}
+	tests := []struct {
+		roots    []string
+		expected []string
+	}{
+		{[]string{fileadmin, uploads}, all},
+		// Roots given twice or through a symlink are scanned once
+		{[]string{uploads, fileadmin, uploads}, all},
+		{[]string{fileadmin, root + "/alias", uploads}, all},
+		// Nested roots are scanned once, by the root given first
+		{[]string{fileadmin, sub, uploads}, all},
+		{[]string{sub, fileadmin, uploads}, all},
+	}
+	for _, test := range tests {
+		i := newIndexer(1, 0, 10)
+		names, err := collect(i, func() error {
+			return i.scan(context.Background(), test.roots, 4)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("roots %v: expected %v got %v", test.roots, test.expected, names)
+		}
+	}
+	// Paths are matched against filters relative to the innermost root
+	i := newIndexer(1, 0, 10)
+	i.setRoots([]string{fileadmin, sub})
+	for name, expected := range map[string]string{
+		fileadmin + "/a.txt":     fileadmin,
+		fileadmin + "/sub/b.txt": sub,
+		uploads + "/c.txt":       "",
+	} {
+		if r := i.rootOf(name); r != expected {
+			t.Errorf("%s: expected root %q got %q", name, expected, r)
+		}
+	}
+}
+
+// Fails if more than n goroutines are still running after a while.
+func checkGoroutines(t *testing.T, n int) {
+	for start := time.Now(); runtime.NumGoroutine() > n; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left running, expected %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+	}
+}
+
+// Scans a tree of wide directories and cancels when stop returns true
+// before a directory is scanned.  Found files are read only if drain.
+func scanCanceled(t *testing.T, i *indexer, drain bool, stop func() bool) {
+	dir := t.TempDir()
+	var names []string
+	for d := 0; d < 40; d++ {
+		names = append(names, fmt.Sprintf("d%02d/f.txt", d), fmt.Sprintf("d%02d/sub/f.txt", d))
+	}
+	makeTree(t, dir, names...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	i.onDir = func(string) {
+		if stop() {
+			cancel()
+		}
+	}
+	if drain {
+		go func() {
+			for range i.sink() {
+			}
+		}()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- i.scan(ctx, []string{filepath.ToSlash(dir)}, 4)
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the scan to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan not stopped after cancel")
+	}
+	// The output is closed when the scan returns
+	for range i.sink() {
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	n := runtime.NumGoroutine()
+	i := newIndexer(1, 0, 10)
+	var dirs atomic.Int32
+	// Nobody reads the files found: workers block until canceled
+	scanCanceled(t, i, false, func() bool { return dirs.Add(1) == 3 })
+	checkGoroutines(t, n)
+}
+
+func TestScanCancelFullQueue(t *testing.T) {
+	n := runtime.NumGoroutine()
+	// At most one directory in memory, the others are spilled
+	i := newIndexer(1, 0, 1)
+	scanCanceled(t, i, true, func() bool { return i.pending() > 20 })
+	checkGoroutines(t, n)
+	if i.queue.file == nil {
+		t.Fatal("queue not spilled")
+	}
+	if _, err := os.Stat(i.queue.file.Name()); !os.IsNotExist(err) {
+		t.Errorf("queue file not removed: %v", err)
+	}
+}
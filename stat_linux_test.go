@@ -0,0 +1,93 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// Directory on device dev.
+type devInfo struct {
+	testInfo
+	dev uint64
+}
+
+func (i devInfo) IsDir() bool      { return true }
+func (i devInfo) Sys() interface{} { return &syscall.Stat_t{Dev: i.dev, Ino: 1} }
+
+func newMountIndexer(mounts ...string) *indexer {
+	i := newIndexer(1, 0, 10)
+	i.xdev = true
+	i.roots = []string{"/srv/site"}
+	i.devices[1] = true
+	for _, m := range mounts {
+		i.mounts = append(i.mounts, makePattern(m))
+	}
+	return i
+}
+
+func TestSameDeviceMounts(t *testing.T) {
+	tests := []struct {
+		mounts  []string
+		name    string
+		allowed bool
+	}{
+		{nil, "/srv/site/user_upload/nfs", false},
+		{[]string{"user_upload/nfs"}, "/srv/site/user_upload/nfs", true},
+		// Anchored patterns match the whole path, not a prefix
+		{[]string{"user_upload/nfs"}, "/srv/site/user_upload/nfs2", false},
+		{[]string{"user_upload/nfs"}, "/srv/site/user_upload/nfs/sub", false},
+		{[]string{"user_upload"}, "/srv/site/user_upload/nfs", false},
+		{[]string{"user_upload/*"}, "/srv/site/user_upload/nfs", true},
+		{[]string{"user_upload/**"}, "/srv/site/user_upload/nfs/sub", true},
+		// Leading and trailing slashes do not change the match
+		{[]string{"/user_upload/nfs"}, "/srv/site/user_upload/nfs", true},
+		{[]string{"user_upload/nfs/"}, "/srv/site/user_upload/nfs", true},
+		{[]string{"/user_upload/nfs/"}, "/srv/site/user_upload/nfs", true},
+		// Patterns without a slash match the name at any depth
+		{[]string{"nfs"}, "/srv/site/a/b/nfs", true},
+		{[]string{"nfs"}, "/srv/site/a/nfs2", false},
+		// The last matching pattern decides
+		{[]string{"user_upload/*", "!user_upload/nfs"}, "/srv/site/user_upload/nfs", false},
+	}
+	for _, test := range tests {
+		i := newMountIndexer(test.mounts...)
+		if ok := i.sameDevice(test.name, devInfo{dev: 2}); ok != test.allowed {
+			t.Errorf("-mount %q: %s: expected %v got %v", test.mounts, test.name, test.allowed, ok)
+		}
+		var skipped []string
+		if !test.allowed {
+			skipped = []string{test.name}
+		}
+		if !reflect.DeepEqual(i.skippedMounts, skipped) {
+			t.Errorf("-mount %q: %s: expected skipped mounts %v got %v", test.mounts, test.name, skipped, i.skippedMounts)
+		}
+	}
+}
+
+func TestSameDeviceAllowedMount(t *testing.T) {
+	i := newMountIndexer("user_upload/nfs")
+	if !i.sameDevice("/srv/site/other", devInfo{dev: 1}) {
+		t.Error("directory on the device of the root not allowed")
+	}
+	if !i.sameDevice("/srv/site/user_upload/nfs", devInfo{dev: 2}) {
+		t.Fatal("allowed mount not allowed")
+	}
+	// Subdirectories of an allowed mount are on its device
+	if !i.sameDevice("/srv/site/user_upload/nfs/sub", devInfo{dev: 2}) {
+		t.Error("subdirectory of an allowed mount not allowed")
+	}
+	if i.sameDevice("/srv/site/user_upload/nfs/sub/other", devInfo{dev: 3}) {
+		t.Error("mount below an allowed mount allowed")
+	}
+	i.xdev = false
+	if !i.sameDevice("/srv/site/x", devInfo{dev: 4}) {
+		t.Error("other device not allowed without -xdev")
+	}
+}
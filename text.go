@@ -0,0 +1,255 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Extracts the plain text of the contents into t.
+type textExtractor func(c *contents, t *plainText) error
+
+// Returns the extractor of the plain text of files of type mime,
+// nil if their text is not extracted.
+func textExtractorOf(mime string) textExtractor {
+	switch {
+	case strings.HasPrefix(mime, "text/"):
+		return textContents
+	case mime == "application/pdf":
+		return pdfPlainText
+	case strings.HasPrefix(mime, "application/vnd.openxmlformats-officedocument."):
+		return ooxmlText
+	case strings.HasPrefix(mime, "application/vnd.oasis.opendocument."):
+		return odfText
+	}
+	return nil
+}
+
+// Plain text of a file, up to a maximum size in bytes.
+type plainText struct {
+	b   strings.Builder
+	max int
+	// Text was cut at the maximum size
+	truncated bool
+}
+
+// Returns true if no more text can be added.
+func (t *plainText) full() bool {
+	return t.truncated
+}
+
+// Adds s, without control characters other than tabs and new lines.
+func (t *plainText) write(s string) {
+	if t.truncated {
+		return
+	}
+	s = strings.Map(func(r rune) rune {
+		if r < ' ' && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, s)
+	if rest := t.max - t.b.Len(); len(s) > rest {
+		// Runes are not cut
+		for rest > 0 && !utf8.RuneStart(s[rest]) {
+			rest--
+		}
+		s = s[:rest]
+		t.truncated = true
+	}
+	t.b.WriteString(s)
+}
+
+// Separates the text that follows with a space, unless it already is.
+func (t *plainText) space() {
+	if s := t.b.String(); s != "" && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\n") {
+		t.write(" ")
+	}
+}
+
+// Starts a new line, unless the text is empty or already at one.
+func (t *plainText) newline() {
+	if s := t.b.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		t.write("\n")
+	}
+}
+
+func (t *plainText) String() string {
+	return strings.TrimSpace(t.b.String())
+}
+
+// Characters 0x80 to 0x9f of Windows-1252; the others are Latin-1.
+var winAnsiEncoding = []rune("€�‚ƒ„…†‡ˆ‰Š‹Œ�Ž��‘’“”•–—˜™š›œ�žŸ")
+
+// Decodes text in Windows-1252, which most Latin-1 text really is.
+func winAnsiText(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		if c >= 0x80 && c <= 0x9f {
+			r[i] = winAnsiEncoding[c-0x80]
+		} else {
+			r[i] = rune(c)
+		}
+	}
+	return string(r)
+}
+
+// Extracts the text of text files, as it is: in UTF-16 or UTF-8 with
+// a byte order mark, in UTF-8, or else in Windows-1252.
+func textContents(c *contents, t *plainText) error {
+	n := min(c.size, int64(t.max))
+	b := c.at(0, n)
+	if b == nil {
+		return fmt.Errorf("%d bytes of text not readable", n)
+	}
+	defer func() {
+		if n < c.size {
+			t.truncated = true
+		}
+	}()
+	switch {
+	case bytes.HasPrefix(b, []byte("\xfe\xff")), bytes.HasPrefix(b, []byte("\xff\xfe")):
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			if b[0] == 0xfe {
+				u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+			} else {
+				u = append(u, uint16(b[i+1])<<8|uint16(b[i]))
+			}
+		}
+		t.write(string(utf16.Decode(u)))
+		return nil
+	case bytes.HasPrefix(b, []byte("\xef\xbb\xbf")):
+		b = b[3:]
+	}
+	// A rune cut at the end does not make the text invalid
+	if n < c.size {
+		for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(b[i]) {
+				if !utf8.FullRune(b[i:]) {
+					b = b[:i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(b) {
+		t.write(string(b))
+	} else {
+		t.write(winAnsiText(b))
+	}
+	return nil
+}
+
+// Line of the text file
+type textRecord struct {
+	IdentifierHash string `json:"identifier_hash"`
+	// Digest of the contents like in the sha1 column, SHA-1 or MD5
+	Digest    string `json:"digest"`
+	Algorithm string `json:"algorithm"`
+	Text      string `json:"text"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// Writes the plain text of files as JSON Lines.
+type textWriter struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error
+	// Maximum size of the text of each file
+	max int
+	// Records of a previous run: the text of unchanged
+	// contents is not extracted again
+	delta delta
+	// Files written and those whose text was cut
+	files, truncated int
+	// Size of the text flushed so far
+	offset int64
+}
+
+func newTextWriter(w io.Writer, max int, d delta) *textWriter {
+	tw := &textWriter{w: bufio.NewWriter(w), max: max, delta: d}
+	tw.enc = json.NewEncoder(tw.w)
+	tw.enc.SetEscapeHTML(false)
+	return tw
+}
+
+// Writes the plain text of the contents c of p, if its type has text
+// and the contents changed since the delta.  Returns the size of the
+// text written.  The text extracted before an error is still written.
+func (w *textWriter) extract(p *props, c *contents) (int, error) {
+	if w == nil {
+		return 0, nil
+	}
+	fn := textExtractorOf(p.mime)
+	if fn == nil {
+		return 0, nil
+	}
+	sum := p.sum()
+	if e := w.delta[p.ident]; e != nil && e.sum == sum {
+		return 0, nil
+	}
+	t := &plainText{max: w.max}
+	err := fn(c, t)
+	text := t.String()
+	if err != nil && text == "" {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.enc.Encode(textRecord{fmt.Sprintf("%x", p.ident), sum, primaryDigest(), text, t.truncated})
+	}
+	w.files++
+	if t.truncated {
+		w.truncated++
+	}
+	return len(text), err
+}
+
+func (w *textWriter) flush() error {
+	_, err := w.sync()
+	return err
+}
+
+// Flushes the text and returns the size of the file.
+func (w *textWriter) sync() (int64, error) {
+	if w == nil {
+		return 0, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := w.w.Buffered()
+	if err := w.w.Flush(); err != nil {
+		return 0, err
+	}
+	w.offset += int64(n)
+	return w.offset, nil
+}
+
+// Writes the number of files whose text was written.
+func (w *textWriter) summary(out io.Writer) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Fprintf(out, "Files with text extracted: %d\n", w.files)
+	if w.truncated > 0 {
+		fmt.Fprintf(out, "Files with text truncated at %d bytes: %d\n", w.max, w.truncated)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTextContents(t *testing.T) {
+	tests := []struct {
+		data, text string
+		max        int
+		truncated  bool
+	}{
+		{"\xef\xbb\xbfH\xc3\xa4llo\r\nw\x00orld\n", "Hällo\r\nworld", 100, false},
+		{"caf\xe9 \x80", "café €", 100, false},
+		{"\xff\xfeH\x00i\x00", "Hi", 100, false},
+		// Runes are not cut
+		{"H\xc3\xa4llo", "H", 2, true},
+		{"Hello", "Hel", 3, true},
+	}
+	for _, tt := range tests {
+		text := &plainText{max: tt.max}
+		c := &contents{head: []byte(tt.data), size: int64(len(tt.data))}
+		if err := textContents(c, text); err != nil {
+			t.Errorf("%q: %s", tt.data, err)
+		}
+		if text.String() != tt.text || text.truncated != tt.truncated {
+			t.Errorf("%q: expected %q (%v), got %q (%v)", tt.data, tt.text, tt.truncated, text.String(), text.truncated)
+		}
+	}
+}
+
+func TestTextWriter(t *testing.T) {
+	var b bytes.Buffer
+	p := &props{mime: "text/plain"}
+	p.ident[0], p.chash[0] = 1, 2
+	d := makeDelta()
+	w := newTextWriter(&b, 100, d)
+	data := []byte("<b>R&D</b>")
+	if _, err := w.extract(p, &contents{head: data, size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged contents are not written again
+	d[p.ident] = &entry{sum: p.sum()}
+	w.extract(p, &contents{head: data, size: int64(len(data))})
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"identifier_hash":"01` + strings.Repeat("0", 38) + `","digest":"02` + strings.Repeat("0", 38) + `","algorithm":"sha1","text":"<b>R&D</b>"}` + "\n"
+	if b.String() != expect {
+		t.Errorf("expected %s, got %s", expect, b.String())
+	}
+}
+
+func TestTextWriterMD5(t *testing.T) {
+	defer func(m bool) { *useMd5 = m }(*useMd5)
+	*useMd5 = true
+	var b bytes.Buffer
+	p := &props{mime: "text/plain"}
+	w := newTextWriter(&b, 100, nil)
+	data := []byte("x")
+	if _, err := w.extract(p, &contents{head: data, size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `"algorithm":"md5"`) {
+		t.Errorf("expected the MD5 algorithm, got %s", b.String())
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Files are processed when closed after writing rather than on
+// IN_MODIFY, which would process them while only partly written.
+// Changes of attributes, like a new modification time, are processed
+// immediately.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// Time to wait for the other half of a move, after which a directory
+// moved away is known to have left the tree.
+const moveWait = 100 * time.Millisecond
+
+// One inotify event
+type event struct {
+	wd     int32
+	mask   uint32
+	cookie uint32
+	name   string
+}
+
+// Watches all scanned directories and emits the files that changed.
+type watcher struct {
+	idx *indexer
+	fd  int
+	// Protects dirs, as directories are added by scan workers.
+	mu sync.Mutex
+	// Directory name for each watch descriptor
+	dirs map[int32]string
+	out  chan file
+	// Files emitted and not deleted since, to know which files were
+	// in a directory that left the tree.  Only used by run.
+	files map[string]bool
+	// Directory moved away, waiting for the matching move event
+	moved       string
+	movedCookie uint32
+}
+
+func newWatcher(idx *indexer) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	return &watcher{
+		idx:   idx,
+		fd:    fd,
+		dirs:  make(map[int32]string),
+		out:   make(chan file),
+		files: make(map[string]bool),
+	}, nil
+}
+
+func (w *watcher) sink() <-chan file {
+	return w.out
+}
+
+// Starts watching dir for changes.
+func (w *watcher) add(dir string) {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		log.Print(dir, ": Watch: ", err)
+		return
+	}
+	w.mu.Lock()
+	w.dirs[int32(wd)] = dir
+	w.mu.Unlock()
+}
+
+func (w *watcher) dir(wd int32) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir, ok := w.dirs[wd]
+	return dir, ok
+}
+
+// Updates or removes the watches of dir and its subdirectories after
+// it was moved to newdir, or out of the watched tree if newdir is empty.
+func (w *watcher) rename(dir, newdir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for wd, name := range w.dirs {
+		if name != dir && !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		if newdir == "" {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+			continue
+		}
+		w.dirs[wd] = newdir + name[len(dir):]
+	}
+}
+
+// Forwards the files found by the initial scan, then emits
+// changes for as long as there are events or until ctx is canceled.
+func (w *watcher) run(ctx context.Context, scanned <-chan file) {
+	events := make(chan event)
+	go w.read(events)
+	stop := ctx.Done()
+	// Fires when a directory moved away was not moved back in.
+	var moved <-chan time.Time
+	for scanned != nil || events != nil {
+		select {
+		case f, ok := <-scanned:
+			if !ok {
+				scanned = nil
+				continue
+			}
+			w.emit(f)
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.handle(ev)
+			moved = nil
+			if w.moved != "" {
+				moved = time.After(moveWait)
+			}
+		case <-moved:
+			moved = nil
+			w.movedOut()
+		case <-stop:
+			// The scan stops by itself, but the events
+			// would never stop.
+			events, stop = nil, nil
+		}
+	}
+	close(w.out)
+}
+
+func (w *watcher) read(events chan<- event) {
+	defer close(events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Print("Watch: ", os.NewSyscallError("read", err))
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			var raw syscall.InotifyEvent
+			raw.Wd = int32(binary.NativeEndian.Uint32(buf[off:]))
+			raw.Mask = binary.NativeEndian.Uint32(buf[off+4:])
+			raw.Cookie = binary.NativeEndian.Uint32(buf[off+8:])
+			raw.Len = binary.NativeEndian.Uint32(buf[off+12:])
+			off += syscall.SizeofInotifyEvent
+			end := off + int(raw.Len)
+			if end > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[off:end], "\x00"))
+			off = end
+			events <- event{raw.Wd, raw.Mask, raw.Cookie, name}
+		}
+	}
+}
+
+func (w *watcher) handle(ev event) {
+	if ev.mask&syscall.IN_Q_OVERFLOW != 0 {
+		log.Print("Watch: event queue overflow, some changes were lost")
+		return
+	}
+	dir, ok := w.dir(ev.wd)
+	if !ok {
+		return
+	}
+	if ev.mask&syscall.IN_IGNORED != 0 {
+		w.mu.Lock()
+		delete(w.dirs, ev.wd)
+		w.mu.Unlock()
+		return
+	}
+	if ev.name == "" {
+		return
+	}
+	name := path.Join(dir, ev.name)
+	isDir := ev.mask&syscall.IN_ISDIR != 0
+	// A directory moved away is only known to have left the tree if
+	// the next event is not the other half of the move.
+	if w.moved != "" && !(ev.mask&syscall.IN_MOVED_TO != 0 && ev.cookie == w.movedCookie) {
+		w.movedOut()
+	}
+	switch {
+	case ev.mask&syscall.IN_MOVED_FROM != 0:
+		if isDir {
+			w.moved, w.movedCookie = name, ev.cookie
+			return
+		}
+		w.deleted(name)
+	case ev.mask&syscall.IN_DELETE != 0:
+		// Files in deleted directories have their own events, but
+		// some could be lost with the watches of subdirectories.
+		if isDir {
+			w.removed(name)
+			return
+		}
+		w.deleted(name)
+	case ev.mask&syscall.IN_MOVED_TO != 0:
+		if !isDir {
+			w.changed(name)
+			return
+		}
+		old := w.moved
+		w.moved = ""
+		if old != "" {
+			w.rename(old, name)
+		}
+		w.walk(name, old)
+	case ev.mask&syscall.IN_CREATE != 0:
+		// Regular files are processed when closed after writing.
+		if isDir {
+			w.walk(name, "")
+			return
+		}
+		if finfo, err := os.Lstat(name); err == nil && finfo.Mode()&os.ModeSymlink != 0 {
+			w.changed(name)
+		}
+	case ev.mask&syscall.IN_CLOSE_WRITE != 0:
+		w.changed(name)
+	case ev.mask&syscall.IN_ATTRIB != 0:
+		if !isDir {
+			w.changed(name)
+		}
+	}
+}
+
+// Emits the files of the directory moved away as deleted, as it
+// left the tree.
+func (w *watcher) movedOut() {
+	dir := w.moved
+	w.moved = ""
+	w.rename(dir, "")
+	w.removed(dir)
+}
+
+// Emits the files still known in a directory that is gone as deleted.
+func (w *watcher) removed(dir string) {
+	var names []string
+	for name := range w.files {
+		if strings.HasPrefix(name, dir+"/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.deleted(name)
+	}
+}
+
+// Emits f, remembering which files exist.
+func (w *watcher) emit(f file) {
+	if f.deleted {
+		delete(w.files, f.name())
+	} else {
+		w.files[f.name()] = true
+	}
+	w.out <- f
+}
+
+func (w *watcher) deleted(name string) {
+	f := makeDeletedFile(name)
+	if w.idx.skip(name, false) || !w.idx.canProcess(f) {
+		delete(w.files, name)
+		return
+	}
+	w.emit(f)
+}
+
+func (w *watcher) changed(name string) {
+	finfo, err := os.Lstat(name)
+	if err != nil {
+		// Already deleted: the delete event follows.
+		if !os.IsNotExist(err) {
+			w.idx.errors.add(newFileError(name, stageScan, "lstat", err))
+		}
+		return
+	}
+	f := makeFile(finfo, name)
+	if f.Mode()&os.ModeSymlink == os.ModeSymlink && !w.idx.followLink(&f) {
+		return
+	}
+	if f.Mode().IsRegular() && !w.idx.skip(name, false) && w.idx.canProcess(f) {
+		w.emit(f)
+	}
+}
+
+// Emits all files of a new directory.  If the directory was moved
+// inside the tree from old, its files are also emitted as deleted
+// from the old location.
+func (w *watcher) walk(dir, old string) {
+	finfo, err := os.Stat(dir)
+	if err != nil {
+		w.idx.errors.add(newFileError(dir, stageScan, "stat", err))
+		return
+	}
+	if w.idx.skip(dir, true) || !w.idx.sameDevice(dir, finfo) {
+		return
+	}
+	// Watch before reading, so that no file can be missed.
+	if old == "" {
+		w.add(dir)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		w.idx.errors.add(newFileError(dir, stageScan, "open", err))
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		w.idx.errors.add(newFileError(dir, stageScan, "readdir", err))
+	}
+	for _, base := range names {
+		name := path.Join(dir, base)
+		finfo, err := os.Lstat(name)
+		if err != nil {
+			w.idx.errors.add(newFileError(name, stageScan, "lstat", err))
+			continue
+		}
+		f := makeFile(finfo, name)
+		link := f.Mode()&os.ModeSymlink == os.ModeSymlink
+		if link && !w.idx.followLink(&f) {
+			continue
+		}
+		var from string
+		if old != "" {
+			from = path.Join(old, base)
+		}
+		if f.IsDir() {
+			if link && !w.idx.visit(f.FileInfo) {
+				continue
+			}
+			w.walk(name, from)
+			continue
+		}
+		if from != "" {
+			w.deleted(from)
+		}
+		if f.Mode().IsRegular() && !w.idx.skip(name, false) && w.idx.canProcess(f) {
+			w.emit(f)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchMovedOut(t *testing.T) {
+	root := filepath.ToSlash(t.TempDir())
+	outside := t.TempDir()
+	makeTree(t, root, "sub/f.txt")
+	idx := newIndexer(1, 0, 10)
+	idx.roots = []string{root}
+	w, err := newWatcher(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.add(root)
+	w.add(root + "/sub")
+	name := root + "/sub/f.txt"
+	finfo, err := os.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned := make(chan file, 1)
+	scanned <- makeFile(finfo, name)
+	close(scanned)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx, scanned)
+	if f := <-w.sink(); f.name() != name || f.deleted {
+		t.Fatalf("expected %s got %s (deleted %v)", name, f.name(), f.deleted)
+	}
+	// Nothing follows the move: it must be resolved without other events
+	if err := os.Rename(root+"/sub", filepath.Join(outside, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-w.sink():
+		if f.name() != name || !f.deleted {
+			t.Errorf("expected %s deleted, got %s (deleted %v)", name, f.name(), f.deleted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("files of the directory moved away were not deleted")
+	}
+}
+
+// Returns the next file emitted by w.
+func nextWatched(t *testing.T, w *watcher) file {
+	select {
+	case f := <-w.sink():
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("no file emitted")
+	}
+	return file{}
+}
+
+func TestWatchFilesPruned(t *testing.T) {
+	root := filepath.ToSlash(t.TempDir())
+	outside := t.TempDir()
+	makeTree(t, root, "g.txt", "sub/f.txt", "moved/h.txt")
+	idx := newIndexer(1, 0, 10)
+	idx.roots = []string{root}
+	w, err := newWatcher(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{root, root + "/sub", root + "/moved"} {
+		w.add(dir)
+	}
+	scanned := make(chan file, 3)
+	for _, name := range []string{"g.txt", "sub/f.txt", "moved/h.txt"} {
+		name = root + "/" + name
+		finfo, err := os.Lstat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned <- makeFile(finfo, name)
+	}
+	close(scanned)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx, scanned)
+	for n := 0; n < 3; n++ {
+		nextWatched(t, w)
+	}
+	expect := func(name string, deleted bool) {
+		if f := nextWatched(t, w); f.name() != root+"/"+name || f.deleted != deleted {
+			t.Fatalf("expected %s (deleted %v) got %s (deleted %v)", name, deleted, f.name(), f.deleted)
+		}
+	}
+	// A new modification time is a change, like writing
+	when := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(root+"/g.txt", when, when); err != nil {
+		t.Fatal(err)
+	}
+	expect("g.txt", false)
+	if err := os.Remove(root + "/g.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expect("g.txt", true)
+	if err := os.RemoveAll(root + "/sub"); err != nil {
+		t.Fatal(err)
+	}
+	expect("sub/f.txt", true)
+	if err := os.Rename(root+"/moved", filepath.Join(outside, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	expect("moved/h.txt", true)
+	cancel()
+	for range w.sink() {
+	}
+	if len(w.files) != 0 {
+		t.Errorf("expected no files left, got %v", w.files)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+type watcher struct {
+	out chan file
+}
+
+func newWatcher(idx *indexer) (*watcher, error) {
+	return nil, errors.New("watch mode is only supported on Linux")
+}
+
+func (w *watcher) sink() <-chan file {
+	return w.out
+}
+
+func (w *watcher) add(dir string) {}
+
+func (w *watcher) run(ctx context.Context, scanned <-chan file) {}
@@ -13,11 +13,28 @@ import (
 )
 
 type writer struct {
-	w        io.Writer
+	w        *bufio.Writer
 	ch       chan string
+	syncs    chan chan writerState
 	done     chan struct{}
 	min, inc int
 	transf   bool
+	// Last UID assigned
+	uid int
+	// Bytes written to the output
+	offset int64
+	// Number of records written
+	count int
+	// First write error, nothing is written after it
+	err   error
+	stats *stats
+}
+
+// Position of the writer after flushing.
+type writerState struct {
+	uid    int
+	offset int64
+	ok     bool
 }
 
 func newWriter(w io.Writer, transform bool, min, inc int) *writer {
@@ -28,13 +45,16 @@ func newWriter(w io.Writer, transform bool, min, inc int) *writer {
 		inc = 1
 	}
 	return &writer{
-		w: w,
+		w: bufio.NewWriter(w),
 		// It's a good idea to buffer this, esp. in SQL mode.
 		ch:     make(chan string, 16),
+		syncs:  make(chan chan writerState),
 		done:   make(chan struct{}),
 		min:    min,
 		inc:    inc,
 		transf: transform,
+		uid:    min,
+		stats:  newStats(),
 	}
 }
 
@@ -46,19 +66,111 @@ func (w *writer) close() {
 	close(w.ch)
 }
 
+// Writes all records until the writer is closed.  Each record is
+// written as a whole, so the output is well formed when the writer
+// returns, even if processing was interrupted.
 func (w *writer) run() {
-	uid := w.min
-	for s := range w.ch {
-		uid += w.inc
-		if w.transf {
-			s = strings.Replace(s, "UID", fmt.Sprintf("%d", uid), 2)
+	for open := true; open; {
+		select {
+		case s, ok := <-w.ch:
+			open = w.record(s, ok)
+		case c := <-w.syncs:
+			open = w.answer(c)
+		default:
+			// Flush while there is nothing to write, so that the output
+			// is not held back when records come in slowly.
+			w.flush()
+			select {
+			case s, ok := <-w.ch:
+				open = w.record(s, ok)
+			case c := <-w.syncs:
+				open = w.answer(c)
+			}
 		}
-		if _, err := io.WriteString(w.w, s); err != nil {
-			log.Print("Write to result: ", err)
-			break
+	}
+	w.flush()
+	close(w.done)
+}
+
+// Writes s before all records.  Must be called before run.
+func (w *writer) header(s string) {
+	n, err := w.w.WriteString(s)
+	w.offset += int64(n)
+	if err != nil {
+		log.Print("Write to result: ", err)
+		w.err = err
+	}
+}
+
+// Writes one record.  Returns false if the writer was closed.
+func (w *writer) record(s string, ok bool) bool {
+	if !ok {
+		return false
+	}
+	// Keep reading after an error, or the processors would
+	// block forever.
+	if w.err != nil {
+		return true
+	}
+	w.uid += w.inc
+	if w.transf {
+		s = strings.Replace(s, "UID", fmt.Sprintf("%d", w.uid), 2)
+	}
+	n, err := w.w.WriteString(s)
+	w.offset += int64(n)
+	if err != nil {
+		log.Print("Write to result: ", err)
+		w.err = err
+		return true
+	}
+	w.count++
+	w.stats.written.Add(1)
+	return true
+}
+
+// Writes all queued records and sends the resulting state.
+// Returns false if the writer was closed.
+func (w *writer) answer(c chan<- writerState) bool {
+	open := true
+	for drained := false; open && !drained; {
+		select {
+		case s, ok := <-w.ch:
+			open = w.record(s, ok)
+		default:
+			drained = true
 		}
 	}
-	w.done <- struct{}{}
+	w.flush()
+	c <- writerState{w.uid, w.offset, w.err == nil}
+	return open
+}
+
+// Returns the state of the writer after all records queued so far
+// have been written.  Returns false if the writer failed or finished.
+func (w *writer) sync() (uid int, offset int64, ok bool) {
+	c := make(chan writerState, 1)
+	select {
+	case w.syncs <- c:
+	case <-w.done:
+		return 0, 0, false
+	}
+	st := <-c
+	return st.uid, st.offset, st.ok
+}
+
+func (w *writer) flush() {
+	if w.err != nil {
+		return
+	}
+	if err := w.w.Flush(); err != nil {
+		log.Print("Write to result: ", err)
+		w.err = err
+	}
+}
+
+// Number of records waiting to be written.
+func (w *writer) backlog() int {
+	return len(w.ch)
 }
 
 func (w *writer) wait() {
@@ -71,6 +183,8 @@ type splitWriter struct {
 	uids   int
 	min    int
 	inc    int
+	// Drop the additional digests from the file lines
+	noDigests bool
 }
 
 func (s splitWriter) write(w io.Writer) error {
@@ -81,12 +195,28 @@ func (s splitWriter) write(w io.Writer) error {
 		s.inc = 1
 	}
 	uid := s.min
-	scanner := bufio.NewScanner(s.reader)
+	digests := 0
+	scanner := newLineScanner(s.reader)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if strings.HasPrefix(line, "info:") {
+			fields, err := parseFields(line[len("info:"):], false)
+			if err != nil {
+				return err
+			}
+			if len(fields) == 2 && fields[0] == "digests" && fields[1] != "" {
+				digests = len(strings.Split(fields[1], ","))
+			}
+			continue
+		}
 		if strings.HasPrefix(line, s.prefix) {
-			// Replacing the first occurrence of UID is safe here because file
-			// contains it as first field, meta as last but has only numeric fields.
+			if s.noDigests && s.prefix == "file:" {
+				line = dropFields(line, digests)
+			}
+			// Replacing the first occurrences of UID is safe here because file
+			// contains it as first field, and meta as first field and as the
+			// file field, before title, description and metadata columns that
+			// contain escaped text.
 			line = strings.Replace(line, "UID", fmt.Sprintf("%d", uid), s.uids)
 			if _, err := fmt.Fprintln(w, line[len(s.prefix):]); err != nil {
 				return err
@@ -96,3 +226,14 @@ func (s splitWriter) write(w io.Writer) error {
 	}
 	return scanner.Err()
 }
+
+// Removes the last n fields of line.  Only for fields that
+// cannot contain escaped text, like the digests.
+func dropFields(line string, n int) string {
+	for ; n > 0; n-- {
+		if i := strings.LastIndex(line, `,"`); i >= 0 {
+			line = line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Namespaces of the XMP properties used for metadata
+const (
+	nsRDF       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC        = "http://purl.org/dc/elements/1.1/"
+	nsXMP       = "http://ns.adobe.com/xap/1.0/"
+	nsPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+	nsIPTCCore  = "http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+	nsPDF       = "http://ns.adobe.com/pdf/1.3/"
+)
+
+// Properties of an XMP packet: the values of each property,
+// by namespace and name.
+type xmpProps map[xml.Name][]string
+
+func (p xmpProps) first(space, local string) string {
+	if v := p[xml.Name{Space: space, Local: local}]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (p xmpProps) join(space, local string) string {
+	return strings.Join(p[xml.Name{Space: space, Local: local}], ", ")
+}
+
+// Parses the properties of an XMP packet.  Simple properties can be
+// attributes or elements of rdf:Description; of arrays all items are
+// kept, of language alternatives only the default one or the first.
+func parseXMP(data []byte) (xmpProps, error) {
+	props := make(xmpProps)
+	d := xml.NewDecoder(bytes.NewReader(data))
+	// Ignore the encoding declared, packets are UTF-8 in practice
+	d.CharsetReader = func(label string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+	var (
+		// Property being read, empty outside of one
+		prop  xml.Name
+		depth int
+		text  strings.Builder
+		// Language alternative already has the default value
+		isDefault bool
+	)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return props, nil
+		}
+		if err != nil {
+			return props, fmt.Errorf("XMP: %s", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if prop.Local == "" {
+				if t.Name.Space == nsRDF && t.Name.Local == "Description" {
+					for _, a := range t.Attr {
+						if a.Name.Space != "" && a.Name.Space != nsRDF && a.Name.Space != "xmlns" {
+							props[a.Name] = append(props[a.Name], a.Value)
+						}
+					}
+					continue
+				}
+				if t.Name.Space == nsRDF || t.Name.Space == "adobe:ns:meta/" {
+					continue
+				}
+				prop, depth, isDefault = t.Name, 0, false
+				text.Reset()
+				continue
+			}
+			depth++
+			text.Reset()
+			if t.Name.Space == nsRDF && t.Name.Local == "li" {
+				isDefault = false
+				for _, a := range t.Attr {
+					if a.Name.Local == "lang" && a.Value == "x-default" {
+						isDefault = true
+					}
+				}
+			}
+		case xml.CharData:
+			if prop.Local != "" {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if prop.Local == "" {
+				continue
+			}
+			if depth == 0 {
+				// Simple property as element
+				if s := strings.TrimSpace(text.String()); s != "" && len(props[prop]) == 0 {
+					props[prop] = []string{s}
+				}
+				prop = xml.Name{}
+				continue
+			}
+			depth--
+			if t.Name.Space == nsRDF && t.Name.Local == "li" {
+				s := strings.TrimSpace(text.String())
+				switch {
+				case s == "":
+				case isDefault:
+					// The default language goes first
+					props[prop] = append([]string{s}, props[prop]...)
+					isDefault = false
+				default:
+					props[prop] = append(props[prop], s)
+				}
+			}
+			text.Reset()
+		}
+	}
+}
+
+// Extracts metadata from an XMP packet.
+func readXMP(data []byte, m metadata) error {
+	p, err := parseXMP(data)
+	// Properties before an error are still used
+	m.set("title", p.first(nsDC, "title"))
+	m.set("description", p.first(nsDC, "description"))
+	m.set("alternative", p.first(nsIPTCCore, "AltTextAccessibility"))
+	m.set("alternative", p.first(nsPhotoshop, "Headline"))
+	m.set("keywords", p.join(nsDC, "subject"))
+	m.set("keywords", p.first(nsPDF, "Keywords"))
+	m.set("creator", p.join(nsDC, "creator"))
+	m.set("copyright", p.first(nsDC, "rights"))
+	m.set("creator_tool", p.first(nsXMP, "CreatorTool"))
+	m.set("content_creation_date", xmpTime(p.first(nsXMP, "CreateDate")))
+	m.set("content_creation_date", xmpTime(p.first(nsPhotoshop, "DateCreated")))
+	m.set("content_modification_date", xmpTime(p.first(nsXMP, "ModifyDate")))
+	return err
+}
+
+// Returns the Unix time of an XMP date as a string.  Dates without
+// time zone are in dateZone.
+func xmpTime(s string) string {
+	if s == "" {
+		return ""
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return strconv.FormatInt(t.Unix(), 10)
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.ParseInLocation(layout, s, dateZone); err == nil {
+			return strconv.FormatInt(t.Unix(), 10)
+		}
+	}
+	return ""
+}
+
+// Maximum size of an XMP sidecar file.
+const sidecarSize = 1 << 20
+
+var errSidecarSize = errors.New("XMP sidecar too big")
+
+// Extracts metadata from the XMP sidecar of file name, "photo.xmp" or
+// "photo.jpg.xmp" next to "photo.jpg", if there is one.
+func readSidecar(name string, m metadata) error {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, sidecar := range []string{base + ".xmp", name + ".xmp"} {
+		f, err := os.Open(sidecar)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, sidecarSize+1))
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if len(data) > sidecarSize {
+			return errSidecarSize
+		}
+		if err := readXMP(data, m); err != nil {
+			return fmt.Errorf("%s: %s", sidecar, err)
+		}
+		return nil
+	}
+	return nil
+}
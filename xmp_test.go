@@ -0,0 +1,145 @@
+// Copyright 2015 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:Iptc4xmpCore="http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/"
+    xmp:CreatorTool="Camera Raw" xmp:CreateDate="2021-06-01T12:00:00+02:00"
+    photoshop:Headline="Headline">
+   <dc:title><rdf:Alt>
+     <rdf:li xml:lang="de">Titel</rdf:li>
+     <rdf:li xml:lang="x-default">Title &amp; more</rdf:li>
+   </rdf:Alt></dc:title>
+   <dc:description><rdf:Alt><rdf:li xml:lang="x-default">A description</rdf:li></rdf:Alt></dc:description>
+   <dc:subject><rdf:Bag><rdf:li>sea</rdf:li><rdf:li>boat</rdf:li></rdf:Bag></dc:subject>
+   <dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li></rdf:Seq></dc:creator>
+   <Iptc4xmpCore:AltTextAccessibility><rdf:Alt><rdf:li xml:lang="x-default">A boat on the sea</rdf:li></rdf:Alt></Iptc4xmpCore:AltTextAccessibility>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+func TestXMP(t *testing.T) {
+	m := make(metadata)
+	if err := readXMP([]byte(testXMP), m); err != nil {
+		t.Fatal(err)
+	}
+	expect := metadata{
+		"title":                 "Title & more",
+		"description":           "A description",
+		"alternative":           "A boat on the sea",
+		"keywords":              "sea, boat",
+		"creator":               "Jane Doe",
+		"creator_tool":          "Camera Raw",
+		"content_creation_date": strconv.FormatInt(time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC).Unix(), 10),
+	}
+	for k, v := range expect {
+		if m[k] != v {
+			t.Errorf("%s: expected %q got %q", k, v, m[k])
+		}
+	}
+	if len(m) != len(expect) {
+		t.Errorf("expected %d fields, got %v", len(expect), m)
+	}
+}
+
+func iptcDataset(dataset byte, s string) []byte {
+	b := []byte{0x1c, 2, dataset}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func testIPTC() []byte {
+	var b []byte
+	b = append(b, iptcDataset(iptcObjectName, "Object")...)
+	b = append(b, iptcDataset(iptcKeywords, "one")...)
+	b = append(b, iptcDataset(iptcKeywords, "zwei")...)
+	b = append(b, iptcDataset(iptcByline, "J\xf6rg")...)
+	b = append(b, iptcDataset(iptcCaption, "Caption")...)
+	b = append(b, iptcDataset(iptcCopyright, "(c) 2020")...)
+	b = append(b, iptcDataset(iptcDateCreated, "20200102")...)
+	return append(b, iptcDataset(iptcTimeCreated, "030405+0100")...)
+}
+
+func TestIPTC(t *testing.T) {
+	// IPTC in Photoshop resources of a JPEG, XMP takes precedence
+	res := []byte("8BIM\x04\x04\x00\x00")
+	iptc := testIPTC()
+	res = binary.BigEndian.AppendUint32(res, uint32(len(iptc)))
+	res = append(res, iptc...)
+	app13 := append(append([]byte{}, photoshopHeader...), res...)
+	app1 := append(append([]byte{}, xmpHeader...), `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title><rdf:Alt><rdf:li xml:lang="x-default">XMP title</rdf:li></rdf:Alt></dc:title></rdf:Description></rdf:RDF></x:xmpmeta>`...)
+	jpeg := []byte{0xff, 0xd8}
+	for _, seg := range []struct {
+		marker byte
+		data   []byte
+	}{{0xed, app13}, {0xe1, app1}} {
+		jpeg = append(jpeg, 0xff, seg.marker)
+		jpeg = binary.BigEndian.AppendUint16(jpeg, uint16(len(seg.data)+2))
+		jpeg = append(jpeg, seg.data...)
+	}
+	m := make(metadata)
+	if err := jpegMeta(&contents{head: jpeg, size: int64(len(jpeg))}, m); err != nil {
+		t.Fatal(err)
+	}
+	expect := metadata{
+		"title":                 "XMP title",
+		"keywords":              "one, zwei",
+		"creator":               "Jörg",
+		"description":           "Caption",
+		"copyright":             "(c) 2020",
+		"content_creation_date": strconv.FormatInt(time.Date(2020, 1, 2, 2, 4, 5, 0, time.UTC).Unix(), 10),
+	}
+	for k, v := range expect {
+		if m[k] != v {
+			t.Errorf("%s: expected %q got %q", k, v, m[k])
+		}
+	}
+	// Resources of odd size at the end, without padding
+	if b := photoshopResource([]byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x01A"), photoshopIPTC); string(b) != "A" {
+		t.Errorf("expected %q, got %q", "A", b)
+	}
+	if b := photoshopResource([]byte("8BIM\x04\x0c\x00\x00\x00\x00\x00\x01A"), photoshopIPTC); b != nil {
+		t.Errorf("expected no IPTC, got %q", b)
+	}
+}
+
+func TestPNGText(t *testing.T) {
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write([]byte(testXMP))
+	w.Close()
+	chunk := func(typ string, data []byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		b = append(append(b, typ...), data...)
+		return append(b, 0, 0, 0, 0)
+	}
+	png := append([]byte{}, pngHeader...)
+	png = append(png, chunk("IHDR", make([]byte, 13))...)
+	png = append(png, chunk("iTXt", append([]byte(pngXMPKeyword+"\x00\x01\x00\x00\x00"), z.Bytes()...))...)
+	png = append(png, chunk("IDAT", nil)...)
+	m := make(metadata)
+	if err := pngMeta(&contents{head: png, size: int64(len(png))}, m); err != nil {
+		t.Fatal(err)
+	}
+	if m["title"] != "Title & more" {
+		t.Errorf("expected the title of the XMP, got %v", m)
+	}
+}